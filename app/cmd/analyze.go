@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"main.go/utils"
+)
+
+type AnalyzeCmd struct {
+	ImageFlags `embed:""`
+	Top int `optional:"" default:"5" help:"number of the largest files to list for each layer"`
+	LowestEfficiency float64 `optional:"" help:"fail when the efficiency (0-1) is lower than this value"`
+	HighestWastedBytes string `optional:"" help:"fail when the wasted space is more than this size, eg: 20MB"`
+	Json bool `optional:"" help:"print the result as JSON"`
+
+	Image string `arg:"" help:"remote image, or local image file or folder"`
+}
+func (c *AnalyzeCmd) Run(debug bool) error {
+	image := c.newImage(c.Image)
+	return utils.AnalyzeImage(c.Image, &image, utils.AnalyzeOptions{
+		Top: c.Top,
+		LowestEfficiency: c.LowestEfficiency,
+		HighestWastedBytes: c.HighestWastedBytes,
+		Json: c.Json,
+	})
+}
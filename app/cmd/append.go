@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"main.go/utils"
+)
+
+type AppendCmd struct {
+	ImageFlags `embed:""`
+	Target string `optional:"" short:"t" help:"push the result to this image instead of <base>"`
+	Compression string `optional:"" enum:"gzip,zstd,none" default:"gzip" help:"compression for the new layers: gzip, zstd, none"`
+	Owner string `optional:"" default:"0:0" help:"owner <uid>:<gid> of the files in layers built from folders"`
+
+	Base string `arg:"" help:"base image"`
+	Layers []string `arg:"" help:"folders or tar files to append as new layers"`
+}
+func (c *AppendCmd) Run(debug bool) error {
+	base := c.newImage(c.Base)
+	target := base
+	if len(c.Target) > 0 {
+		target = c.newImage(c.Target)
+	}
+	return utils.AppendImage(&base, &target, c.Layers, utils.AppendOptions{
+		Compression: c.Compression,
+		Owner: c.Owner,
+	})
+}
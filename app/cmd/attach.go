@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"main.go/utils"
+)
+
+type AttachCmd struct {
+	ImageFlags `embed:""`
+	ArtifactType string `required:"" help:"type of the artifact, eg: application/spdx+json"`
+	MediaType string `optional:"" help:"media type of the file, default application/octet-stream"`
+	Annotation map[string]string `optional:"" help:"set artifact manifest annotation KEY=VALUE"`
+
+	Image string `arg:"" help:"image the artifact refers to, by tag or digest"`
+	File string `arg:"" help:"file to attach, eg: SBOM, signature, scan report"`
+}
+func (c *AttachCmd) Run(debug bool) error {
+	image := c.newImage(c.Image)
+	return utils.AttachArtifact(&image, c.File, utils.AttachOptions{
+		ArtifactType: c.ArtifactType,
+		MediaType: c.MediaType,
+		Annotations: c.Annotation,
+	})
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"os"
+
+	"main.go/utils"
+)
+
+type BundleCmd struct {
+	Create BundleCreateCmd `cmd:"" help:"Pack images with all their platforms into one archive for air-gapped registries"`
+	Import BundleImportCmd `cmd:"" help:"Verify a bundle and push all of its images to a registry"`
+}
+
+type BundleCreateCmd struct {
+	ImageFlags `embed:""`
+	Output string `short:"o" optional:"" default:"bundle.tar" help:"bundle file to write"`
+	List string `optional:"" help:"also bundle every image of this file (YAML, or one image per line)"`
+	Policy string `optional:"" help:"trust policy file checked before anything is downloaded; default $GO_DOCKER_POLICY"`
+
+	Images []string `arg:"" optional:"" help:"images to bundle; every platform of a manifest list is included"`
+}
+func (c *BundleCreateCmd) Run(debug bool) error {
+	policy := c.Policy
+	if len(policy) == 0 {
+		policy = os.Getenv("GO_DOCKER_POLICY")
+	}
+	image := c.newImage("")
+	return utils.CreateBundle(&image, c.Images, c.List, c.Output, utils.BundleOptions{
+		Policy: policy,
+	})
+}
+
+type BundleImportCmd struct {
+	ImageFlags `embed:""`
+	RegistryPrefix string `optional:"" help:"push every image in the bundle to <prefix>/<repository>:<tag>; this or --tag-template is required"`
+	TagTemplate string `optional:"" help:"push every image in the bundle to the tag rendered by this Go template, eg: my-registry.com/{{.Repository}}:{{.Tag}}; this or --registry-prefix is required"`
+	Policy string `optional:"" help:"trust policy file checked before anything is transferred; default $GO_DOCKER_POLICY"`
+
+	File string `arg:"" help:"bundle file written by bundle create"`
+}
+func (c *BundleImportCmd) Run(debug bool) error {
+	policy := c.Policy
+	if len(policy) == 0 {
+		policy = os.Getenv("GO_DOCKER_POLICY")
+	}
+	image := c.newImage("")
+	return utils.ImportBundle(&image, c.File, utils.BundleOptions{
+		Policy: policy,
+		RegistryPrefix: c.RegistryPrefix,
+		TagTemplate: c.TagTemplate,
+	})
+}
@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"main.go/utils"
+)
+
+type DiffCmd struct {
+	ImageFlags `embed:""`
+	Files bool `optional:"" help:"also compare the files of the flattened filesystems, this downloads every layer"`
+	Json bool `optional:"" help:"print the result as JSON"`
+
+	Old string `arg:"" help:"remote image, or local image file or folder"`
+	New string `arg:"" help:"remote image, or local image file or folder"`
+}
+func (c *DiffCmd) Run(debug bool) error {
+	oldImage := c.newImage(c.Old)
+	newImage := c.newImage(c.New)
+	return utils.DiffImages(c.Old, &oldImage, c.New, &newImage, utils.DiffOptions{
+		Files: c.Files,
+		Json: c.Json,
+	})
+}
@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"main.go/utils"
+)
+
+type ExportCmd struct {
+	ImageFlags `embed:""`
+
+	Image string `arg:""`
+	Output string `arg:"" optional:"" default:"-" help:"output tar file, - for stdout"`
+}
+func (c *ExportCmd) Run(debug bool) error {
+	image := c.newImage(c.Image)
+	return utils.ExportImage(&image, c.Output)
+}
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"os"
+
+	"main.go/utils"
+)
+
+type FindImagesCmd struct {
+	ImageFlags `embed:""`
+	Output string `short:"o" optional:"" help:"write the images to this list file, for pull --list and lock"`
+	Pull string `optional:"" help:"pull every image found into this directory"`
+	Concurrency int `optional:"" default:"4" help:"number of images pulled at the same time with --pull"`
+
+	Paths []string `arg:"" help:"Kubernetes manifests or Compose files; directories are searched for .yaml and .yml files"`
+}
+func (c *FindImagesCmd) Run(debug bool) error {
+	image := c.newImage("")
+	return utils.FindImages(&image, c.Paths, utils.FindImagesOptions{
+		Output: c.Output,
+		Pull: c.Pull,
+		Concurrency: c.Concurrency,
+		PullOptions: utils.PullOptions{Policy: os.Getenv("GO_DOCKER_POLICY")},
+	})
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"os"
+
+	"main.go/utils"
+)
+
+// 访问镜像仓库的通用参数
+type ImageFlags struct {
+	Username string `optional:""`
+	Password string `optional:""`
+	Os string `optional:""`
+	Architecture string `optional:""`
+	Variant string `optional:""`
+	Mirror string `optional:""`
+
+	InsecureRegistry bool `optional:""`		// 指定使用 http 协议，否则使用 https
+}
+
+func (f *ImageFlags) newImage(name string) utils.Image {
+	username := f.Username
+	passowrd := f.Password
+	if len(username) == 0 {
+		username = os.Getenv("GO_DOCKER_USERNAME")
+	}
+	if len(passowrd) == 0 {
+		passowrd = os.Getenv("GO_DOCKER_PASSWORD")
+	}
+
+	osName := f.Os
+	architecture := f.Architecture
+	if len(osName) == 0 {								// 默认使用 linux 的镜像
+		osName = "linux"
+	}
+	if len(architecture) == 0 {					// 默认使用 amd64 的镜像
+		architecture = "amd64"
+	}
+
+	return utils.NewImage(name, username, passowrd, f.InsecureRegistry, f.Mirror, osName, architecture, f.Variant)
+}
@@ -3,4 +3,18 @@ package cmd
 type Cli struct {
 	Pull PullCmd `cmd:"" help:"Pull Image"`
 	Push PushCmd `cmd:"" help:"Push Image"`
+	Export ExportCmd `cmd:"" help:"Export the flattened filesystem of an image as a tar file"`
+	Squash SquashCmd `cmd:"" help:"Merge all layers of an image into one layer"`
+	Append AppendCmd `cmd:"" help:"Append folders or tar files to an image as new layers"`
+	Mutate MutateCmd `cmd:"" help:"Edit the config and annotations of an image without downloading its layers"`
+	Rebase RebaseCmd `cmd:"" help:"Move an image onto a new base image"`
+	Diff DiffCmd `cmd:"" help:"Compare the layers, config and files of two images"`
+	Analyze AnalyzeCmd `cmd:"" help:"Report the largest files of each layer and the space wasted by overwritten or deleted files"`
+	Sbom SbomCmd `cmd:"" help:"Generate an SPDX or CycloneDX SBOM from the packages installed in an image"`
+	Attach AttachCmd `cmd:"" help:"Attach a file (SBOM, signature, scan report) to an image through the OCI referrers API"`
+	Referrers ReferrersCmd `cmd:"" help:"List the artifacts attached to an image"`
+	Sign SignCmd `cmd:"" help:"Sign an image with a local key, in the cosign signature format"`
+	Lock LockCmd `cmd:"" help:"Resolve the tags of a list of images to digests and write a lockfile"`
+	FindImages FindImagesCmd `cmd:"" help:"Find the images used by Kubernetes manifests and Compose files"`
+	Bundle BundleCmd `cmd:"" help:"Create and import air-gap bundles of several images"`
 }
\ No newline at end of file
@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"main.go/utils"
+)
+
+type LockCmd struct {
+	ImageFlags `embed:""`
+	Output string `short:"o" optional:"" default:"images.lock" help:"lockfile to write, or to check with --check"`
+	Check bool `optional:"" help:"report the images whose tags point to other digests than in the lockfile, instead of writing it"`
+
+	List string `arg:"" optional:"" help:"file with one image per line; with --check, also report the images missing in the lockfile"`
+}
+func (c *LockCmd) Run(debug bool) error {
+	image := c.newImage("")
+	return utils.LockImages(&image, c.List, utils.LockOptions{
+		Lockfile: c.Output,
+		Check: c.Check,
+	})
+}
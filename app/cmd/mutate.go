@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"encoding/json"
+	"strings"
+
+	"main.go/utils"
+)
+
+type MutateCmd struct {
+	ImageFlags `embed:""`
+	Tag string `optional:"" short:"t" help:"push the result to this image instead of overwriting <image>"`
+
+	Entrypoint string `optional:"" help:"new entrypoint, as a JSON array or space separated words"`
+	Cmd string `optional:"" help:"new cmd, as a JSON array or space separated words"`
+	Env []string `optional:"" help:"set environment variable KEY=VALUE"`
+	Label map[string]string `optional:"" help:"set label KEY=VALUE"`
+	User string `optional:"" help:"new user"`
+	Workdir string `optional:"" help:"new working directory"`
+	Expose []string `optional:"" help:"expose port <port>[/<protocol>]"`
+	Annotation map[string]string `optional:"" help:"set manifest annotation KEY=VALUE"`
+
+	Image string `arg:""`
+}
+func (c *MutateCmd) Run(debug bool) error {
+	source := c.newImage(c.Image)
+	target := source
+	if len(c.Tag) > 0 {
+		target = c.newImage(c.Tag)
+	}
+
+	opts := utils.MutateOptions{
+		Env: c.Env,
+		Labels: c.Label,
+		User: c.User,
+		WorkingDir: c.Workdir,
+		ExposePorts: c.Expose,
+		Annotations: c.Annotation,
+	}
+	var err error
+	if opts.Entrypoint, err = parseCommand(c.Entrypoint); err != nil {
+		return err
+	}
+	if opts.Cmd, err = parseCommand(c.Cmd); err != nil {
+		return err
+	}
+	return utils.MutateImage(&source, &target, opts)
+}
+
+// 解析 JSON 数组或以空格分隔的命令，未指定时返回 nil
+func parseCommand(value string) ([]string, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		command := []string{}
+		err := json.Unmarshal([]byte(value), &command)
+		return command, err
+	}
+	return strings.Fields(value), nil
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 
 	"main.go/utils"
@@ -13,13 +14,22 @@ type PullCmd struct {
 	Architecture string `optional:""`
 	Variant string `optional:""`
 	Mirror string `optional:""`
+	Unpack string `optional:"" help:"unpack the layers into this directory as the root filesystem instead of creating a docker-archive"`
+	Rootless string `optional:"" enum:",xattr,sidecar" default:"" help:"unpack without root: record ownership in the user.containers.override_stat xattr, or in a <dir>.mtree sidecar"`
+	SubidUser string `optional:"" help:"map the ownership of unpacked files into the /etc/subuid and /etc/subgid range of this user"`
+	VerifyKey string `optional:"" help:"refuse the image unless it has a valid signature for this PEM public key"`
+	Policy string `optional:"" help:"trust policy file checked before anything is transferred; default $GO_DOCKER_POLICY"`
+	DecryptionKey []string `optional:"" help:"PEM private key used to decrypt +encrypted layers (JWE or PKCS7 wrapped keys); can be repeated"`
+	Lockfile string `optional:"" help:"pull the digest recorded for the image in this lockfile (see lock) instead of the current tag"`
+	List string `optional:"" help:"pull every image of this file (YAML, or one '<image> [<os>/<arch>] [<name>]' per line); the only argument is then the directory"`
+	Concurrency int `optional:"" default:"4" help:"number of images pulled at the same time with --list"`
 
 	InsecureRegistry bool `optional:""`		// 指定使用 http 协议，否则使用 https
 	Image struct {
-		Image string `arg:""`
+		Image string `arg:"" optional:""`
 		Dir struct {
 			Dir string `arg:"" optional:""`
-		} `arg`
+		} `arg:""`
 	} `arg:""`
 }
 func (c *PullCmd) Run(debug bool) error {
@@ -31,6 +41,10 @@ func (c *PullCmd) Run(debug bool) error {
 	if len(passowrd) == 0 {
 		passowrd = os.Getenv("GO_DOCKER_PASSWORD")
 	}
+	policy := c.Policy
+	if len(policy) == 0 {
+		policy = os.Getenv("GO_DOCKER_POLICY")
+	}
 
 	osName := c.Os
 	architecture := c.Architecture
@@ -43,12 +57,33 @@ func (c *PullCmd) Run(debug bool) error {
 		architecture = "amd64"
 	}
 
+	imageName := c.Image.Image
 	dir := c.Image.Dir.Dir
+	if len(c.List) > 0 {								// 批量下载时只有目录参数
+		if len(dir) > 0 {
+			return fmt.Errorf("<image> cannot be used with --list")
+		}
+		imageName, dir = "", imageName
+	} else if len(imageName) == 0 {
+		return fmt.Errorf("<image> is required")
+	}
 	if len(dir) == 0 {									// 默认下载到当前目录
 		dir, _ = os.Getwd()
 	}
 
-	image := utils.NewImage(c.Image.Image, username, passowrd, c.InsecureRegistry, c.Mirror, osName, architecture, variant)
+	image := utils.NewImage(imageName, username, passowrd, c.InsecureRegistry, c.Mirror, osName, architecture, variant)
 
-	return utils.PullImage(&image, dir)
+	opts := utils.PullOptions{
+		Unpack: c.Unpack,
+		Rootless: c.Rootless,
+		SubIDUser: c.SubidUser,
+		VerifyKey: c.VerifyKey,
+		Policy: policy,
+		DecryptionKeys: c.DecryptionKey,
+		Lockfile: c.Lockfile,
+	}
+	if len(c.List) > 0 {
+		return utils.PullImageList(&image, c.List, dir, c.Concurrency, opts)
+	}
+	return utils.PullImage(&image, dir, opts)
 }
\ No newline at end of file
@@ -12,14 +12,17 @@ type PushCmd struct {
 	Os string `optional:""`
 	Architecture string `optional:""`
 	Variant string `optional:""`
+	Compression string `optional:"" enum:"gzip,zstd,none" default:"gzip" help:"compression for uncompressed layers: gzip, zstd, none"`
 
 	InsecureRegistry bool `optional:""`		// 指定使用 http 协议，否则使用 https
-	File struct {
-		File string `arg:""`
-		Image struct {
-			Image string `arg:""`
-		} `arg`
-	} `arg`
+	RegistryPrefix string `optional:"" help:"push every image in the file to <prefix>/<repository>:<tag>"`
+	TagTemplate string `optional:"" help:"push every image in the file to the tag rendered by this Go template, eg: my-registry.com/{{.Repository}}:{{.Tag}}"`
+	Policy string `optional:"" help:"trust policy file checked before anything is transferred; default $GO_DOCKER_POLICY"`
+	EncryptionKey []string `optional:"" help:"encrypt layers for this recipient, [jwe:]<PEM public key or certificate>; can be repeated"`
+	EncryptLayer []int `optional:"" help:"index of the layer to encrypt, negative counts from the top layer; default all layers"`
+
+	File string `arg:"" help:"image file or folder; use [<os>/<arch>[/<variant>]=]<file>,... to push a multi-platform image"`
+	Image string `arg:"" optional:"" help:"target image; omit it to push every image in the file to its RepoTags"`
 }
 func (c *PushCmd) Run(debug bool) error {
 	username := c.Username
@@ -30,6 +33,10 @@ func (c *PushCmd) Run(debug bool) error {
 	if len(passowrd) == 0 {
 		passowrd = os.Getenv("GO_DOCKER_PASSWORD")
 	}
+	policy := c.Policy
+	if len(policy) == 0 {
+		policy = os.Getenv("GO_DOCKER_POLICY")
+	}
 
 	osName := c.Os
 	architecture := c.Architecture
@@ -42,7 +49,14 @@ func (c *PushCmd) Run(debug bool) error {
 		architecture = "amd64"
 	}
 
-	image := utils.NewImage(c.File.Image.Image, username, passowrd, c.InsecureRegistry, "", osName, architecture, variant)
+	image := utils.NewImage(c.Image, username, passowrd, c.InsecureRegistry, "", osName, architecture, variant)
 
-	return utils.PushImage(c.File.File, &image)
+	return utils.PushImage(c.File, &image, utils.PushOptions{
+		Compression: c.Compression,
+		RegistryPrefix: c.RegistryPrefix,
+		TagTemplate: c.TagTemplate,
+		Policy: policy,
+		EncryptionKeys: c.EncryptionKey,
+		EncryptLayers: c.EncryptLayer,
+	})
 }
\ No newline at end of file
@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"main.go/utils"
+)
+
+type RebaseCmd struct {
+	ImageFlags `embed:""`
+	OldBase string `required:"" help:"the base image that <image> was built on"`
+	NewBase string `required:"" help:"the base image to move <image> onto"`
+	Tag string `optional:"" short:"t" help:"push the result to this image instead of overwriting <image>"`
+
+	Image string `arg:""`
+}
+func (c *RebaseCmd) Run(debug bool) error {
+	image := c.newImage(c.Image)
+	oldBase := c.newImage(c.OldBase)
+	newBase := c.newImage(c.NewBase)
+	target := image
+	if len(c.Tag) > 0 {
+		target = c.newImage(c.Tag)
+	}
+	return utils.RebaseImage(&image, &oldBase, &newBase, &target)
+}
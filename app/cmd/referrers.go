@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"main.go/utils"
+)
+
+type ReferrersCmd struct {
+	ImageFlags `embed:""`
+	ArtifactType string `optional:"" help:"only list artifacts of this type"`
+	Json bool `optional:"" help:"print the referrers as an OCI image index"`
+
+	Image string `arg:"" help:"image to list the artifacts of, by tag or digest"`
+}
+func (c *ReferrersCmd) Run(debug bool) error {
+	image := c.newImage(c.Image)
+	return utils.ListReferrers(&image, utils.ReferrersOptions{
+		ArtifactType: c.ArtifactType,
+		Json: c.Json,
+	})
+}
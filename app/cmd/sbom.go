@@ -0,0 +1,20 @@
+package cmd
+
+import (
+	"main.go/utils"
+)
+
+type SbomCmd struct {
+	ImageFlags `embed:""`
+	Format string `optional:"" enum:"spdx,cyclonedx" default:"spdx" help:"SBOM format: spdx, cyclonedx"`
+	Output string `optional:"" short:"o" help:"write the SBOM to this file instead of stdout"`
+
+	Image string `arg:"" help:"remote image, or local image file or folder"`
+}
+func (c *SbomCmd) Run(debug bool) error {
+	image := c.newImage(c.Image)
+	return utils.GenerateSbom(c.Image, &image, utils.SbomOptions{
+		Format: c.Format,
+		Output: c.Output,
+	})
+}
@@ -0,0 +1,22 @@
+package cmd
+
+import (
+	"main.go/utils"
+)
+
+type SignCmd struct {
+	ImageFlags `embed:""`
+	Key string `required:"" help:"PEM private key (ECDSA or ed25519, unencrypted)"`
+	Referrer bool `optional:"" help:"push the signature as an OCI referrer instead of the sha256-<hex>.sig tag"`
+	Annotation map[string]string `optional:"" help:"add KEY=VALUE to the optional section of the signed payload"`
+
+	Image string `arg:"" help:"image to sign, by tag or digest"`
+}
+func (c *SignCmd) Run(debug bool) error {
+	image := c.newImage(c.Image)
+	return utils.SignImage(&image, utils.SignOptions{
+		Key: c.Key,
+		Referrer: c.Referrer,
+		Annotations: c.Annotation,
+	})
+}
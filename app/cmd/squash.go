@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"fmt"
+
+	"main.go/utils"
+)
+
+type SquashCmd struct {
+	ImageFlags `embed:""`
+	Output string `optional:"" short:"o" help:"save the squashed image as a docker-archive tar file"`
+	Compression string `optional:"" enum:"gzip,zstd,none" default:"gzip" help:"compression of the squashed layer when pushing: gzip, zstd, none"`
+
+	Source string `arg:"" help:"remote image, or local image file or folder; - for stdin"`
+	Target string `arg:"" optional:"" help:"push the squashed image to this image"`
+}
+func (c *SquashCmd) Run(debug bool) error {
+	if len(c.Output) == 0 && len(c.Target) == 0 {
+		return fmt.Errorf("either <target> or --output is required")
+	}
+
+	image := c.newImage(c.Source)
+	opts := utils.SquashOptions{
+		Output: c.Output,
+		RepoTag: c.Target,
+		Compression: c.Compression,
+	}
+
+	var target *utils.Image
+	if len(c.Target) > 0 {
+		targetImage := c.newImage(c.Target)
+		target = &targetImage
+	}
+	return utils.SquashImage(c.Source, &image, target, opts)
+}
@@ -69,4 +69,42 @@ func Test_ParseImage(t *testing.T) {
 	assert.Equal(t, "node", ret.Slug)
 	assert.Equal(t, "library/node", ret.Repository)
 	assert.Equal(t, "registry-1.docker.io", ret.Registry)
+
+	// 同时有 tag 和 hash 时使用 hash
+	ret.ParseImage("localhost:5000/user/image:tag@sha256:075012d2072be942e17da73a35278be89707266010fb6977bfc43dae5d492ab4")
+	assert.Equal(t, "user", ret.Namespace)
+	assert.Equal(t, "image", ret.ImageName)
+	assert.Equal(t, "sha256:075012d2072be942e17da73a35278be89707266010fb6977bfc43dae5d492ab4", ret.Tag)
+	assert.Equal(t, "localhost:5000/user/image", ret.Slug)
+	assert.Equal(t, "user/image", ret.Repository)
+	assert.Equal(t, "localhost:5000", ret.Registry)
+
+	// docker.io 为官方仓库
+	ret.ParseImage("docker.io/library/node:10-apline")
+	assert.Equal(t, "library", ret.Namespace)
+	assert.Equal(t, "node", ret.ImageName)
+	assert.Equal(t, "10-apline", ret.Tag)
+	assert.Equal(t, "library/node", ret.Repository)
+	assert.Equal(t, "registry-1.docker.io", ret.Registry)
+
+	ret.ParseImage("docker.io/user/image")
+	assert.Equal(t, "user/image", ret.Slug)
+	assert.Equal(t, "user/image", ret.Repository)
+	assert.Equal(t, "registry-1.docker.io", ret.Registry)
+}
+
+func Test_Reference(t *testing.T) {
+	var ret utils.Image
+
+	ret.ParseImage("node")
+	assert.Equal(t, "docker.io/library/node:latest", ret.Reference())
+
+	ret.ParseImage("docker.io/library/node:10-apline")
+	assert.Equal(t, "docker.io/library/node:10-apline", ret.Reference())
+
+	ret.ParseImage("user/image:tag")
+	assert.Equal(t, "docker.io/user/image:tag", ret.Reference())
+
+	ret.ParseImage("localhost:5000/user/image:tag@sha256:075012d2072be942e17da73a35278be89707266010fb6977bfc43dae5d492ab4")
+	assert.Equal(t, "localhost:5000/user/image@sha256:075012d2072be942e17da73a35278be89707266010fb6977bfc43dae5d492ab4", ret.Reference())
 }
\ No newline at end of file
@@ -0,0 +1,299 @@
+package utils
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+type AnalyzeOptions struct {
+	Top                int     // 每个 layer 列出的最大文件数
+	LowestEfficiency   float64 // 效率低于该值时返回错误，0 表示不检查
+	HighestWastedBytes string  // 浪费的空间超过该值时返回错误，如 20MB，为空表示不检查
+	Json               bool
+}
+
+type analyzedFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type analyzedLayer struct {
+	Digest           string         `json:"digest"`
+	CreatedBy        string         `json:"created_by,omitempty"`
+	Size             int64          `json:"size"`              // 压缩后的大小
+	UncompressedSize int64          `json:"uncompressed_size"` // tar 包的大小
+	FilesSize        int64          `json:"files_size"`        // 其中文件内容的总大小
+	Files            int            `json:"files"`
+	LargestFiles     []analyzedFile `json:"largest_files"`
+}
+
+type wastedFile struct {
+	Path   string `json:"path"`
+	Count  int    `json:"count"` // 被覆盖或删除的次数
+	Wasted int64  `json:"wasted"`
+}
+
+type imageAnalysis struct {
+	Layers      []analyzedLayer `json:"layers"`
+	Size        int64           `json:"size"`
+	FilesSize   int64           `json:"files_size"`
+	WastedBytes int64           `json:"wasted_bytes"`
+	Efficiency  float64         `json:"efficiency"`
+	WastedFiles []wastedFile    `json:"wasted_files"`
+}
+
+// 统计每个 layer 中最大的文件，以及被之后的 layer 覆盖或删除的文件所浪费的空间
+func AnalyzeImage(source string, image *Image, opts AnalyzeOptions) error {
+	if opts.Top < 0 {
+		return fmt.Errorf("--top must not be negative: %d", opts.Top)
+	}
+	var highestWasted int64 = -1
+	if len(opts.HighestWastedBytes) > 0 {
+		var err error
+		if highestWasted, err = parseSize(opts.HighestWastedBytes); err != nil {
+			return err
+		}
+	}
+
+	src, err := loadSourceImage(source, image)
+	if err != nil {
+		return err
+	}
+	defer src.cleanup()
+
+	result, err := analyzeLayers(src, opts.Top)
+	if err != nil {
+		return err
+	}
+
+	if opts.Json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(result); err != nil {
+			return err
+		}
+	} else {
+		printImageAnalysis(result)
+	}
+
+	if opts.LowestEfficiency > 0 && result.Efficiency < opts.LowestEfficiency {
+		return fmt.Errorf("image efficiency %.4f is lower than %.4f", result.Efficiency, opts.LowestEfficiency)
+	}
+	if highestWasted >= 0 && result.WastedBytes > highestWasted {
+		return fmt.Errorf("wasted %s is more than %s", formatSize(result.WastedBytes), formatSize(highestWasted))
+	}
+	return nil
+}
+
+// 按从下到上的顺序读取每个 layer，记录当前可见的文件，被覆盖或删除时计入浪费的空间
+func analyzeLayers(src *sourceImage, top int) (*imageAnalysis, error) {
+	type liveFile struct {
+		layer int
+		size  int64
+		isDir bool
+	}
+	live := map[string]liveFile{}
+	wasted := map[string]*wastedFile{}
+	result := &imageAnalysis{}
+
+	waste := func(name string, file liveFile) {
+		delete(live, name)
+		if file.isDir {
+			return
+		}
+		item, ok := wasted[name]
+		if !ok {
+			item = &wastedFile{Path: "/" + name}
+			wasted[name] = item
+		}
+		item.Count++
+		item.Wasted += file.size
+		result.WastedBytes += file.size
+	}
+	// 删除目录下在之前的 layer 中写入的文件
+	wasteChildren := func(dir string, layer int) {
+		prefix := dir + "/"
+		for name, file := range live {
+			if (dir == "." || strings.HasPrefix(name, prefix)) && file.layer < layer {
+				waste(name, file)
+			}
+		}
+	}
+
+	createdBy := layerHistory(src.config)
+	for idx, layer := range src.layers {
+		fmt.Fprintf(os.Stderr, "(%d/%d) Analyzing layer %s\n", idx+1, len(src.layers), layer.name())
+		item := analyzedLayer{Digest: layer.name(), Size: layer.Size}
+		if idx < len(createdBy) {
+			item.CreatedBy = createdBy[idx]
+		}
+
+		reader, err := src.openLayerTar(layer)
+		if err != nil {
+			return nil, err
+		}
+		counter := &countingReader{r: reader}
+		tarFile := tar.NewReader(counter)
+		files := []analyzedFile{}
+		for {
+			header, err := tarFile.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				reader.Close()
+				return nil, fmt.Errorf("layer %s: %w", layer.name(), err)
+			}
+			name, err := checkTarName(header.Name)
+			if err != nil {
+				reader.Close()
+				return nil, err
+			}
+			base := path.Base(name)
+			if base == whiteoutOpaque {
+				wasteChildren(path.Dir(name), idx)
+				continue
+			}
+			if deleted, ok, err := whiteoutTarget(name); ok {
+				if err != nil {
+					reader.Close()
+					return nil, err
+				}
+				if file, ok := live[deleted]; ok && file.layer < idx {
+					waste(deleted, file)
+				}
+				wasteChildren(deleted, idx)
+				continue
+			}
+
+			if file, ok := live[name]; ok && file.layer < idx {
+				waste(name, file)
+			}
+			size := int64(0)
+			if header.Typeflag == tar.TypeReg {
+				size = header.Size
+			}
+			live[name] = liveFile{layer: idx, size: size, isDir: header.Typeflag == tar.TypeDir}
+			item.Files++
+			item.FilesSize += size
+			files = append(files, analyzedFile{Path: "/" + name, Size: size})
+		}
+		io.Copy(io.Discard, counter)
+		reader.Close()
+		item.UncompressedSize = counter.n
+		if item.Size == 0 {
+			item.Size = counter.n
+		}
+
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Size > files[j].Size
+		})
+		if len(files) > top {
+			files = files[:top]
+		}
+		item.LargestFiles = files
+		result.Layers = append(result.Layers, item)
+		result.Size += item.Size
+		result.FilesSize += item.FilesSize
+	}
+
+	for _, item := range wasted {
+		result.WastedFiles = append(result.WastedFiles, *item)
+	}
+	sort.Slice(result.WastedFiles, func(i, j int) bool {
+		if result.WastedFiles[i].Wasted != result.WastedFiles[j].Wasted {
+			return result.WastedFiles[i].Wasted > result.WastedFiles[j].Wasted
+		}
+		return result.WastedFiles[i].Path < result.WastedFiles[j].Path
+	})
+	result.Efficiency = 1
+	if result.FilesSize > 0 {
+		result.Efficiency = float64(result.FilesSize-result.WastedBytes) / float64(result.FilesSize)
+	}
+	return result, nil
+}
+
+// 每个 layer 对应的 history 中的 created_by，跳过没有 layer 的 history
+func layerHistory(config []byte) []string {
+	var p fastjson.Parser
+	configJson, err := p.ParseBytes(config)
+	if err != nil {
+		return nil
+	}
+	result := []string{}
+	for _, item := range configJson.GetArray("history") {
+		if !item.GetBool("empty_layer") {
+			result = append(result, string(item.GetStringBytes("created_by")))
+		}
+	}
+	return result
+}
+
+func printImageAnalysis(result *imageAnalysis) {
+	for idx, layer := range result.Layers {
+		fmt.Printf("Layer %d %s\n", idx+1, layer.Digest)
+		if len(layer.CreatedBy) > 0 {
+			createdBy := strings.Join(strings.Fields(layer.CreatedBy), " ")
+			if len(createdBy) > 100 {
+				createdBy = createdBy[:97] + "..."
+			}
+			fmt.Printf("  created by: %s\n", createdBy)
+		}
+		fmt.Printf("  size: %s compressed, %s uncompressed, %d files\n", formatSize(layer.Size), formatSize(layer.UncompressedSize), layer.Files)
+		for _, file := range layer.LargestFiles {
+			fmt.Printf("  %10s  %s\n", formatSize(file.Size), file.Path)
+		}
+	}
+
+	fmt.Println("Wasted space:")
+	if len(result.WastedFiles) == 0 {
+		fmt.Println("  none")
+	}
+	for _, file := range result.WastedFiles {
+		fmt.Printf("  %10s  %dx  %s\n", formatSize(file.Wasted), file.Count, file.Path)
+	}
+
+	fmt.Printf("Image size: %s compressed, %s of files\n", formatSize(result.Size), formatSize(result.FilesSize))
+	fmt.Printf("Wasted bytes: %s\n", formatSize(result.WastedBytes))
+	fmt.Printf("Efficiency: %.2f%%\n", result.Efficiency*100)
+}
+
+// 解析 1024, 20KB, 1.5MB, 2G 格式的大小
+func parseSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+	units := map[string]float64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	scale := 1.0
+	if len(value) > 0 {
+		if unit, ok := units[value[len(value)-1:]]; ok {
+			scale = unit
+			value = value[:len(value)-1]
+		}
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(number * scale), nil
+}
+
+// 统计读取的字节数
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
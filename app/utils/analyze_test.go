@@ -0,0 +1,59 @@
+package utils_test
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_AnalyzeLayers(t *testing.T) {
+	dir := t.TempDir()
+	lower := buildTar(t, []tarItem{{name: "a", content: "aaaa"}, {name: "b", content: "bb"}, {name: "c", content: "c"}})
+	upper := buildTar(t, []tarItem{{name: "a", content: "a"}, {name: ".wh.b"}})
+	archive := buildTar(t, []tarItem{
+		{name: "lower/layer.tar", content: string(lower)},
+		{name: "upper/layer.tar", content: string(upper)},
+		{name: "config.json", content: `{"os": "linux", "rootfs": {"type": "layers", "diff_ids": ["sha256:1", "sha256:2"]}}`},
+		{name: "manifest.json", content: `[{"Config": "config.json", "Layers": ["lower/layer.tar", "upper/layer.tar"]}]`},
+	})
+	source := path.Join(dir, "image.tar")
+	assert.NoError(t, os.WriteFile(source, archive, 0644))
+
+	var result struct {
+		Layers []struct {
+			Files        int
+			LargestFiles []struct{ Path string } `json:"largest_files"`
+		}
+		WastedBytes int64 `json:"wasted_bytes"`
+	}
+	for _, top := range []int{0, 2, 10} {
+		content, err := utils.AnalyzeLayers(source, top)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal([]byte(content), &result))
+		assert.Len(t, result.Layers, 2)
+		assert.Equal(t, 3, result.Layers[0].Files)
+		assert.Len(t, result.Layers[0].LargestFiles, min(top, 3))
+		// a 被覆盖，b 被删除
+		assert.Equal(t, int64(6), result.WastedBytes)
+	}
+	assert.Equal(t, "/a", result.Layers[0].LargestFiles[0].Path)
+
+	// 负数的 --top 直接返回错误
+	assert.Error(t, utils.AnalyzeImage(source, nil, utils.AnalyzeOptions{Top: -1}))
+
+	// 删除目录本身的 whiteout
+	upper = buildTar(t, []tarItem{{name: ".wh.."}})
+	archive = buildTar(t, []tarItem{
+		{name: "lower/layer.tar", content: string(lower)},
+		{name: "upper/layer.tar", content: string(upper)},
+		{name: "config.json", content: `{"os": "linux", "rootfs": {"type": "layers", "diff_ids": ["sha256:1", "sha256:2"]}}`},
+		{name: "manifest.json", content: `[{"Config": "config.json", "Layers": ["lower/layer.tar", "upper/layer.tar"]}]`},
+	})
+	assert.NoError(t, os.WriteFile(source, archive, 0644))
+	_, err := utils.AnalyzeLayers(source, 0)
+	assert.ErrorContains(t, err, "invalid whiteout")
+}
@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/samber/lo"
+	"github.com/valyala/fastjson"
+)
+
+type AppendOptions struct {
+	Compression string // 新 layer 的压缩方式：gzip, zstd, none
+	Owner       string // 目录生成的 layer 中文件的属主 <uid>:<gid>
+}
+
+// 在远程镜像 base 之上添加 layer 并推送到 target，layer 来自目录或 tar 包
+// 目录按固定的修改时间和属主打包，相同的内容总是得到相同的 digest；base 已有的 blob 直接 mount
+// base 为 manifest list 时，每个 platform 都添加相同的 layer，再生成新的 manifest list
+func AppendImage(base *Image, target *Image, sources []string, opts AppendOptions) error {
+	fmt.Printf("Append %d layers to %s/%s:%s\n", len(sources), base.Registry, base.Repository, base.Tag)
+	owner, err := parseLayerOwner(opts.Owner)
+	if err != nil {
+		return err
+	}
+
+	var manifest *fastjson.Value
+	if err = Try(func() {
+		manifest = base.FetchManifest("")
+	}); err != nil {
+		return err
+	}
+	if manifest.GetInt("schemaVersion") != 2 {
+		return fmt.Errorf("Unsupported schema version %d", manifest.GetInt("schemaVersion"))
+	}
+
+	tempDir, err := os.MkdirTemp("", "append-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	// 1.生成并上传新的 layer，所有 platform 共用
+	modTime := layerModTime()
+	layers := []appendedLayer{}
+	for idx, source := range sources {
+		fmt.Printf("Layer (%d/%d) %s #####\n", idx+1, len(sources), source)
+		info, err := os.Stat(source)
+		if err != nil {
+			return err
+		}
+		layerDir, layerFilename := path.Dir(source), path.Base(source)
+		if info.IsDir() {
+			layerDir, layerFilename = tempDir, fmt.Sprintf("layer-%d.tar", idx)
+			fp, err := os.Create(path.Join(layerDir, layerFilename))
+			if err != nil {
+				return err
+			}
+			err = writeDirLayer(fp, source, owner, modTime)
+			fp.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		fsys := os.DirFS(layerDir)
+		diffID, err := computeDiffID(fsys, layerFilename)
+		if err != nil {
+			return err
+		}
+		desc, err := uploadLayer(target, fsys, layerFilename, opts.Compression)
+		if err != nil {
+			return err
+		}
+		layers = append(layers, appendedLayer{desc: desc, diffID: diffID, source: source})
+	}
+
+	var a fastjson.Arena
+	mediaType := manifestMediaType(manifest, manifest)
+	if isIndexMediaType(mediaType) {
+		children := a.NewArray()
+		count := 0
+		hasOci := false
+		for _, item := range manifest.GetArray("manifests") {
+			if string(item.GetStringBytes("platform", "os")) == "unknown" {
+				// attestation 等引用原有 digest 的 manifest，添加 layer 后不再有效
+				fmt.Printf("skipping %s\n", item.GetStringBytes("digest"))
+				continue
+			}
+			var child *fastjson.Value
+			if err := Try(func() {
+				child = base.FetchManifest(string(item.GetStringBytes("digest")))
+			}); err != nil {
+				return err
+			}
+			childMediaType, content, err := appendManifest(base, target, child, manifestMediaType(item, child), layers, modTime)
+			if err != nil {
+				return err
+			}
+			digest, err := uploadManifest(target, computeBytesDigest(content), childMediaType, content)
+			if err != nil {
+				return err
+			}
+			hasOci = hasOci || childMediaType == "application/vnd.oci.image.manifest.v1+json"
+			item.Set("mediaType", a.NewString(childMediaType))
+			item.Set("digest", a.NewString(digest))
+			item.Set("size", a.NewNumberInt(len(content)))
+			children.SetArrayItem(count, item)
+			count++
+		}
+		manifest.Set("manifests", children)
+		// docker 的 manifest list 不能包含 OCI manifest
+		if hasOci && mediaType != "application/vnd.oci.image.index.v1+json" {
+			mediaType = "application/vnd.oci.image.index.v1+json"
+			manifest.Set("mediaType", a.NewString(mediaType))
+		}
+		_, err = uploadManifest(target, target.Tag, mediaType, manifest.MarshalTo(nil))
+		return err
+	}
+
+	mediaType, content, err := appendManifest(base, target, manifest, mediaType, layers, modTime)
+	if err != nil {
+		return err
+	}
+	_, err = uploadManifest(target, target.Tag, mediaType, content)
+	return err
+}
+
+// 已上传的新 layer
+type appendedLayer struct {
+	desc   descriptor
+	diffID string
+	source string
+}
+
+// 在单个 platform 的 manifest 之上添加 layer，上传新的 config，返回新的 manifest 及其 mediaType
+func appendManifest(base *Image, target *Image, manifest *fastjson.Value, mediaType string, layers []appendedLayer, modTime time.Time) (string, []byte, error) {
+	configDigest := string(manifest.GetStringBytes("config", "digest"))
+	blob, err := openBlob(base, configDigest)
+	if err != nil {
+		return "", nil, err
+	}
+	content, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return "", nil, err
+	}
+	var p fastjson.Parser
+	config, err := p.ParseBytes(content)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 2.base 的 layer 已在仓库中，mount 到目标 repository
+	for _, layer := range manifest.GetArray("layers") {
+		layerMediaType := string(layer.GetStringBytes("mediaType"))
+		if isForeignMediaType(layerMediaType) {
+			continue
+		}
+		if err = copyBlob(target, base, string(layer.GetStringBytes("digest")), layerMediaType); err != nil {
+			return "", nil, err
+		}
+	}
+
+	// 3.更新 config 中的 diff_ids 和 history
+	var a fastjson.Arena
+	if !config.Exists("rootfs", "diff_ids") {
+		config.Set("rootfs", parseJsonString(`{"type": "layers", "diff_ids": []}`))
+	}
+	if !config.Exists("history") {
+		config.Set("history", a.NewArray())
+	}
+	for _, layer := range layers {
+		diffIDsJson := config.Get("rootfs", "diff_ids")
+		diffIDsJson.SetArrayItem(len(diffIDsJson.GetArray()), a.NewString(layer.diffID))
+		history := config.Get("history")
+		history.SetArrayItem(len(history.GetArray()), appendHistory(&a, modTime, layer.source))
+	}
+	configMediaType := string(manifest.GetStringBytes("config", "mediaType"))
+	configDigest, configSize, err := uploadBlobBytes(target, config.MarshalTo(nil), configMediaType)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 4.生成新的 manifest，docker 的 manifest 不支持 zstd，需要转换为 OCI manifest
+	isOci := mediaType == "application/vnd.oci.image.manifest.v1+json"
+	hasZstd := lo.ContainsBy(layers, func(layer appendedLayer) bool {
+		return layer.desc.Compression == "zstd"
+	})
+	if !isOci && hasZstd {
+		isOci = true
+		mediaType = "application/vnd.oci.image.manifest.v1+json"
+		manifest.Set("mediaType", a.NewString(mediaType))
+		manifest.Get("config").Set("mediaType", a.NewString("application/vnd.oci.image.config.v1+json"))
+		for _, layer := range manifest.GetArray("layers") {
+			layer.Set("mediaType", a.NewString(ociLayerMediaType(string(layer.GetStringBytes("mediaType")))))
+		}
+	}
+	manifest.Get("config").Set("digest", a.NewString(configDigest))
+	manifest.Get("config").Set("size", a.NewNumberInt(int(configSize)))
+	manifestLayers := manifest.Get("layers")
+	for _, layer := range layers {
+		manifestLayers.SetArrayItem(len(manifestLayers.GetArray()), parseJsonString(fmt.Sprintf(`{
+			"digest": "%s",
+			"size": %d,
+			"mediaType": "%s"
+		}`, layer.desc.Digest, layer.desc.Size, layerMediaType(layer.desc.Compression, isOci))))
+	}
+	return mediaType, manifest.MarshalTo(nil), nil
+}
+
+// 新 layer 的 history；fastjson 使用 strconv.Quote 转义控制字符（如 \a、\x01），不是合法的 JSON，
+// 文件名中的控制字符和无效的 UTF-8 替换为 U+FFFD
+func appendHistory(a *fastjson.Arena, modTime time.Time, source string) *fastjson.Value {
+	name := strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return utf8.RuneError
+		}
+		return r
+	}, path.Base(path.Clean(source)))
+	history := a.NewObject()
+	history.Set("created", a.NewString(modTime.Format("2006-01-02T15:04:05Z")))
+	history.Set("created_by", a.NewString("append "+name))
+	history.Set("comment", a.NewString("append"))
+	return history
+}
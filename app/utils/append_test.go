@@ -0,0 +1,136 @@
+package utils_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_AppendHistory(t *testing.T) {
+	modTime := time.Unix(0, 0).UTC()
+	for _, source := range []string{"./overlay/", "a\"b", "bell\a\x01", "invalid\xff\xfe", "tab\there"} {
+		var history map[string]string
+		assert.NoError(t, json.Unmarshal([]byte(utils.AppendHistory(modTime, source)), &history), source)
+		assert.Equal(t, "1970-01-01T00:00:00Z", history["created"])
+		assert.Equal(t, "append", history["comment"])
+		assert.Contains(t, history["created_by"], "append ")
+	}
+}
+
+func Test_WriteDirLayer(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(path.Join(dir, "b/c"), 0755))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "b/c/file"), []byte("file"), 0600))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "a"), []byte("a"), 0755))
+	assert.NoError(t, os.Symlink("a", path.Join(dir, "link")))
+
+	modTime := time.Unix(1700000000, 0).UTC()
+	var first, second bytes.Buffer
+	assert.NoError(t, utils.WriteDirLayer(&first, dir, "1000:2000", modTime))
+	// 修改时间不同的相同内容得到相同的 tar 包
+	os.Chtimes(path.Join(dir, "a"), time.Now(), time.Now())
+	assert.NoError(t, utils.WriteDirLayer(&second, dir, "1000:2000", modTime))
+	assert.Equal(t, first.Bytes(), second.Bytes())
+
+	names := []string{}
+	r := tar.NewReader(&first)
+	for {
+		header, err := r.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+		assert.Equal(t, 1000, header.Uid, header.Name)
+		assert.Equal(t, 2000, header.Gid, header.Name)
+		assert.True(t, modTime.Equal(header.ModTime), header.Name)
+	}
+	assert.Equal(t, []string{"a", "b/", "b/c/", "b/c/file", "link"}, names)
+
+	assert.Error(t, utils.WriteDirLayer(&first, dir, "root", modTime))
+}
+
+// base 为 manifest list 时每个 platform 都添加 layer，attestation 被跳过
+func Test_AppendImageManifestList(t *testing.T) {
+	t.Setenv("GO_DOCKER_CACHE_DIR", t.TempDir())
+	registry := newPushRegistry(t)
+	defer registry.Close()
+
+	addManifest := func(content string) string {
+		digest := "sha256:" + sha256Hex([]byte(content))
+		registry.manifests[digest] = []byte(content)
+		return fmt.Sprintf(`"digest": "%s", "size": %d`, digest, len(content))
+	}
+	addBlob := func(content []byte) string {
+		digest := "sha256:" + sha256Hex(content)
+		registry.blobs[digest] = content
+		return fmt.Sprintf(`"digest": "%s", "size": %d`, digest, len(content))
+	}
+	items := []string{}
+	for _, arch := range []string{"amd64", "arm64"} {
+		layer := gzipBytes(t, buildTar(t, []tarItem{{name: "etc/arch", content: arch}}))
+		config := addBlob([]byte(`{"architecture": "` + arch + `", "os": "linux", "rootfs": {"type": "layers", "diff_ids": ["sha256:1"]}}`))
+		manifest := addManifest(`{"schemaVersion": 2, "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+			"config": {"mediaType": "application/vnd.docker.container.image.v1+json", ` + config + `},
+			"layers": [{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", ` + addBlob(layer) + `}]}`)
+		items = append(items, `{"mediaType": "application/vnd.docker.distribution.manifest.v2+json", `+manifest+`, "platform": {"os": "linux", "architecture": "`+arch+`"}}`)
+	}
+	attestation := addManifest(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "layers": []}`)
+	items = append(items, `{"mediaType": "application/vnd.oci.image.manifest.v1+json", `+attestation+`, "platform": {"os": "unknown", "architecture": "unknown"}}`)
+	registry.manifests["1"] = []byte(`{"schemaVersion": 2, "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json", "manifests": [` + strings.Join(items, ",") + `]}`)
+
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(path.Join(dir, "hello"), []byte("hello"), 0644))
+	name := strings.TrimPrefix(registry.URL, "http://") + "/t/app"
+	base := utils.NewImage(name+":1", "", "", true, "", "linux", "amd64", "")
+	target := utils.NewImage(name+":2", "", "", true, "", "linux", "amd64", "")
+	assert.NoError(t, utils.AppendImage(&base, &target, []string{dir}, utils.AppendOptions{Compression: "gzip", Owner: "0:0"}))
+
+	var list struct {
+		MediaType string `json:"mediaType"`
+		Manifests []struct {
+			Digest   string            `json:"digest"`
+			Platform map[string]string `json:"platform"`
+		} `json:"manifests"`
+	}
+	assert.NoError(t, json.Unmarshal(registry.manifests["2"], &list))
+	assert.Equal(t, "application/vnd.docker.distribution.manifest.list.v2+json", list.MediaType)
+	assert.Len(t, list.Manifests, 2)
+	appended := ""
+	for idx, arch := range []string{"amd64", "arm64"} {
+		assert.Equal(t, arch, list.Manifests[idx].Platform["architecture"])
+		var manifest struct {
+			Config struct {
+				Digest string `json:"digest"`
+			} `json:"config"`
+			Layers []struct {
+				Digest string `json:"digest"`
+			} `json:"layers"`
+		}
+		assert.NoError(t, json.Unmarshal(registry.manifests[list.Manifests[idx].Digest], &manifest), arch)
+		assert.Len(t, manifest.Layers, 2, arch)
+		// 所有 platform 共用新的 layer
+		if idx == 0 {
+			appended = manifest.Layers[1].Digest
+		}
+		assert.Equal(t, appended, manifest.Layers[1].Digest, arch)
+
+		var config struct {
+			Architecture string `json:"architecture"`
+			Rootfs       struct {
+				DiffIDs []string `json:"diff_ids"`
+			} `json:"rootfs"`
+		}
+		assert.NoError(t, json.Unmarshal(registry.blobs[manifest.Config.Digest], &config), arch)
+		assert.Equal(t, arch, config.Architecture)
+		assert.Len(t, config.Rootfs.DiffIDs, 2, arch)
+	}
+}
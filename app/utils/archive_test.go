@@ -0,0 +1,59 @@
+package utils_test
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_RewriteImageTag(t *testing.T) {
+	cases := []struct {
+		tag      string
+		prefix   string
+		template string
+		expected string
+	}{
+		{"nginx:stable", "", "", "nginx:stable"},
+		{"nginx:stable", "my-registry.com/mirror/", "", "my-registry.com/mirror/library/nginx:stable"},
+		{"quay.io/org/app:1.0", "my-registry.com", "", "my-registry.com/org/app:1.0"},
+		{"quay.io/org/app@sha256:abc", "my-registry.com", "", "my-registry.com/org/app@sha256:abc"},
+		{"quay.io/org/app:1.0", "", "my-registry.com/{{.ImageName}}:{{.Tag}}", "my-registry.com/app:1.0"},
+		// 模板优先于前缀
+		{"user/app:2", "ignored.com", "r.com/{{.Repository}}-x:{{.Tag}}", "r.com/user/app-x:2"},
+	}
+	for _, c := range cases {
+		target, err := utils.RewriteImageTag(c.tag, c.prefix, c.template)
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, target, c.tag)
+	}
+
+	_, err := utils.RewriteImageTag("nginx", "", "{{.Unknown}}")
+	assert.Error(t, err)
+}
+
+func Test_ListArchiveImages(t *testing.T) {
+	// docker save a b c 的 manifest.json
+	tags, err := utils.ListArchiveImages(fstest.MapFS{
+		"manifest.json": {Data: []byte(`[
+			{"Config": "a.json", "RepoTags": ["a:1", "a:latest"], "Layers": []},
+			{"Config": "b.json", "RepoTags": ["b:1"], "Layers": []},
+			{"Config": "c.json", "Layers": []}
+		]`)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"a:1", "a:latest"}, {"b:1"}, nil}, tags)
+
+	// OCI layout 的 ref.name 只有 tag 时无法得到 repository
+	tags, err = utils.ListArchiveImages(fstest.MapFS{
+		"oci-layout": {Data: []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+		"index.json": {Data: []byte(`{"manifests": [
+			{"digest": "sha256:a", "annotations": {"io.containerd.image.name": "docker.io/library/a:1", "org.opencontainers.image.ref.name": "1"}},
+			{"digest": "sha256:b", "annotations": {"org.opencontainers.image.ref.name": "b:2"}},
+			{"digest": "sha256:c", "annotations": {"org.opencontainers.image.ref.name": "latest"}}
+		]}`)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"docker.io/library/a:1"}, {"b:2"}, nil}, tags)
+}
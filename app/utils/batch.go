@@ -0,0 +1,243 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 镜像列表文件中的一个镜像
+type imageListEntry struct {
+	Image    string `yaml:"image"`
+	Platform string `yaml:"platform"` // <os>/<arch>[/<variant>]，默认使用 --os 和 --architecture
+	Name     string `yaml:"name"`     // 输出的文件名
+}
+
+// YAML 中的镜像可以只写镜像名
+func (e *imageListEntry) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		e.Image = node.Value
+		return nil
+	}
+	type plain imageListEntry
+	return node.Decode((*plain)(e))
+}
+
+// 读取镜像列表文件
+// .yaml 和 .yml 文件为镜像的数组，或者 images 字段中的数组；每个镜像为镜像名，或者包含 image, platform, name 的对象
+// 其他文件每行一个镜像：<image> [<os>/<arch>[/<variant>]] [<name>]，忽略空行和 # 开头的注释
+func readImageList(filename string) ([]imageListEntry, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []imageListEntry{}
+	if ext := path.Ext(filename); ext == ".yaml" || ext == ".yml" {
+		var node yaml.Node
+		if err = yaml.Unmarshal(content, &node); err != nil {
+			return nil, fmt.Errorf("invalid image list %s: %w", filename, err)
+		}
+		if len(node.Content) > 0 && node.Content[0].Kind == yaml.MappingNode {
+			var list struct {
+				Images []imageListEntry `yaml:"images"`
+			}
+			err = node.Decode(&list)
+			entries = list.Images
+		} else if len(node.Content) > 0 {
+			err = node.Decode(&entries)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid image list %s: %w", filename, err)
+		}
+	} else {
+		scanner := bufio.NewScanner(strings.NewReader(string(content)))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if idx := strings.Index(line, "#"); idx >= 0 {
+				line = line[:idx]
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			entry := imageListEntry{Image: fields[0]}
+			for _, field := range fields[1:] {
+				if strings.Contains(field, "/") && len(entry.Platform) == 0 {
+					entry.Platform = field
+				} else if len(entry.Name) == 0 {
+					entry.Name = field
+				} else {
+					return nil, fmt.Errorf("invalid line in image list %s: %s", filename, line)
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	for _, entry := range entries {
+		if len(entry.Image) == 0 {
+			return nil, fmt.Errorf("image list %s has an entry without image", filename)
+		}
+		if strings.Contains(entry.Name, "/") {
+			return nil, fmt.Errorf("invalid output name %q in image list %s", entry.Name, filename)
+		}
+	}
+	return entries, nil
+}
+
+// 批量下载时共享的 layer：相同 digest 的 layer 只下载一次，其他镜像使用硬链接或复制
+type sharedLayers struct {
+	mutex sync.Mutex
+	files map[string]string      // digest -> 已下载并解压的 layer.tar
+	locks map[string]*sync.Mutex // 正在下载的 layer
+}
+
+func newSharedLayers() *sharedLayers {
+	return &sharedLayers{files: map[string]string{}, locks: map[string]*sync.Mutex{}}
+}
+
+// 锁定 digest，返回解锁的函数
+func (s *sharedLayers) lock(digest string) func() {
+	s.mutex.Lock()
+	lock, ok := s.locks[digest]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.locks[digest] = lock
+	}
+	s.mutex.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+func (s *sharedLayers) add(digest string, filename string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files[digest] = filename
+}
+
+// 将已下载的 layer 链接到 filename
+func (s *sharedLayers) link(digest string, filename string) bool {
+	s.mutex.Lock()
+	source, ok := s.files[digest]
+	s.mutex.Unlock()
+	if !ok || source == filename {
+		return false
+	}
+	os.Remove(filename)
+	if err := os.Link(source, filename); err == nil {
+		return true
+	}
+	// 不支持硬链接时复制文件
+	in, err := os.Open(source)
+	if err != nil {
+		return false
+	}
+	defer in.Close()
+	out, err := os.Create(filename)
+	if err != nil {
+		return false
+	}
+	defer out.Close()
+	if _, err = io.Copy(out, in); err != nil {
+		os.Remove(filename)
+		return false
+	}
+	return true
+}
+
+// 批量下载列表文件中的镜像，共享 token 和已下载的 layer，最后输出成功和失败的汇总
+func PullImageList(image *Image, listFile string, dir string, concurrency int, opts PullOptions) error {
+	entries, err := readImageList(listFile)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no images in %s", listFile)
+	}
+	return pullImageEntries(image, entries, dir, concurrency, opts)
+}
+
+func pullImageEntries(image *Image, entries []imageListEntry, dir string, concurrency int, opts PullOptions) error {
+	if len(opts.Unpack) > 0 {
+		return fmt.Errorf("--unpack cannot be used with a list of images")
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	image.tokens = newTokenCache()
+	opts.layers = newSharedLayers()
+	targets := make([]Image, len(entries))
+	outputs := map[string]int{}
+	for idx, entry := range entries {
+		targets[idx] = image.WithReference(entry.Image)
+		if len(entry.Platform) > 0 {
+			targets[idx].platform = parsePlatform(entry.Platform)
+		}
+		entryOpts := opts
+		entryOpts.OutputName = entry.Name
+		output := pullTargetFolder(&targets[idx], &entryOpts)
+		if previous, ok := outputs[output]; ok {
+			return fmt.Errorf("%s and %s are both pulled to %s, set a different name for one of them", entries[previous].Image, entry.Image, output)
+		}
+		outputs[output] = idx
+		image.tokens.register(&targets[idx])
+	}
+
+	type pullResult struct {
+		err      error
+		output   string
+		duration time.Duration
+	}
+	results := make([]pullResult, len(entries))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				entryOpts := opts
+				entryOpts.OutputName = entries[idx].Name
+				start := time.Now()
+				var pullErr error
+				err := Try(func() {
+					pullErr = PullImage(&targets[idx], dir, entryOpts)
+				})
+				if err == nil {
+					err = pullErr
+				}
+				results[idx] = pullResult{err, path.Join(dir, pullTargetFolder(&targets[idx], &entryOpts)+".tar"), time.Since(start)}
+			}
+		}()
+	}
+	for idx := range entries {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	fmt.Printf("\n========== Summary ==========\n")
+	failed := 0
+	for idx, result := range results {
+		if result.err != nil {
+			failed++
+			fmt.Printf("FAILED  %s: %s\n", entries[idx].Image, result.err)
+			continue
+		}
+		fmt.Printf("OK      %s -> %s (%s)\n", entries[idx].Image, result.output, result.duration.Round(time.Millisecond))
+	}
+	fmt.Printf("%d succeeded, %d failed\n", len(entries)-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed to pull", failed, len(entries))
+	}
+	return nil
+}
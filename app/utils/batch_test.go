@@ -0,0 +1,84 @@
+package utils_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_ReadImageList(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		filename string
+		content  string
+		expected [][]string
+	}{
+		{"images.txt", `
+# 基础镜像
+nginx:1.25
+redis:7 linux/arm64/v8   # 指定 platform
+registry.example.com/team/app:v1 app
+alpine:3.19 linux/arm64 alpine-arm64
+
+`, [][]string{
+			{"nginx:1.25", "", ""},
+			{"redis:7", "linux/arm64/v8", ""},
+			{"registry.example.com/team/app:v1", "", "app"},
+			{"alpine:3.19", "linux/arm64", "alpine-arm64"},
+		}},
+		{"empty.txt", "# nothing\n\n", [][]string{}},
+		{"images.yaml", `
+- nginx:1.25
+- image: redis:7
+  platform: linux/arm64/v8
+- {image: registry.example.com/team/app:v1, name: app}
+`, [][]string{
+			{"nginx:1.25", "", ""},
+			{"redis:7", "linux/arm64/v8", ""},
+			{"registry.example.com/team/app:v1", "", "app"},
+		}},
+		{"images.yml", `
+images:
+  - nginx:1.25
+  - image: alpine:3.19
+    platform: linux/arm64
+    name: alpine-arm64
+`, [][]string{
+			{"nginx:1.25", "", ""},
+			{"alpine:3.19", "linux/arm64", "alpine-arm64"},
+		}},
+		{"empty.yaml", "", [][]string{}},
+		{"no-images.yaml", "other: value\n", [][]string{}},
+	}
+	for _, c := range cases {
+		filename := path.Join(dir, c.filename)
+		assert.NoError(t, os.WriteFile(filename, []byte(c.content), 0644))
+		entries, err := utils.ReadImageList(filename)
+		assert.NoError(t, err, c.filename)
+		assert.Equal(t, c.expected, entries, c.filename)
+	}
+
+	invalid := []struct {
+		filename string
+		content  string
+		message  string
+	}{
+		{"extra.txt", "nginx:1.25 linux/amd64 name extra\n", "invalid line in image list"},
+		{"names.txt", "nginx:1.25 first second\n", "invalid line in image list"},
+		{"invalid.yaml", "- image: [nginx\n", "invalid image list"},
+		{"mapping.yaml", "images: nginx:1.25\n", "invalid image list"},
+		{"no-image.yaml", "- platform: linux/amd64\n", "has an entry without image"},
+		{"slash.yaml", "- {image: nginx:1.25, name: out/nginx}\n", "invalid output name"},
+	}
+	for _, c := range invalid {
+		filename := path.Join(dir, c.filename)
+		assert.NoError(t, os.WriteFile(filename, []byte(c.content), 0644))
+		_, err := utils.ReadImageList(filename)
+		assert.ErrorContains(t, err, c.message, c.filename)
+	}
+	_, err := utils.ReadImageList(path.Join(dir, "missing.txt"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,430 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// 离线镜像包为 OCI image layout 的 tar 文件：
+// index.json 中每个镜像的 org.opencontainers.image.ref.name 为完整的镜像名，指向原始的 manifest 或 manifest list（包含所有 platform）
+// 相同的 blob 只保存一次；SHA256SUMS 记录其他所有文件的 sha256，可以使用 sha256sum -c 检查
+const bundleChecksumFile = "SHA256SUMS"
+
+type BundleOptions struct {
+	Policy         string // 镜像信任策略文件，create 时按 pull 检查，import 时按 push 检查
+	RegistryPrefix string // import 时替换镜像的仓库前缀
+	TagTemplate    string // import 时镜像名的映射模板
+}
+
+// 写入镜像包的 tar 文件，同时记录每个文件的 sha256
+type bundleWriter struct {
+	tarWriter *tar.Writer
+	blobs     map[string]bool
+	checksums []string
+	size      int64
+}
+
+func (w *bundleWriter) writeHeader(name string, size int64) error {
+	return w.tarWriter.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  layerModTime(),
+		Format:   tar.FormatPAX,
+	})
+}
+
+func (w *bundleWriter) writeFile(name string, content []byte) error {
+	if err := w.writeHeader(name, int64(len(content))); err != nil {
+		return err
+	}
+	if _, err := w.tarWriter.Write(content); err != nil {
+		return err
+	}
+	w.checksums = append(w.checksums, fmt.Sprintf("%x  %s", sha256.Sum256(content), name))
+	w.size += int64(len(content))
+	return nil
+}
+
+func (w *bundleWriter) writeBlobBytes(digest string, content []byte) error {
+	if w.blobs[digest] {
+		return nil
+	}
+	if actual := computeBytesDigest(content); actual != digest {
+		return fmt.Errorf("blob %s does not match its digest %s", digest, actual)
+	}
+	w.blobs[digest] = true
+	return w.writeFile(ociBlobPath(digest), content)
+}
+
+// 以数据流的方式将远程的 blob 写入镜像包，写入后检查 digest
+func (w *bundleWriter) copyBlob(image *Image, digest string, size int64) (err error) {
+	if w.blobs[digest] {
+		return nil
+	}
+	if !strings.HasPrefix(digest, "sha256:") {
+		return fmt.Errorf("unsupported digest algorithm in %s", digest)
+	}
+	var blob io.ReadCloser
+	var openErr error
+	if err = Try(func() {
+		blob, openErr = openBlob(image, digest)
+	}); err != nil {
+		return
+	}
+	if err = openErr; err != nil {
+		return
+	}
+	defer blob.Close()
+
+	if err = w.writeHeader(ociBlobPath(digest), size); err != nil {
+		return
+	}
+	h := sha256.New()
+	var written int64
+	if written, err = io.Copy(io.MultiWriter(w.tarWriter, h), blob); err != nil {
+		return fmt.Errorf("blob %s: %w", digest, err)
+	}
+	if written != size {
+		return fmt.Errorf("blob %s has %d bytes, expected %d", digest, written, size)
+	}
+	if actual := fmt.Sprintf("sha256:%x", h.Sum(nil)); actual != digest {
+		return fmt.Errorf("blob %s does not match its digest %s", digest, actual)
+	}
+	w.blobs[digest] = true
+	w.checksums = append(w.checksums, fmt.Sprintf("%s  %s", strings.TrimPrefix(digest, "sha256:"), ociBlobPath(digest)))
+	w.size += size
+	return nil
+}
+
+// 写入 manifest 或 manifest list 及其引用的所有 manifest、config 和 layer
+func (w *bundleWriter) writeManifest(image *Image, digest string, content []byte) error {
+	if err := w.writeBlobBytes(digest, content); err != nil {
+		return err
+	}
+	manifest := parseJson(content)
+	if manifest.GetInt("schemaVersion") != 2 {
+		return fmt.Errorf("schema version %d manifests cannot be bundled", manifest.GetInt("schemaVersion"))
+	}
+
+	// manifest list 中的每个 platform 都写入镜像包
+	for _, item := range manifest.GetArray("manifests") {
+		childDigest := string(item.GetStringBytes("digest"))
+		if w.blobs[childDigest] {
+			continue
+		}
+		var child []byte
+		var fetchErr error
+		if err := Try(func() {
+			child, _, fetchErr = image.fetchManifestRaw(childDigest)
+		}); err != nil {
+			return err
+		}
+		if fetchErr != nil {
+			return fetchErr
+		}
+		fmt.Printf("Platform %s/%s %s\n", item.GetStringBytes("platform", "os"), item.GetStringBytes("platform", "architecture"), childDigest)
+		if err := w.writeManifest(image, childDigest, child); err != nil {
+			return err
+		}
+	}
+
+	blobs := []*fastjson.Value{}
+	if manifest.Exists("config") {
+		blobs = append(blobs, manifest.Get("config"))
+	}
+	blobs = append(blobs, manifest.GetArray("layers")...)
+	for _, item := range blobs {
+		blobDigest := string(item.GetStringBytes("digest"))
+		if isForeignMediaType(string(item.GetStringBytes("mediaType"))) {
+			fmt.Printf("skipping non-distributable layer %s\n", blobDigest)
+			continue
+		}
+		if w.blobs[blobDigest] {
+			fmt.Printf("blob %s already in bundle\n", blobDigest)
+			continue
+		}
+		fmt.Printf("Downloading blob %s (%d bytes)\n", blobDigest, item.GetInt64("size"))
+		if err := w.copyBlob(image, blobDigest, item.GetInt64("size")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将多个镜像的所有 platform 打包为一个离线镜像包
+func CreateBundle(image *Image, names []string, listFile string, output string, opts BundleOptions) (err error) {
+	if len(listFile) > 0 {
+		entries, err := readImageList(listFile)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			names = append(names, entry.Image)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no images to bundle")
+	}
+
+	// 先按策略检查所有镜像，再开始下载
+	targets := []Image{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		target := image.WithReference(name)
+		if seen[target.Reference()] {
+			continue
+		}
+		seen[target.Reference()] = true
+		targets = append(targets, target)
+	}
+	requirements := make([][]signatureRequirement, len(targets))
+	for idx := range targets {
+		if requirements[idx], err = checkPolicy(opts.Policy, &targets[idx], "pull"); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(output)
+		}
+	}()
+	buffer := bufio.NewWriterSize(file, 1<<20)
+	w := &bundleWriter{tarWriter: tar.NewWriter(buffer), blobs: map[string]bool{}}
+
+	var a fastjson.Arena
+	manifests := a.NewArray()
+	for idx := range targets {
+		target := &targets[idx]
+		reference := target.Reference()
+		fmt.Printf("Bundle Image (%d/%d) %s\n", idx+1, len(targets), reference)
+
+		var content []byte
+		var mediaType string
+		var fetchErr error
+		if err = Try(func() {
+			if len(requirements[idx]) > 0 {
+				// 使用已验证签名的 manifest
+				content, fetchErr = verifyImageSignature(target, requirements[idx])
+			} else {
+				content, mediaType, fetchErr = target.fetchManifestRaw("")
+			}
+		}); err != nil {
+			return fmt.Errorf("%s: %w", reference, err)
+		}
+		if fetchErr != nil {
+			return fmt.Errorf("%s: %w", reference, fetchErr)
+		}
+		digest := manifestDigest(content)
+		fmt.Printf("Digest: %s\n", digest)
+		if err = w.writeManifest(target, digest, content); err != nil {
+			return fmt.Errorf("%s: %w", reference, err)
+		}
+
+		if !strings.HasPrefix(mediaType, "application/vnd.") {
+			mediaType = manifestMediaType(a.NewObject(), parseJson(content))
+		}
+		desc := a.NewObject()
+		desc.Set("mediaType", a.NewString(mediaType))
+		desc.Set("digest", a.NewString(digest))
+		desc.Set("size", a.NewNumberInt(len(content)))
+		annotations := a.NewObject()
+		annotations.Set("io.containerd.image.name", a.NewString(reference))
+		annotations.Set("org.opencontainers.image.ref.name", a.NewString(reference))
+		desc.Set("annotations", annotations)
+		manifests.SetArrayItem(idx, desc)
+	}
+
+	index := a.NewObject()
+	index.Set("schemaVersion", a.NewNumberInt(2))
+	index.Set("mediaType", a.NewString("application/vnd.oci.image.index.v1+json"))
+	index.Set("manifests", manifests)
+	if err = w.writeFile("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+	if err = w.writeFile("index.json", index.MarshalTo(nil)); err != nil {
+		return err
+	}
+	checksums := strings.Join(w.checksums, "\n") + "\n"
+	if err = w.writeHeader(bundleChecksumFile, int64(len(checksums))); err != nil {
+		return err
+	}
+	if _, err = w.tarWriter.Write([]byte(checksums)); err != nil {
+		return err
+	}
+	if err = w.tarWriter.Close(); err != nil {
+		return err
+	}
+	if err = buffer.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d images, %d blobs (%d bytes) written to %s\n", len(targets), len(w.blobs), w.size, output)
+	return nil
+}
+
+// 检查镜像包中所有文件的 sha256：除 SHA256SUMS 外的每个文件都必须列出，
+// index.json、oci-layout 以及 index.json 引用的每个 blob 都必须列出且存在
+func verifyBundle(fsys fs.FS) error {
+	content, err := fs.ReadFile(fsys, bundleChecksumFile)
+	if err != nil {
+		return fmt.Errorf("not a bundle, %s is missing: %w", bundleChecksumFile, err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	checksums := map[string]string{}
+	for _, line := range lines {
+		sum, name, found := strings.Cut(line, "  ")
+		if !found {
+			return fmt.Errorf("invalid line in %s: %s", bundleChecksumFile, line)
+		}
+		expected, err := hex.DecodeString(sum)
+		if err != nil || len(expected) != sha256.Size {
+			return fmt.Errorf("invalid checksum in %s: %s", bundleChecksumFile, line)
+		}
+		checksums[name] = sum
+	}
+
+	names, err := listFiles(fsys)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, ok := checksums[name]; !ok && name != bundleChecksumFile {
+			return fmt.Errorf("%s is not listed in %s", name, bundleChecksumFile)
+		}
+	}
+
+	for idx, line := range lines {
+		_, name, _ := strings.Cut(line, "  ")
+		fmt.Printf("Verifying (%d/%d) %s\n", idx+1, len(lines), name)
+		digest, err := computeDigest(fsys, name)
+		if err != nil {
+			return err
+		}
+		if digest != "sha256:"+checksums[name] {
+			return fmt.Errorf("checksum mismatch for %s: expected sha256:%s, got %s", name, checksums[name], digest)
+		}
+	}
+
+	if !checkFsExist(fsys, "index.json") {
+		return fmt.Errorf("not a bundle, index.json is missing")
+	}
+	for _, name := range []string{"index.json", "oci-layout"} {
+		if _, ok := checksums[name]; !ok {
+			return fmt.Errorf("%s is not listed in %s", name, bundleChecksumFile)
+		}
+	}
+	// 以上已检查所有文件，这里读取的 manifest 都已通过校验
+	if content, err = fs.ReadFile(fsys, "index.json"); err != nil {
+		return err
+	}
+	var p fastjson.Parser
+	index, err := p.ParseBytes(content)
+	if err != nil {
+		return fmt.Errorf("index.json: %w", err)
+	}
+	return checkBundleBlobs(fsys, index, checksums, map[string]bool{})
+}
+
+// 检查 manifest 或 index 引用的 manifest、config 和 layer 都已列出，不可分发的 layer 不在镜像包中
+func checkBundleBlobs(fsys fs.FS, manifest *fastjson.Value, checksums map[string]string, seen map[string]bool) error {
+	blobs := []*fastjson.Value{}
+	if manifest.Exists("config") {
+		blobs = append(blobs, manifest.Get("config"))
+	}
+	blobs = append(blobs, manifest.GetArray("layers")...)
+	for _, item := range append(manifest.GetArray("manifests"), blobs...) {
+		if isForeignMediaType(string(item.GetStringBytes("mediaType"))) {
+			continue
+		}
+		name := ociBlobPath(string(item.GetStringBytes("digest")))
+		if _, ok := checksums[name]; !ok {
+			return fmt.Errorf("blob %s referenced from index.json is not listed in %s", name, bundleChecksumFile)
+		}
+	}
+
+	for _, item := range manifest.GetArray("manifests") {
+		name := ociBlobPath(string(item.GetStringBytes("digest")))
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		var p fastjson.Parser
+		child, err := p.ParseBytes(content)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err = checkBundleBlobs(fsys, child, checksums, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsys 中的所有文件，不包括目录
+func listFiles(fsys fs.FS) (names []string, err error) {
+	if t, ok := fsys.(*tarFS); ok {
+		// tarFS 不支持读取目录
+		for name, entry := range t.entries {
+			if entry.header.Typeflag != tar.TypeDir {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return
+	}
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return
+}
+
+// 检查镜像包后，将其中的所有镜像上传到目标仓库，已存在的 blob 不再上传
+func ImportBundle(image *Image, filename string, opts BundleOptions) error {
+	// 镜像包中记录的是镜像原来的名字，不指定目标仓库时会推回原来的仓库
+	if len(opts.RegistryPrefix) == 0 && len(opts.TagTemplate) == 0 {
+		return fmt.Errorf("--registry-prefix or --tag-template is required to import a bundle")
+	}
+	fsys, cleanup, err := openImageFile(filename)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err = verifyBundle(fsys); err != nil {
+		return err
+	}
+	return pushArchiveFs(fsys, filename, image, &PushOptions{
+		RegistryPrefix: opts.RegistryPrefix,
+		TagTemplate:    opts.TagTemplate,
+		Policy:         opts.Policy,
+	})
+}
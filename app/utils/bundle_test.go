@@ -0,0 +1,122 @@
+package utils_test
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_VerifyBundle(t *testing.T) {
+	blobName := func(content []byte) string {
+		return fmt.Sprintf("blobs/sha256/%x", sha256.Sum256(content))
+	}
+	descriptor := func(mediaType string, content []byte) string {
+		return fmt.Sprintf(`{"mediaType": "%s", "digest": "sha256:%x", "size": %d}`, mediaType, sha256.Sum256(content), len(content))
+	}
+	blob := []byte("layer content")
+	config := []byte(`{"architecture": "amd64", "os": "linux"}`)
+	manifest := []byte(`{"schemaVersion": 2, "config": ` + descriptor("application/vnd.oci.image.config.v1+json", config) +
+		`, "layers": [` + descriptor("application/vnd.oci.image.layer.v1.tar", blob) +
+		`, {"mediaType": "application/vnd.oci.image.layer.nondistributable.v1.tar", "digest": "sha256:0", "size": 1}]}`)
+	index := []byte(`{"schemaVersion": 2, "manifests": [` + descriptor("application/vnd.oci.image.manifest.v1+json", manifest) + `]}`)
+	layout := []byte(`{"imageLayoutVersion":"1.0.0"}`)
+
+	checksum := func(content []byte, name string) string {
+		return fmt.Sprintf("%x  %s\n", sha256.Sum256(content), name)
+	}
+	bundle := func(checksums string, files map[string][]byte) fstest.MapFS {
+		fsys := fstest.MapFS{"SHA256SUMS": &fstest.MapFile{Data: []byte(checksums)}}
+		for name, content := range files {
+			fsys[name] = &fstest.MapFile{Data: content}
+		}
+		return fsys
+	}
+	files := map[string][]byte{}
+	valid := ""
+	for _, content := range [][]byte{blob, config, manifest} {
+		files[blobName(content)] = content
+		valid += checksum(content, blobName(content))
+	}
+	files["oci-layout"] = layout
+	files["index.json"] = index
+	valid += checksum(layout, "oci-layout") + checksum(index, "index.json")
+	with := func(name string, content []byte) map[string][]byte {
+		changed := map[string][]byte{}
+		for k, v := range files {
+			changed[k] = v
+		}
+		if content == nil {
+			delete(changed, name)
+		} else {
+			changed[name] = content
+		}
+		return changed
+	}
+	// 删除 SHA256SUMS 中 name 所在的行
+	without := func(name string) string {
+		return strings.Replace(valid, fmt.Sprintf("%x  %s\n", sha256.Sum256(files[name]), name), "", 1)
+	}
+
+	assert.NoError(t, utils.VerifyBundle(bundle(valid, files)))
+
+	cases := []struct {
+		name    string
+		fsys    fstest.MapFS
+		message string
+	}{
+		{"tampered blob", bundle(valid, with(blobName(blob), []byte("other content"))), "checksum mismatch for " + blobName(blob)},
+		{"tampered index", bundle(valid, with("index.json", []byte("{}"))), "checksum mismatch for index.json"},
+		{"missing file", bundle(valid, with(blobName(blob), nil)), blobName(blob)},
+		{"missing index", bundle(without("index.json"), with("index.json", nil)), "index.json is missing"},
+		{"missing checksums", fstest.MapFS{"index.json": &fstest.MapFile{Data: index}}, "SHA256SUMS is missing"},
+		{"single space", bundle(strings.Replace(valid, "  ", " ", 1), files), "invalid line in SHA256SUMS"},
+		{"not hex", bundle("zz"+valid[2:], files), "invalid checksum in SHA256SUMS"},
+		{"short checksum", bundle(valid[2:], files), "invalid checksum in SHA256SUMS"},
+		{"unlisted file", bundle(valid, with("extra/file", []byte("extra"))), "extra/file is not listed in SHA256SUMS"},
+		{"unlisted index", bundle(without("index.json"), files), "index.json is not listed in SHA256SUMS"},
+		{"unlisted oci-layout", bundle(without("oci-layout"), files), "oci-layout is not listed in SHA256SUMS"},
+	}
+	// 删除 index.json 引用的 manifest、config 或 layer 所在的行，文件也不在镜像包中
+	for _, content := range [][]byte{blob, config, manifest} {
+		cases = append(cases, struct {
+			name    string
+			fsys    fstest.MapFS
+			message string
+		}{"unlisted " + blobName(content), bundle(without(blobName(content)), with(blobName(content), nil)), blobName(content) + " referenced from index.json is not listed in SHA256SUMS"})
+	}
+	for _, c := range cases {
+		assert.ErrorContains(t, utils.VerifyBundle(c.fsys), c.message, c.name)
+	}
+
+	// tar 包中未列出的文件（包括符号链接）
+	dir := t.TempDir()
+	items := []tarItem{{name: "SHA256SUMS", content: valid}}
+	for name, content := range files {
+		items = append(items, tarItem{name: name, content: string(content)})
+	}
+	filename := path.Join(dir, "bundle.tar")
+	assert.NoError(t, os.WriteFile(filename, buildTar(t, items), 0644))
+	assert.NoError(t, utils.VerifyBundleFile(filename))
+	items = append(items, tarItem{name: "blobs/link", typeflag: tar.TypeSymlink, linkname: "../index.json"})
+	assert.NoError(t, os.WriteFile(filename, buildTar(t, items), 0644))
+	assert.ErrorContains(t, utils.VerifyBundleFile(filename), "blobs/link is not listed in SHA256SUMS")
+}
+
+func Test_ImportBundleTarget(t *testing.T) {
+	image := utils.NewImage("", "", "", false, "", "linux", "amd64", "")
+	// 没有指定目标仓库时，不会打开镜像包，也不会推回原来的仓库
+	err := utils.ImportBundle(&image, "testdata/missing-bundle.tar", utils.BundleOptions{})
+	assert.ErrorContains(t, err, "--registry-prefix or --tag-template is required")
+
+	err = utils.ImportBundle(&image, "testdata/missing-bundle.tar", utils.BundleOptions{RegistryPrefix: "registry.example.com/mirror"})
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "is required")
+}
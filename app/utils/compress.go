@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/valyala/fastjson"
+)
+
+// 检测文件的压缩格式：gzip, zstd, tar
+func detectCompression(fsys fs.FS, filename string) (string, error) {
+	fp, err := fsys.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	buff := make([]byte, 4)
+	n, err := io.ReadFull(fp, buff)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return detectCompressionBytes(buff[:n]), nil
+}
+func detectCompressionBytes(buff []byte) string {
+	if bytes.HasPrefix(buff, []byte{0x1f, 0x8b}) {
+		return "gzip"
+	}
+	if bytes.HasPrefix(buff, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		return "zstd"
+	}
+	return "tar"
+}
+
+// 固定压缩参数，保证相同的输入得到相同的输出
+func newCompressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "gzip":
+		// 不写入文件名和修改时间
+		return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("Unsupported compression %q", compression)
+}
+
+func compressFile(fsys fs.FS, src string, dst string, compression string) (err error) {
+	var in fs.File
+	var out *os.File
+	if in, err = fsys.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+	if out, err = os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644); err != nil {
+		return
+	}
+	defer out.Close()
+
+	var w io.WriteCloser
+	if w, err = newCompressWriter(out, compression); err != nil {
+		return
+	}
+	if _, err = io.Copy(w, in); err != nil {
+		return
+	}
+	return w.Close()
+}
+
+// ==================== diffID 与压缩后 digest 的对应关系 ====================
+var digestCacheLock sync.Mutex
+
+func digestCacheFile() string {
+	dir := os.Getenv("GO_DOCKER_CACHE_DIR")
+	if len(dir) == 0 {
+		if cacheDir, err := os.UserCacheDir(); err == nil {
+			dir = path.Join(cacheDir, "docker-pull-go")
+		} else {
+			dir = path.Join(os.TempDir(), "docker-pull-go")
+		}
+	}
+	return path.Join(dir, "diffid-digest.json")
+}
+
+func loadDigestCache() *fastjson.Value {
+	content, err := os.ReadFile(digestCacheFile())
+	if err == nil {
+		var p fastjson.Parser
+		if value, err := p.ParseBytes(content); err == nil && value.Type() == fastjson.TypeObject {
+			return value
+		}
+	}
+	return parseJsonString("{}")
+}
+
+// 查找 diffID 按指定方式压缩后的 digest
+func lookupCompressedDigest(diffId string, compression string) (desc descriptor, ok bool) {
+	digestCacheLock.Lock()
+	defer digestCacheLock.Unlock()
+
+	item := loadDigestCache().Get(compressionKey(compression, diffId))
+	if item == nil {
+		return
+	}
+	desc.Compression = compression
+	desc.MediaType = layerMediaType(compression, true)
+	desc.Digest = string(item.GetStringBytes("digest"))
+	desc.Size = item.GetInt64("size")
+	ok = len(desc.Digest) > 0 && desc.Size > 0
+	return
+}
+
+// 记录 diffID 压缩后的 digest，失败时不影响上传
+func saveCompressedDigest(diffId string, desc descriptor) {
+	digestCacheLock.Lock()
+	defer digestCacheLock.Unlock()
+
+	cache := loadDigestCache()
+	cache.Set(compressionKey(desc.Compression, diffId), parseJsonString(fmt.Sprintf(`{
+		"digest": "%s",
+		"size": %d
+	}`, desc.Digest, desc.Size)))
+
+	filename := digestCacheFile()
+	if err := ensureDir(path.Dir(filename)); err != nil {
+		return
+	}
+	os.WriteFile(filename, cache.MarshalTo(nil), 0644)
+}
+func compressionKey(compression string, diffId string) string {
+	return compression + "/" + diffId
+}
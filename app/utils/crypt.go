@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// 加密 layer 的格式与 ocicrypt 相同，wrap 后的 key 保存在 layer 的 annotations 中
+// https://github.com/containers/ocicrypt/blob/main/docs/spec.md
+const (
+	encryptedSuffix          = "+encrypted"
+	encKeysJweAnnotation     = "org.opencontainers.image.enc.keys.jwe"
+	encKeysPkcs7Annotation   = "org.opencontainers.image.enc.keys.pkcs7"
+	encPubOptsAnnotation     = "org.opencontainers.image.enc.pubopts"
+	layerCipherAes256CtrHmac = "AES_256_CTR_HMAC_SHA256"
+)
+
+// 公开的加密参数，保存在 pubopts 中
+type publicCipherOptions struct {
+	Cipher        string            `json:"cipher"`
+	Hmac          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// 私密的加密参数，由各个接收者的公钥 wrap 之后保存在 keys 中
+type privateCipherOptions struct {
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        string            `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+func isEncryptedMediaType(mediaType string) bool {
+	return strings.HasSuffix(mediaType, encryptedSuffix)
+}
+
+// 使用 AES-256-CTR 加密 layer 文件，HMAC-SHA256 保证完整性，返回需要写入 layer 的 annotations
+func encryptLayerFile(fsys fs.FS, src string, dst string, recipients []crypto.PublicKey) (map[string]string, error) {
+	digest, err := computeDigest(fsys, src)
+	if err != nil {
+		return nil, err
+	}
+	symmetricKey := make([]byte, 32)
+	nonce := make([]byte, aes.BlockSize)
+	if _, err = rand.Read(symmetricKey); err != nil {
+		return nil, err
+	}
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	in, err := fsys.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	block, err := aes.NewCipher(symmetricKey)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, symmetricKey)
+	writer := cipher.StreamWriter{S: cipher.NewCTR(block, nonce), W: io.MultiWriter(out, mac)}
+	if _, err = io.Copy(writer, in); err != nil {
+		return nil, err
+	}
+
+	private, err := json.Marshal(privateCipherOptions{
+		SymmetricKey:  symmetricKey,
+		Digest:        digest,
+		CipherOptions: map[string][]byte{"nonce": nonce},
+	})
+	if err != nil {
+		return nil, err
+	}
+	public, err := json.Marshal(publicCipherOptions{
+		Cipher:        layerCipherAes256CtrHmac,
+		Hmac:          mac.Sum(nil),
+		CipherOptions: map[string][]byte{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	jwe, err := wrapKeysJwe(recipients, private)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		encKeysJweAnnotation: base64.StdEncoding.EncodeToString(jwe),
+		encPubOptsAnnotation: base64.StdEncoding.EncodeToString(public),
+	}, nil
+}
+
+// 使用私钥从 annotations 中得到 layer 的对称密钥，解密 layer 文件并检查 HMAC 和解密后的 digest
+func decryptLayerFile(src string, dst string, annotations *fastjson.Value, keys []crypto.PrivateKey) error {
+	private, err := unwrapLayerKey(annotations, keys)
+	if err != nil {
+		return err
+	}
+	public := publicCipherOptions{}
+	if content := annotations.GetStringBytes(encPubOptsAnnotation); content != nil {
+		decoded, err := base64.StdEncoding.DecodeString(string(content))
+		if err != nil {
+			return fmt.Errorf("invalid %s annotation: %w", encPubOptsAnnotation, err)
+		}
+		if err = json.Unmarshal(decoded, &public); err != nil {
+			return fmt.Errorf("invalid %s annotation: %w", encPubOptsAnnotation, err)
+		}
+	}
+	if len(public.Cipher) == 0 {
+		public.Cipher = layerCipherAes256CtrHmac
+	}
+	if public.Cipher != layerCipherAes256CtrHmac {
+		return fmt.Errorf("unsupported layer cipher %s", public.Cipher)
+	}
+	nonce := public.CipherOptions["nonce"]
+	if nonce == nil {
+		nonce = private.CipherOptions["nonce"]
+	}
+	if len(private.SymmetricKey) != 32 || len(nonce) != aes.BlockSize {
+		return fmt.Errorf("invalid layer encryption key")
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	block, err := aes.NewCipher(private.SymmetricKey)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, private.SymmetricKey)
+	h := sha256.New()
+	reader := cipher.StreamReader{S: cipher.NewCTR(block, nonce), R: io.TeeReader(in, mac)}
+	if _, err = io.Copy(io.MultiWriter(out, h), reader); err != nil {
+		return err
+	}
+	if !hmac.Equal(mac.Sum(nil), public.Hmac) {
+		return fmt.Errorf("HMAC of the encrypted layer does not match")
+	}
+	if digest := fmt.Sprintf("sha256:%x", h.Sum(nil)); len(private.Digest) > 0 && digest != private.Digest {
+		return fmt.Errorf("digest of the decrypted layer %s does not match %s", digest, private.Digest)
+	}
+	return nil
+}
+
+// 依次尝试 JWE 和 PKCS7 格式的 key
+func unwrapLayerKey(annotations *fastjson.Value, keys []crypto.PrivateKey) (*privateCipherOptions, error) {
+	unwrappers := map[string]func([]byte, []crypto.PrivateKey) ([]byte, error){
+		encKeysJweAnnotation:   unwrapKeyJwe,
+		encKeysPkcs7Annotation: unwrapKeyPkcs7,
+	}
+	found := false
+	for _, name := range []string{encKeysJweAnnotation, encKeysPkcs7Annotation} {
+		value := string(annotations.GetStringBytes(name))
+		if len(value) == 0 {
+			continue
+		}
+		found = true
+		for _, item := range strings.Split(value, ",") {
+			wrapped, err := base64.StdEncoding.DecodeString(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s annotation: %w", name, err)
+			}
+			content, err := unwrappers[name](wrapped, keys)
+			if err != nil {
+				continue
+			}
+			private := &privateCipherOptions{}
+			if err = json.Unmarshal(content, private); err != nil {
+				return nil, fmt.Errorf("invalid layer encryption options: %w", err)
+			}
+			return private, nil
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("encrypted layer has no JWE or PKCS7 wrapped keys")
+	}
+	return nil, fmt.Errorf("none of the decryption keys can decrypt the layer")
+}
@@ -0,0 +1,308 @@
+package utils
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/valyala/fastjson"
+)
+
+type DiffOptions struct {
+	Files bool // 比较合并后的文件系统中的文件
+	Json  bool // 以 json 格式输出
+}
+
+type layerDiff struct {
+	Status string `json:"status"` // shared, removed, added
+	DiffID string `json:"diff_id"`
+	Digest string `json:"digest,omitempty"`
+	Size   int64  `json:"size"`
+}
+
+type configDiff struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+type fileDiff struct {
+	Status  string `json:"status"` // added, removed, modified
+	Path    string `json:"path"`
+	OldSize int64  `json:"old_size"`
+	NewSize int64  `json:"new_size"`
+}
+
+type imageDiff struct {
+	Layers []layerDiff  `json:"layers"`
+	Config []configDiff `json:"config"`
+	Files  []fileDiff   `json:"files,omitempty"`
+}
+
+// 比较两个镜像的 layer、config 和文件，镜像为远程镜像或本地镜像文件
+func DiffImages(sourceA string, imageA *Image, sourceB string, imageB *Image, opts DiffOptions) error {
+	srcA, err := loadSourceImage(sourceA, imageA)
+	if err != nil {
+		return err
+	}
+	defer srcA.cleanup()
+	srcB, err := loadSourceImage(sourceB, imageB)
+	if err != nil {
+		return err
+	}
+	defer srcB.cleanup()
+
+	var p fastjson.Parser
+	configA, err := p.ParseBytes(srcA.config)
+	if err != nil {
+		return err
+	}
+	var p2 fastjson.Parser
+	configB, err := p2.ParseBytes(srcB.config)
+	if err != nil {
+		return err
+	}
+
+	result := imageDiff{
+		Layers: diffLayers(srcA, configA, srcB, configB),
+		Config: diffConfigs(configA, configB),
+	}
+	if opts.Files {
+		filesA, err := listImageFiles(srcA, sourceA)
+		if err != nil {
+			return err
+		}
+		filesB, err := listImageFiles(srcB, sourceB)
+		if err != nil {
+			return err
+		}
+		result.Files = diffFiles(filesA, filesB)
+	}
+
+	if opts.Json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	printImageDiff(&result)
+	return nil
+}
+
+// 按 diff_id 比较 layer，diff_id 与压缩方式无关，可以比较远程镜像和本地镜像文件
+func diffLayers(srcA *sourceImage, configA *fastjson.Value, srcB *sourceImage, configB *fastjson.Value) []layerDiff {
+	toLayers := func(src *sourceImage, config *fastjson.Value) []layerDiff {
+		layers := []layerDiff{}
+		for idx, item := range config.GetArray("rootfs", "diff_ids") {
+			layer := layerDiff{DiffID: string(item.GetStringBytes())}
+			if idx < len(src.layers) {
+				layer.Digest = src.layers[idx].Digest
+				layer.Size = src.layers[idx].Size
+			}
+			layers = append(layers, layer)
+		}
+		return layers
+	}
+	layersA := toLayers(srcA, configA)
+	layersB := toLayers(srcB, configB)
+	diffIDsA := lo.SliceToMap(layersA, func(item layerDiff) (string, bool) { return item.DiffID, true })
+	diffIDsB := lo.SliceToMap(layersB, func(item layerDiff) (string, bool) { return item.DiffID, true })
+
+	result := []layerDiff{}
+	for _, layer := range layersA {
+		layer.Status = "removed"
+		if diffIDsB[layer.DiffID] {
+			layer.Status = "shared"
+		}
+		result = append(result, layer)
+	}
+	for _, layer := range layersB {
+		if !diffIDsA[layer.DiffID] {
+			layer.Status = "added"
+			result = append(result, layer)
+		}
+	}
+	return result
+}
+
+// 比较 config 中的 platform 和运行参数，Env 和 Labels 按名字逐个比较
+func diffConfigs(configA *fastjson.Value, configB *fastjson.Value) []configDiff {
+	result := []configDiff{}
+	valueString := func(value *fastjson.Value) string {
+		if value == nil || value.Type() == fastjson.TypeNull {
+			return ""
+		}
+		if value.Type() == fastjson.TypeString {
+			return string(value.GetStringBytes())
+		}
+		return string(value.MarshalTo(nil))
+	}
+	compare := func(field string, a string, b string) {
+		if a != b {
+			result = append(result, configDiff{Field: field, Old: a, New: b})
+		}
+	}
+
+	for _, field := range []string{"os", "architecture", "variant"} {
+		compare(field, valueString(configA.Get(field)), valueString(configB.Get(field)))
+	}
+
+	envA := configEnv(configA)
+	envB := configEnv(configB)
+	for _, key := range sortedKeys(lo.Assign(envA, envB)) {
+		compare("Env."+key, envA[key], envB[key])
+	}
+
+	for _, field := range []string{"Entrypoint", "Cmd", "User", "WorkingDir", "ExposedPorts", "Volumes", "StopSignal"} {
+		compare(field, valueString(configA.Get("config", field)), valueString(configB.Get("config", field)))
+	}
+
+	labelsA := configLabels(configA)
+	labelsB := configLabels(configB)
+	for _, key := range sortedKeys(lo.Assign(labelsA, labelsB)) {
+		compare("Labels."+key, labelsA[key], labelsB[key])
+	}
+	return result
+}
+
+func configEnv(config *fastjson.Value) map[string]string {
+	env := map[string]string{}
+	for _, item := range config.GetArray("config", "Env") {
+		parts := strings.SplitN(string(item.GetStringBytes()), "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		} else {
+			env[parts[0]] = ""
+		}
+	}
+	return env
+}
+
+func configLabels(config *fastjson.Value) map[string]string {
+	labels := map[string]string{}
+	if object := config.GetObject("config", "Labels"); object != nil {
+		object.Visit(func(key []byte, v *fastjson.Value) {
+			labels[string(key)] = string(v.GetStringBytes())
+		})
+	}
+	return labels
+}
+
+// 合并后的文件系统中的一个文件
+type imageFile struct {
+	typeflag byte
+	mode     int64
+	uid      int
+	gid      int
+	size     int64
+	linkname string
+	digest   string // 普通文件内容的 sha256
+}
+
+// 合并镜像的 layer，得到最终文件系统中的所有文件
+func listImageFiles(src *sourceImage, name string) (map[string]imageFile, error) {
+	files := map[string]imageFile{}
+	emit := func(header *tar.Header, r io.Reader) error {
+		file := imageFile{
+			typeflag: header.Typeflag,
+			mode:     header.Mode,
+			uid:      header.Uid,
+			gid:      header.Gid,
+			size:     header.Size,
+			linkname: header.Linkname,
+		}
+		if header.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			if _, err := io.Copy(h, r); err != nil {
+				return err
+			}
+			file.digest = fmt.Sprintf("%x", h.Sum(nil))
+		}
+		files["/"+strings.TrimSuffix(header.Name, "/")] = file
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Reading files of %s\n", name)
+	if err := src.flatten(emit); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func diffFiles(filesA map[string]imageFile, filesB map[string]imageFile) []fileDiff {
+	names := lo.Union(lo.Keys(filesA), lo.Keys(filesB))
+	sort.Strings(names)
+
+	result := []fileDiff{}
+	for _, name := range names {
+		a, inA := filesA[name]
+		b, inB := filesB[name]
+		switch {
+		case !inB:
+			result = append(result, fileDiff{Status: "removed", Path: name, OldSize: a.size})
+		case !inA:
+			result = append(result, fileDiff{Status: "added", Path: name, NewSize: b.size})
+		case a != b:
+			result = append(result, fileDiff{Status: "modified", Path: name, OldSize: a.size, NewSize: b.size})
+		}
+	}
+	return result
+}
+
+func printImageDiff(result *imageDiff) {
+	marks := map[string]string{"shared": "=", "removed": "-", "added": "+", "modified": "M"}
+
+	fmt.Println("Layers:")
+	for _, layer := range result.Layers {
+		fmt.Printf("  %s %s %s\n", marks[layer.Status], layer.DiffID, formatSize(layer.Size))
+	}
+
+	fmt.Println("Config:")
+	if len(result.Config) == 0 {
+		fmt.Println("  no changes")
+	}
+	for _, item := range result.Config {
+		fmt.Printf("  %s: %q -> %q\n", item.Field, item.Old, item.New)
+	}
+
+	if result.Files == nil {
+		return
+	}
+	fmt.Println("Files:")
+	if len(result.Files) == 0 {
+		fmt.Println("  no changes")
+	}
+	counts := map[string]int{}
+	for _, file := range result.Files {
+		counts[file.Status]++
+		switch file.Status {
+		case "added":
+			fmt.Printf("  + %s %s\n", file.Path, formatSize(file.NewSize))
+		case "removed":
+			fmt.Printf("  - %s %s\n", file.Path, formatSize(file.OldSize))
+		default:
+			fmt.Printf("  M %s %s -> %s\n", file.Path, formatSize(file.OldSize), formatSize(file.NewSize))
+		}
+	}
+	fmt.Printf("%d added, %d removed, %d modified\n", counts["added"], counts["removed"], counts["modified"])
+}
+
+// 以 B, KB, MB, GB 显示文件大小
+func formatSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// 将镜像最终的文件系统导出为一个 tar 包，output 为 - 时写到标准输出
+// layer 以数据流的方式下载并合并，不会在磁盘上保存任何文件
+func ExportImage(image *Image, output string) (err error) {
+	fmt.Fprintf(os.Stderr, "Export Image %s/%s:%s\n", image.Registry, image.Repository, image.Tag)
+
+	layers, err := topDownLayers(image)
+	if err != nil {
+		return err
+	}
+
+	var writer io.Writer = os.Stdout
+	if output != "" && output != "-" {
+		var file *os.File
+		if file, err = os.Create(output); err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(output)
+			}
+		}()
+		writer = file
+	}
+
+	return writeFlattenedTar(writer, len(layers), func(index int) (io.ReadCloser, error) {
+		fmt.Fprintf(os.Stderr, "(%d/%d) Exporting layer %s\n", index+1, len(layers), layers[index])
+		reader, err := openRemoteLayer(image, layers[index])
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %w", layers[index], err)
+		}
+		return reader, nil
+	})
+}
+
+// 按从上到下的顺序返回镜像 layer 的 digest
+func topDownLayers(image *Image) ([]string, error) {
+	manifest := image.FetchManifest("")
+	layers := []string{}
+	switch manifest.GetInt("schemaVersion") {
+	case 1:
+		// schema v1 的 fsLayers 本身就是从上到下的顺序
+		for _, item := range manifest.GetArray("fsLayers") {
+			layers = append(layers, string(item.GetStringBytes("blobSum")))
+		}
+	case 2:
+		manifest, err := selectPlatformManifest(image, manifest)
+		if err != nil {
+			return nil, err
+		}
+		items := manifest.GetArray("layers")
+		for i := len(items) - 1; i >= 0; i-- {
+			layers = append(layers, string(items[i].GetStringBytes("digest")))
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported schema version %d", manifest.GetInt("schemaVersion"))
+	}
+	return layers, nil
+}
+
+// 以数据流的方式下载并解压一个远程 layer
+func openRemoteLayer(image *Image, digest string) (io.ReadCloser, error) {
+	blob, err := openBlob(image, digest)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := decompressStream(blob)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return &layerReader{reader, blob}, nil
+}
@@ -0,0 +1,345 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/valyala/fastjson"
+)
+
+// utils_test 中的测试只能访问导出的名字，这里导出需要测试的内部函数，只在测试时编译
+
+// 返回每个文件及其 platform（<os>/<arch>[/<variant>]，未指定时为空）
+func ParsePushEntries(filename string) (files []string, platforms []string) {
+	for _, entry := range parsePushEntries(filename) {
+		files = append(files, entry.filename)
+		platform := ""
+		if entry.hasPlatform {
+			platform = entry.platform.osName + "/" + entry.platform.architecture
+			if len(entry.platform.variant) > 0 {
+				platform += "/" + entry.platform.variant
+			}
+		}
+		platforms = append(platforms, platform)
+	}
+	return
+}
+
+func CheckLayoutPlatforms(indexJson string) error {
+	return checkLayoutPlatforms(parseJsonString(indexJson).GetArray("manifests"))
+}
+
+var LayerMediaType = layerMediaType
+
+func RewriteImageTag(tag string, registryPrefix string, tagTemplate string) (string, error) {
+	return rewriteImageTag(tag, &PushOptions{RegistryPrefix: registryPrefix, TagTemplate: tagTemplate})
+}
+
+// 返回镜像包中每个镜像的 tag
+func ListArchiveImages(fsys fs.FS) ([][]string, error) {
+	images, err := listArchiveImages(fsys)
+	tags := [][]string{}
+	for _, image := range images {
+		tags = append(tags, image.tags)
+	}
+	return tags, err
+}
+
+// 打开镜像文件并读取其中的一个文件
+func ReadImageFile(filename string, name string) ([]byte, error) {
+	fsys, cleanup, err := openImageFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	return fs.ReadFile(fsys, name)
+}
+
+var (
+	CheckTarName       = checkTarName
+	CheckSymlinkTarget = checkSymlinkTarget
+	SecureJoin         = secureJoin
+	ExtractTar         = extractTar
+)
+
+// 将 layer 的 tar 数据流应用到 rootfs，rootless 为 sidecar 时不需要 root 权限
+func ApplyLayer(r io.Reader, rootfs string, rootless string) error {
+	u, err := newUnpacker(&PullOptions{Unpack: rootfs, Rootless: rootless})
+	if err != nil {
+		return err
+	}
+	return u.applyLayer(r)
+}
+
+var MapSubID = mapSubID
+
+// 合并从上到下的多个 layer tar 包
+func WriteFlattenedTar(w io.Writer, layers [][]byte) error {
+	return writeFlattenedTar(w, len(layers), func(index int) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(layers[index])), nil
+	})
+}
+
+// append 生成的 history，返回 JSON
+func AppendHistory(modTime time.Time, source string) string {
+	var a fastjson.Arena
+	return string(appendHistory(&a, modTime, source).MarshalTo(nil))
+}
+
+// 将目录打包为 layer
+func WriteDirLayer(w io.Writer, dir string, owner string, modTime time.Time) error {
+	layerOwner, err := parseLayerOwner(owner)
+	if err != nil {
+		return err
+	}
+	return writeDirLayer(w, dir, layerOwner, modTime)
+}
+
+// 修改 config 和 manifest 的 JSON
+func MutateConfig(config string, opts MutateOptions) string {
+	value := parseJsonString(config)
+	mutateConfig(value, &opts)
+	return string(value.MarshalTo(nil))
+}
+
+func SetAnnotations(manifest string, annotations map[string]string) string {
+	value := parseJsonString(manifest)
+	setAnnotations(value, annotations)
+	return string(value.MarshalTo(nil))
+}
+
+func CheckBaseConfig(app string, base string) error {
+	return checkBaseConfig(parseJsonString(app), parseJsonString(base))
+}
+
+// 分析本地镜像文件，返回 JSON 格式的结果
+func AnalyzeLayers(source string, top int) (string, error) {
+	image := NewImage("", "", "", false, "", "linux", "amd64", "")
+	src, err := loadSourceImage(source, &image)
+	if err != nil {
+		return "", err
+	}
+	defer src.cleanup()
+	result, err := analyzeLayers(src, top)
+	if err != nil {
+		return "", err
+	}
+	content, err := json.Marshal(result)
+	return string(content), err
+}
+
+// 读取本地镜像文件中的 os-release，返回其中的 ID
+func ScanOsRelease(source string) (string, error) {
+	image := NewImage("", "", "", false, "", "linux", "amd64", "")
+	src, err := loadSourceImage(source, &image)
+	if err != nil {
+		return "", err
+	}
+	defer src.cleanup()
+	_, release, err := scanPackages(src)
+	if err != nil || release == nil {
+		return "", err
+	}
+	return release.ID, nil
+}
+
+// 解析 rpm 数据库，每个软件包返回 <name> <version> <arch> <license>
+func ParseRpmDatabase(name string, content []byte) ([]string, error) {
+	packages, err := parseRpmDatabase(name, content, "/"+name)
+	result := []string{}
+	for _, item := range packages {
+		result = append(result, strings.Join([]string{item.Name, item.Version, item.Arch, item.License}, " "))
+	}
+	return result, err
+}
+
+func PackagePurl(packageType string, name string, version string, arch string, osID string, osVersion string) string {
+	item := sbomPackage{Type: packageType, Name: name, Version: version, Arch: arch}
+	return item.purl(&osRelease{ID: osID, VersionID: osVersion})
+}
+
+func NormalizeSpdxLicense(license string) (string, bool) {
+	return normalizeSpdxLicense(license)
+}
+
+// 生成 SPDX 文档，返回每个软件包的 licenseDeclared 和 LicenseRef 对应的文本
+func SpdxLicenses(licenses []string) ([]string, map[string]string) {
+	packages := []sbomPackage{}
+	for idx, license := range licenses {
+		packages = append(packages, sbomPackage{Type: "pypi", Name: fmt.Sprintf("p%d", idx), License: license})
+	}
+	document := buildSpdx("image", packages, nil)
+	declared := []string{}
+	for _, item := range document.Packages[1:] {
+		declared = append(declared, item.LicenseDeclared)
+	}
+	extracted := map[string]string{}
+	for _, item := range document.ExtractedLicenses {
+		extracted[item.LicenseId] = item.ExtractedText
+	}
+	return declared, extracted
+}
+
+// 生成 CycloneDX 文档，返回每个软件包 licenses 的 JSON
+func CycloneDXLicenses(licenses []string) []string {
+	packages := []sbomPackage{}
+	for idx, license := range licenses {
+		packages = append(packages, sbomPackage{Type: "pypi", Name: fmt.Sprintf("p%d", idx), License: license})
+	}
+	result := []string{}
+	for _, item := range buildCycloneDX("image", packages, nil).Components {
+		content, _ := json.Marshal(item.Licenses)
+		result = append(result, string(content))
+	}
+	return result
+}
+
+func IsReferrersUnsupported(statusCode int) bool {
+	return isReferrersUnsupported(statusCode)
+}
+
+func SignPayload(keyFile string, payload []byte) ([]byte, error) {
+	signer, err := loadPrivateKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return signPayload(signer, payload)
+}
+
+func CheckSignedPayload(publicKeyFile string, payload []byte, signature []byte, digest string) error {
+	publicKey, err := loadPublicKey(publicKeyFile)
+	if err != nil {
+		return err
+	}
+	return checkSignedPayload(publicKey, payload, signature, digest)
+}
+
+// 使用 keyFile 检查镜像的签名
+func VerifyImageSignature(name string, keyFile string) error {
+	image := NewImage(name, "", "", true, "", "linux", "amd64", "")
+	_, err := verifyImageSignature(&image, []signatureRequirement{{source: "test", keys: []string{keyFile}}})
+	return err
+}
+
+func GlobToRegexp(pattern string) *regexp.Regexp {
+	return globToRegexp(pattern)
+}
+
+// 检查策略，返回 pull 时需要验证签名的公钥
+func CheckPolicy(filename string, name string, operation string) ([]string, error) {
+	image := NewImage(name, "", "", false, "", "linux", "amd64", "")
+	requirements, err := checkPolicy(filename, &image, operation)
+	keys := []string{}
+	for _, item := range requirements {
+		keys = append(keys, item.keys...)
+	}
+	return keys, err
+}
+
+var (
+	AesKeyWrap   = aesKeyWrap
+	AesKeyUnwrap = aesKeyUnwrap
+	ConcatKDF    = concatKDF
+)
+
+// 使用公钥文件加密 layer，返回 annotations
+func EncryptLayerFile(src string, dst string, recipients []string) (map[string]string, error) {
+	keys, err := loadEncryptionKeys(recipients)
+	if err != nil {
+		return nil, err
+	}
+	return encryptLayerFile(os.DirFS(path.Dir(src)), path.Base(src), dst, keys)
+}
+
+// 使用私钥文件解密 layer，annotations 为 json 格式
+func DecryptLayerFile(src string, dst string, annotations string, keyFiles []string) error {
+	keys, err := loadDecryptionKeys(keyFiles)
+	if err != nil {
+		return err
+	}
+	return decryptLayerFile(src, dst, parseJsonString(annotations), keys)
+}
+
+func UnwrapKeyPkcs7(data []byte, keyFile string) ([]byte, error) {
+	keys, err := loadDecryptionKeys([]string{keyFile})
+	if err != nil {
+		return nil, err
+	}
+	return unwrapKeyPkcs7(data, keys)
+}
+
+func ManifestDigest(content []byte) string {
+	return manifestDigest(content)
+}
+
+// 返回 lockfile 中的镜像名和 digest
+func ReadLockfile(filename string) (references []string, digests []string, err error) {
+	lockfile, err := readLockfile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, item := range lockfile.Images {
+		references = append(references, item.Reference)
+		digests = append(digests, item.Digest)
+	}
+	return
+}
+
+func FindLockedDigest(filename string, name string) (string, error) {
+	image := NewImage(name, "", "", false, "", "linux", "amd64", "")
+	return findLockedDigest(filename, &image)
+}
+
+// 返回列表中每个镜像的 [image, platform, name]
+func ReadImageList(filename string) ([][]string, error) {
+	entries, err := readImageList(filename)
+	if err != nil {
+		return nil, err
+	}
+	result := [][]string{}
+	for _, entry := range entries {
+		result = append(result, []string{entry.Image, entry.Platform, entry.Name})
+	}
+	return result, nil
+}
+
+func VerifyBundle(fsys fs.FS) error {
+	return verifyBundle(fsys)
+}
+
+// 按 import 的方式打开镜像包文件后检查
+func VerifyBundleFile(filename string) error {
+	fsys, cleanup, err := openImageFile(filename)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return verifyBundle(fsys)
+}
+
+// 批量下载时共享的 pull token
+type TokenCache struct {
+	cache *tokenCache
+}
+
+func NewTokenCache() *TokenCache {
+	return &TokenCache{cache: newTokenCache()}
+}
+
+func (c *TokenCache) Register(name string) {
+	image := NewImage(name, "", "", true, "", "linux", "amd64", "")
+	c.cache.register(&image)
+}
+
+func (c *TokenCache) PullToken(name string) string {
+	image := NewImage(name, "", "", true, "", "linux", "amd64", "")
+	return c.cache.pullToken(&image)
+}
@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// 从上到下合并多个 layer，得到镜像最终的文件系统
+// 上层已经写出、删除或标记为 opaque 的路径在下层中直接跳过，因此每个 layer 只需按顺序读取一次
+type layerFlattener struct {
+	emitted      map[string]*tar.Header // 已写出的路径
+	deleted      map[string]bool        // whiteout 删除的路径，包括其下的所有文件
+	opaque       map[string]bool        // opaque 目录，下层中该目录下的文件全部隐藏
+	parents      map[string]bool        // 已写出文件的上级目录，下层中同名的非目录文件会被隐藏
+	pendingLinks []*tar.Header          // 目标文件在更下层的硬链接，等目标写出后再写
+}
+
+// 写出一个文件，r 为文件内容
+type flattenEmitter func(header *tar.Header, r io.Reader) error
+
+func newLayerFlattener() *layerFlattener {
+	return &layerFlattener{
+		emitted: map[string]*tar.Header{},
+		deleted: map[string]bool{},
+		opaque:  map[string]bool{},
+		parents: map[string]bool{},
+	}
+}
+
+// 路径是否已被上层的文件覆盖或删除
+func (f *layerFlattener) hidden(name string) bool {
+	if _, ok := f.emitted[name]; ok || f.deleted[name] {
+		return true
+	}
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if f.deleted[dir] || f.opaque[dir] {
+			return true
+		}
+		// 上层把该目录替换成了普通文件
+		if header, ok := f.emitted[dir]; ok && header.Typeflag != tar.TypeDir {
+			return true
+		}
+		if dir == "." {
+			return false
+		}
+	}
+}
+
+// 处理一个 layer 的 tar 数据流，layer 需要按从上到下的顺序传入
+func (f *layerFlattener) addLayer(r io.Reader, emit flattenEmitter) error {
+	// 同一个 layer 中的 whiteout 只作用于更下层，处理完当前 layer 后再生效
+	layerDeleted := []string{}
+	layerOpaque := []string{}
+
+	tarFile := tar.NewReader(r)
+	for {
+		header, err := tarFile.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name, err := checkTarName(header.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." || header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		base := path.Base(name)
+		if base == whiteoutOpaque {
+			layerOpaque = append(layerOpaque, path.Dir(name))
+			continue
+		}
+		if target, ok, err := whiteoutTarget(name); ok {
+			if err != nil {
+				return err
+			}
+			layerDeleted = append(layerDeleted, target)
+			continue
+		}
+		if f.hidden(name) || header.Typeflag != tar.TypeDir && f.parents[name] {
+			continue
+		}
+		for dir := path.Dir(name); dir != "." && !f.parents[dir]; dir = path.Dir(dir) {
+			f.parents[dir] = true
+		}
+
+		header.Name = name
+		if header.Typeflag == tar.TypeDir {
+			header.Name += "/"
+		}
+		f.emitted[name] = header
+
+		if header.Typeflag == tar.TypeLink {
+			if header.Linkname, err = checkTarName(header.Linkname); err != nil {
+				return err
+			}
+			if _, ok := f.emitted[header.Linkname]; !ok {
+				f.pendingLinks = append(f.pendingLinks, header)
+				continue
+			}
+		}
+		if err = emit(header, tarFile); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range layerDeleted {
+		f.deleted[name] = true
+	}
+	for _, name := range layerOpaque {
+		f.opaque[name] = true
+	}
+	return nil
+}
+
+func (f *layerFlattener) isPending(header *tar.Header) bool {
+	for _, item := range f.pendingLinks {
+		if item == header {
+			return true
+		}
+	}
+	return false
+}
+
+// 写出目标文件已存在的硬链接，目标文件已被删除的硬链接会被丢弃
+func (f *layerFlattener) finish(emit flattenEmitter) error {
+	for _, header := range f.pendingLinks {
+		target, ok := f.emitted[header.Linkname]
+		if !ok || target.Typeflag == tar.TypeLink && f.isPending(target) {
+			continue
+		}
+		if err := emit(header, strings.NewReader("")); err != nil {
+			return err
+		}
+	}
+	f.pendingLinks = nil
+	return nil
+}
+
+// 合并 count 个 layer，对最终文件系统中的每个文件调用 emit，openLayer 按从上到下的顺序返回 layer 解压后的数据流
+func flattenLayers(count int, openLayer func(index int) (io.ReadCloser, error), emit flattenEmitter) error {
+	flattener := newLayerFlattener()
+	for index := 0; index < count; index++ {
+		reader, err := openLayer(index)
+		if err != nil {
+			return err
+		}
+		err = flattener.addLayer(reader, emit)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("layer %d/%d: %w", index+1, count, err)
+		}
+	}
+	return flattener.finish(emit)
+}
+
+// 合并 count 个 layer，将最终的文件系统写为一个 tar 包
+func writeFlattenedTar(w io.Writer, count int, openLayer func(index int) (io.ReadCloser, error)) error {
+	tarWriter := tar.NewWriter(w)
+	emit := func(header *tar.Header, r io.Reader) error {
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := io.Copy(tarWriter, r)
+		return err
+	}
+	if err := flattenLayers(count, openLayer, emit); err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
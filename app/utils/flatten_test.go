@@ -0,0 +1,76 @@
+package utils_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+// 读取 tar 包中的每个文件：文件内容，符号链接和硬链接为 -> 目标
+func readTarFiles(t *testing.T, content []byte) map[string]string {
+	files := map[string]string{}
+	r := tar.NewReader(bytes.NewReader(content))
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(r)
+		switch header.Typeflag {
+		case tar.TypeSymlink, tar.TypeLink:
+			files[header.Name] = "-> " + header.Linkname
+		default:
+			files[header.Name] = string(data)
+		}
+	}
+	return files
+}
+
+func Test_WriteFlattenedTar(t *testing.T) {
+	// 从上到下的顺序
+	layers := [][]byte{
+		buildTar(t, []tarItem{
+			{name: "etc/.wh.removed"},
+			{name: "opt/.wh..wh..opq"},
+			{name: "opt/new", content: "new"},
+			{name: "bin", content: "bin is a file now"},
+			{name: "etc/conf", content: "top"},
+		}),
+		buildTar(t, []tarItem{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/conf", content: "middle"},
+			{name: "etc/removed", content: "x"},
+			{name: "hard", typeflag: tar.TypeLink, linkname: "data/file"},
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "etc/conf"},
+		}),
+		buildTar(t, []tarItem{
+			{name: "etc/removed", content: "x"},
+			{name: "opt/old", content: "old"},
+			{name: "bin/sh", content: "sh"},
+			{name: "data/file", content: "data"},
+			{name: "gone/.wh.x"},
+		}),
+	}
+	var buff bytes.Buffer
+	assert.NoError(t, utils.WriteFlattenedTar(&buff, layers))
+	assert.Equal(t, map[string]string{
+		"etc/":      "",
+		"etc/conf":  "top",
+		"opt/new":   "new",
+		"bin":       "bin is a file now",
+		"link":      "-> etc/conf",
+		"data/file": "data",
+		// 目标在更下层的硬链接最后写出
+		"hard": "-> data/file",
+	}, readTarFiles(t, buff.Bytes()))
+
+	for _, name := range []string{".wh..", "etc/.wh..."} {
+		layers := [][]byte{buildTar(t, []tarItem{{name: name}}), layers[1]}
+		assert.ErrorContains(t, utils.WriteFlattenedTar(io.Discard, layers), "invalid whiteout", name)
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"io/fs"
 	"os"
 )
 
@@ -16,4 +17,8 @@ func ensureDir(dir string) error {
 func checkExist(path string) bool {
   _, err := os.Stat(path)
   return err == nil
-}
\ No newline at end of file
+}
+func checkFsExist(fsys fs.FS, name string) bool {
+	_, err := fs.Stat(fsys, name)
+	return err == nil
+}
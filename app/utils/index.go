@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
@@ -40,12 +42,26 @@ type Image struct {
 	password string;
 	pullToken string;
 	pushToken string;
+	mountTokens map[string]string;
+	tokens *tokenCache;		// 批量下载时共享的 pull token
 
-	platform struct {
-		architecture string;
-		osName string;
-		variant string;
- };
+	platform imagePlatform;
+}
+
+type imagePlatform struct {
+	architecture string;
+	osName string;
+	variant string;
+}
+
+// manifest 的描述信息
+type descriptor struct {
+	MediaType string;
+	Digest string;
+	Size int64;
+	Platform imagePlatform;
+	Annotations map[string]string;	// 加密 layer 的 wrap 后的 key 等
+	Compression string;		// 上传的 layer 的压缩方式：gzip, zstd, tar
 }
 
 func (i *Image) ParseImage(image string) {
@@ -54,11 +70,16 @@ func (i *Image) ParseImage(image string) {
 	tag := "latest"
 	imageName := ""
 
+	// docker.io/library/nginx 与 nginx 相同
+	for _, prefix := range []string{"docker.io/", "index.docker.io/", "registry-1.docker.io/"} {
+		image = strings.TrimPrefix(image, prefix)
+	}
+
 	imgParts := strings.Split(image, "/")
 	name := imgParts[len(imgParts) - 1]
-	if strings.Contains(name, "@") {            // 参数是 <image>@sha256:<hash> 的格式
+	if strings.Contains(name, "@") {            // 参数是 <image>[:<tag>]@sha256:<hash> 的格式，同时有 tag 时使用 digest
 		nameParts := strings.Split(name, "@")
-		imageName = nameParts[0]
+		imageName = strings.Split(nameParts[0], ":")[0]
 		tag = nameParts[1]                        // sha256:<hash>
 	} else if strings.Contains(name, ":") {     // 参数是 <image>:<tag> 的格式
 		nameParts := strings.Split(name, ":")
@@ -90,6 +111,14 @@ func (i *Image) ParseImage(image string) {
 	i.Namespace = namespace
 }
 
+// 规范化的镜像名：<registry>/<repository>:<tag> 或 <registry>/<repository>@<digest>，docker hub 使用 docker.io
+func (i *Image) Reference() string {
+	if strings.HasPrefix(i.Tag, "sha256:") {
+		return fmt.Sprintf("%s@%s", policyReference(i), i.Tag)
+	}
+	return fmt.Sprintf("%s:%s", policyReference(i), i.Tag)
+}
+
 func (i *Image) setApiProxy(c *resty.Client) {
 	proxy := os.Getenv("DOCKER_API_PROXY")
 	if proxy != "" {
@@ -97,7 +126,13 @@ func (i *Image) setApiProxy(c *resty.Client) {
 	}
 }
 
-func (i *Image) requestToken(action string) string {
+func (i *Image) requestToken(action string, extraScopes ...string) string {
+	token, _ := i.requestTokenWithExpiry(action, extraScopes...)
+	return token
+}
+
+// 申请 token，同时返回 token 的有效期
+func (i *Image) requestTokenWithExpiry(action string, extraScopes ...string) (string, time.Duration) {
 	// https://distribution.github.io/distribution/spec/auth/token/
 	// 使用指定的反向代理
 	baseUrl := fmt.Sprintf("%s://%s", i.protocol, i.Registry)
@@ -134,18 +169,27 @@ func (i *Image) requestToken(action string) string {
 	}
 	req = client.NewRequest()
 	req.SetQueryParam("service", regexp.MustCompile(`service="([^"]+)"`).FindStringSubmatch(wwwAuth)[1])
-	req.SetQueryParam("scope", fmt.Sprintf("repository:%s:%s", i.Repository, action))
+	scopes := append([]string{fmt.Sprintf("repository:%s:%s", i.Repository, action)}, extraScopes...)
+	req.SetQueryParamsFromValues(map[string][]string{"scope": scopes})
 	if len(i.username) > 0 && len(i.password) > 0 {
 		req.SetBasicAuth(i.username, i.password)
 	}
 	resp, err = req.Get(url)
 
 	data := parseJson(resp.Body())
-	return string(data.Get("token").GetStringBytes())
+	// 未返回 expires_in 时默认为 60 秒
+	expiresIn := time.Duration(data.GetInt("expires_in")) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = 60 * time.Second
+	}
+	return string(data.Get("token").GetStringBytes()), expiresIn
 }
 
 func (i *Image) GetToken(action string) string {
 	if action == "pull" {
+		if i.tokens != nil {
+			return i.tokens.pullToken(i)
+		}
 		if len(i.pullToken) == 0 {
 			i.pullToken = i.requestToken("pull")
 		}
@@ -160,10 +204,34 @@ func (i *Image) GetToken(action string) string {
 	return i.pushToken
 }
 
+// 跨 repository mount blob 时，需要同时拥有来源 repository 的 pull 权限
+func (i *Image) GetMountToken(from string) string {
+	if i.mountTokens == nil {
+		i.mountTokens = map[string]string{}
+	}
+	if len(i.mountTokens[from]) == 0 {
+		i.mountTokens[from] = i.requestToken("pull,push", fmt.Sprintf("repository:%s:pull", from))
+	}
+	return i.mountTokens[from]
+}
+
 func (i *Image) FetchManifest(digest string) *fastjson.Value {
+	content, _, err := i.fetchManifestRaw(digest)
+	ThrowIfError(err)
+
+	data := parseJson(content)
+	return data
+}
+
+// manifest 不存在时 fetchManifestRaw 返回的错误
+var errManifestNotFound = errors.New("manifest not found")
+
+// 获取 manifest 的原始内容和 Content-Type，reference 为空时使用镜像的 tag
+// reference 为 digest 时检查返回内容的 digest，防止仓库或镜像站返回其他的 manifest
+func (i *Image) fetchManifestRaw(reference string) (content []byte, mediaType string, err error) {
 	token := i.GetToken("pull")
-	if len(digest) == 0 {
-		digest = i.Tag
+	if len(reference) == 0 {
+		reference = i.Tag
 	}
 	// 使用指定的反向代理
 	baseUrl := fmt.Sprintf("%s://%s", i.protocol, i.Registry)
@@ -171,7 +239,7 @@ func (i *Image) FetchManifest(digest string) *fastjson.Value {
 	if proxy != "" && strings.HasPrefix(proxy, "http") {
 		baseUrl = proxy
 	}
-	manifestUrl := fmt.Sprintf("%s/v2/%s/manifests/%s", baseUrl, i.Repository, digest)
+	manifestUrl := fmt.Sprintf("%s/v2/%s/manifests/%s", baseUrl, i.Repository, reference)
 
 	client := resty.New()
 	i.setApiProxy(client)
@@ -185,23 +253,74 @@ func (i *Image) FetchManifest(digest string) *fastjson.Value {
 			"application/vnd.docker.distribution.manifest.list.v2+json",
 			"application/vnd.docker.distribution.manifest.v1+json",
 			"application/vnd.oci.image.manifest.v1+json",
+			"application/vnd.oci.image.index.v1+json",
 		},
 	}
 	req.SetHeaderMultiValues(headers)
 	resp, err := req.Get(manifestUrl)
-	ThrowIfError(err)
+	if err != nil {
+		return
+	}
 
+	if resp.StatusCode() == 404 {
+		err = fmt.Errorf("%w: %s", errManifestNotFound, manifestUrl)
+		return
+	}
 	if resp.StatusCode() != 200 {
-		fmt.Println("manifestUrl:", manifestUrl)
-		fmt.Println(string(resp.Body()))
-		ThrowIfError(fmt.Errorf("FetchManifest with status %d", resp.StatusCode()))
+		// 错误信息中包含仓库返回的内容，不输出到标准输出，以免破坏 --json 的结果
+		body := strings.TrimSpace(string(resp.Body()))
+		if len(body) > 512 {
+			body = body[:512] + "..."
+		}
+		err = fmt.Errorf("FetchManifest %s with status %d: %s", manifestUrl, resp.StatusCode(), body)
+		return
+	}
+	content = resp.Body()
+	if strings.Contains(reference, ":") {
+		if !strings.HasPrefix(reference, "sha256:") {
+			err = fmt.Errorf("unsupported digest algorithm in %s", reference)
+			return
+		}
+		if digest := manifestDigest(content); digest != reference {
+			err = fmt.Errorf("manifest digest mismatch: requested %s but %s returned %s", reference, manifestUrl, digest)
+			return
+		}
 	}
+	return content, resp.Header().Get("Content-Type"), nil
+}
 
-	data := parseJson(resp.Body())
-	return data
+// 计算 manifest 的 digest；schema v1 的签名 manifest 的 digest 不包括签名部分
+// https://github.com/distribution/distribution/blob/v2.8.3/docs/spec/manifest-v2-1.md#signed-manifests
+func manifestDigest(content []byte) string {
+	var p fastjson.Parser
+	manifest, err := p.ParseBytes(content)
+	if err != nil || manifest.GetInt("schemaVersion") != 1 || len(manifest.GetArray("signatures")) == 0 {
+		return computeBytesDigest(content)
+	}
+	protected, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(string(manifest.GetStringBytes("signatures", "0", "protected")), "="))
+	if err != nil {
+		return computeBytesDigest(content)
+	}
+	header, err := p.ParseBytes(protected)
+	if err != nil {
+		return computeBytesDigest(content)
+	}
+	formatLength := header.GetInt("formatLength")
+	formatTail, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(string(header.GetStringBytes("formatTail")), "="))
+	if err != nil || formatLength <= 0 || formatLength > len(content) {
+		return computeBytesDigest(content)
+	}
+	return computeBytesDigest(append(append([]byte{}, content[:formatLength]...), formatTail...))
 }
 
 
+// 使用相同的认证信息和配置，得到另一个镜像
+func (i *Image) WithReference(name string) Image {
+	image := NewImage(name, i.username, i.password, i.protocol == "http", i.mirror, i.platform.osName, i.platform.architecture, i.platform.variant)
+	image.tokens = i.tokens
+	return image
+}
+
 func NewImage(
 	name string, username string, password string, insecureRegistry bool, mirror string,
 	osName string, architecture string, variant string,
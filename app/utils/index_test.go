@@ -0,0 +1,84 @@
+package utils_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_ManifestDigest(t *testing.T) {
+	digest := func(content string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+	}
+	protected := func(header string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(header))
+	}
+
+	// 由 docker/libtrust 签名的 schema v1 manifest，digest 是去掉签名之后的内容的 digest
+	content, err := os.ReadFile("testdata/manifest-v1-signed.json")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:f5f3fb381d27b2e899d1b5ef9a7d286a3e7da3f41283ba39da21faacdd7cd8c3", utils.ManifestDigest(content))
+
+	// 签名插入在最后的 "\n}" 之前，protected header 记录了去掉签名的方法
+	unsigned := `{
+   "schemaVersion": 1,
+   "name": "library/hello-world",
+   "tag": "latest",
+   "architecture": "amd64",
+   "fsLayers": [
+      {
+         "blobSum": "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+      }
+   ],
+   "history": [
+      {
+         "v1Compatibility": "{\"id\":\"e45a5af57b00862e5ef5782a9925979a02ba2b12dff832fd0991335f4a11e5c5\"}"
+      }
+   ]
+}`
+	formatLength := len(unsigned) - 2
+	signed := func(header string) string {
+		return unsigned[:formatLength] + `,
+   "signatures": [
+      {
+         "header": {
+            "alg": "ES256"
+         },
+         "signature": "c2lnbmF0dXJl",
+         "protected": "` + header + `"
+      }
+   ]
+}`
+	}
+	valid := protected(fmt.Sprintf(`{"formatLength":%d,"formatTail":"Cn0","time":"2016-01-01T00:00:00Z"}`, formatLength))
+
+	cases := []struct {
+		content  string
+		expected string
+	}{
+		{signed(valid), digest(unsigned)},
+		// 带有 base64 padding 的 protected header
+		{signed(valid + strings.Repeat("=", (4-len(valid)%4)%4)), digest(unsigned)},
+		// 无法得到签名前的内容时，使用 manifest 本身的 digest
+		{signed(protected(`{"formatLength":100000,"formatTail":"Cn0"}`)), ""},
+		{signed(protected(`{"formatTail":"Cn0"}`)), ""},
+		{signed(protected(`not json`)), ""},
+		{signed("!!!"), ""},
+		{unsigned, ""},
+		{`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","signatures":[{}]}`, ""},
+		{`not json`, ""},
+	}
+	for _, c := range cases {
+		expected := c.expected
+		if len(expected) == 0 {
+			expected = digest(c.content)
+		}
+		assert.Equal(t, expected, utils.ManifestDigest([]byte(c.content)), c.content)
+	}
+}
@@ -0,0 +1,584 @@
+package utils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ==================== JWE ====================
+// 与 ocicrypt 相同：内容使用 A256GCM 加密，RSA 公钥使用 RSA-OAEP，EC 公钥使用 ECDH-ES+A256KW
+// https://www.rfc-editor.org/rfc/rfc7516 https://www.rfc-editor.org/rfc/rfc7518
+
+type jweHeader struct {
+	Alg string `json:"alg,omitempty"`
+	Enc string `json:"enc,omitempty"`
+	Zip string `json:"zip,omitempty"`
+	Epk *ecJwk `json:"epk,omitempty"`
+	Apu string `json:"apu,omitempty"`
+	Apv string `json:"apv,omitempty"`
+}
+
+type ecJwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jweRecipient struct {
+	Header       *jweHeader `json:"header,omitempty"`
+	EncryptedKey string     `json:"encrypted_key,omitempty"`
+}
+
+// JWE 的 JSON 格式，包括 general 和 flattened 两种形式
+type jweJson struct {
+	Protected    string         `json:"protected,omitempty"`
+	Unprotected  *jweHeader     `json:"unprotected,omitempty"`
+	Header       *jweHeader     `json:"header,omitempty"`
+	EncryptedKey string         `json:"encrypted_key,omitempty"`
+	Recipients   []jweRecipient `json:"recipients,omitempty"`
+	Aad          string         `json:"aad,omitempty"`
+	Iv           string         `json:"iv"`
+	Ciphertext   string         `json:"ciphertext"`
+	Tag          string         `json:"tag"`
+}
+
+var b64url = base64.RawURLEncoding
+
+// 为每个公钥加密 plaintext，返回 JSON 格式的 JWE
+func wrapKeysJwe(recipients []crypto.PublicKey, plaintext []byte) ([]byte, error) {
+	cek := make([]byte, 32)
+	iv := make([]byte, 12)
+	if _, err := rand.Read(cek); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	result := jweJson{Protected: b64url.EncodeToString([]byte(`{"enc":"A256GCM"}`))}
+	for _, key := range recipients {
+		recipient := jweRecipient{Header: &jweHeader{}}
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, key, cek, nil)
+			if err != nil {
+				return nil, err
+			}
+			recipient.Header.Alg = "RSA-OAEP"
+			recipient.EncryptedKey = b64url.EncodeToString(encryptedKey)
+		case *ecdsa.PublicKey:
+			publicKey, err := key.ECDH()
+			if err != nil {
+				return nil, err
+			}
+			ephemeral, err := publicKey.Curve().GenerateKey(rand.Reader)
+			if err != nil {
+				return nil, err
+			}
+			shared, err := ephemeral.ECDH(publicKey)
+			if err != nil {
+				return nil, err
+			}
+			recipient.Header.Alg = "ECDH-ES+A256KW"
+			if recipient.Header.Epk, err = newEcJwk(key.Curve, ephemeral.PublicKey()); err != nil {
+				return nil, err
+			}
+			kek := concatKDF(shared, recipient.Header.Alg, nil, nil, 32)
+			encryptedKey, err := aesKeyWrap(kek, cek)
+			if err != nil {
+				return nil, err
+			}
+			recipient.EncryptedKey = b64url.EncodeToString(encryptedKey)
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T for JWE", key)
+		}
+		result.Recipients = append(result.Recipients, recipient)
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(result.Protected))
+	result.Iv = b64url.EncodeToString(iv)
+	result.Ciphertext = b64url.EncodeToString(sealed[:len(sealed)-gcm.Overhead()])
+	result.Tag = b64url.EncodeToString(sealed[len(sealed)-gcm.Overhead():])
+	return json.Marshal(result)
+}
+
+// 使用任意一个私钥解密 JWE
+func unwrapKeyJwe(data []byte, keys []crypto.PrivateKey) ([]byte, error) {
+	var jwe jweJson
+	if err := json.Unmarshal(data, &jwe); err != nil {
+		return nil, fmt.Errorf("invalid JWE: %w", err)
+	}
+	protected := jweHeader{}
+	if len(jwe.Protected) > 0 {
+		content, err := b64url.DecodeString(jwe.Protected)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWE protected header: %w", err)
+		}
+		if err = json.Unmarshal(content, &protected); err != nil {
+			return nil, fmt.Errorf("invalid JWE protected header: %w", err)
+		}
+	}
+	recipients := jwe.Recipients
+	if len(recipients) == 0 {
+		recipients = []jweRecipient{{Header: jwe.Header, EncryptedKey: jwe.EncryptedKey}}
+	}
+
+	for _, recipient := range recipients {
+		header := mergeJweHeaders(protected, jwe.Unprotected, recipient.Header)
+		if len(header.Zip) > 0 {
+			return nil, fmt.Errorf("compressed JWE is not supported")
+		}
+		encryptedKey, err := b64url.DecodeString(recipient.EncryptedKey)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			cek, err := decryptJweKey(&header, encryptedKey, key)
+			if err != nil {
+				continue
+			}
+			if plaintext, err := decryptJweContent(&jwe, &header, cek); err == nil {
+				return plaintext, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no private key can decrypt the JWE")
+}
+
+func mergeJweHeaders(headers ...interface{}) jweHeader {
+	result := jweHeader{}
+	for _, item := range headers {
+		var header *jweHeader
+		switch item := item.(type) {
+		case jweHeader:
+			header = &item
+		case *jweHeader:
+			header = item
+		}
+		if header == nil {
+			continue
+		}
+		if len(header.Alg) > 0 {
+			result.Alg = header.Alg
+		}
+		if len(header.Enc) > 0 {
+			result.Enc = header.Enc
+		}
+		if len(header.Zip) > 0 {
+			result.Zip = header.Zip
+		}
+		if header.Epk != nil {
+			result.Epk = header.Epk
+		}
+		if len(header.Apu) > 0 {
+			result.Apu = header.Apu
+		}
+		if len(header.Apv) > 0 {
+			result.Apv = header.Apv
+		}
+	}
+	return result
+}
+
+// 解密 content encryption key
+func decryptJweKey(header *jweHeader, encryptedKey []byte, key crypto.PrivateKey) ([]byte, error) {
+	switch header.Alg {
+	case "RSA-OAEP", "RSA-OAEP-256":
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("not an RSA key")
+		}
+		if header.Alg == "RSA-OAEP" {
+			return rsa.DecryptOAEP(sha1.New(), nil, rsaKey, encryptedKey, nil)
+		}
+		return rsa.DecryptOAEP(sha256.New(), nil, rsaKey, encryptedKey, nil)
+	case "ECDH-ES+A128KW", "ECDH-ES+A192KW", "ECDH-ES+A256KW":
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok || header.Epk == nil {
+			return nil, fmt.Errorf("not an EC key")
+		}
+		privateKey, err := ecKey.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		ephemeral, err := header.Epk.publicKey(privateKey.Curve())
+		if err != nil {
+			return nil, err
+		}
+		shared, err := privateKey.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		apu, _ := b64url.DecodeString(header.Apu)
+		apv, _ := b64url.DecodeString(header.Apv)
+		keySize := map[string]int{"ECDH-ES+A128KW": 16, "ECDH-ES+A192KW": 24, "ECDH-ES+A256KW": 32}[header.Alg]
+		return aesKeyUnwrap(concatKDF(shared, header.Alg, apu, apv, keySize), encryptedKey)
+	}
+	return nil, fmt.Errorf("unsupported JWE key algorithm %q", header.Alg)
+}
+
+func decryptJweContent(jwe *jweJson, header *jweHeader, cek []byte) ([]byte, error) {
+	keySize := map[string]int{"A128GCM": 16, "A192GCM": 24, "A256GCM": 32}[header.Enc]
+	if keySize == 0 {
+		return nil, fmt.Errorf("unsupported JWE content encryption %q", header.Enc)
+	}
+	if len(cek) != keySize {
+		return nil, fmt.Errorf("invalid JWE content encryption key")
+	}
+	iv, err := b64url.DecodeString(jwe.Iv)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := b64url.DecodeString(jwe.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := b64url.DecodeString(jwe.Tag)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	aad := jwe.Protected
+	if len(jwe.Aad) > 0 {
+		aad += "." + jwe.Aad
+	}
+	return gcm.Open(nil, iv, append(ciphertext, tag...), []byte(aad))
+}
+
+func newEcJwk(curve elliptic.Curve, publicKey *ecdh.PublicKey) (*ecJwk, error) {
+	point := publicKey.Bytes()
+	size := (curve.Params().BitSize + 7) / 8
+	if len(point) != 1+2*size || point[0] != 4 {
+		return nil, fmt.Errorf("invalid EC public key")
+	}
+	return &ecJwk{
+		Kty: "EC",
+		Crv: curve.Params().Name,
+		X:   b64url.EncodeToString(point[1 : 1+size]),
+		Y:   b64url.EncodeToString(point[1+size:]),
+	}, nil
+}
+
+func (k *ecJwk) publicKey(curve ecdh.Curve) (*ecdh.PublicKey, error) {
+	names := map[string]ecdh.Curve{"P-256": ecdh.P256(), "P-384": ecdh.P384(), "P-521": ecdh.P521()}
+	if k.Kty != "EC" || names[k.Crv] != curve {
+		return nil, fmt.Errorf("epk does not match the private key")
+	}
+	x, err := b64url.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := b64url.DecodeString(k.Y)
+	if err != nil {
+		return nil, err
+	}
+	return curve.NewPublicKey(append(append([]byte{4}, x...), y...))
+}
+
+// RFC 7518 4.6.2 中的 Concat KDF
+func concatKDF(shared []byte, algorithm string, apu []byte, apv []byte, keySize int) []byte {
+	lengthPrefixed := func(data []byte) []byte {
+		return binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	}
+	otherInfo := append(lengthPrefixed([]byte(algorithm)), algorithm...)
+	otherInfo = append(append(otherInfo, lengthPrefixed(apu)...), apu...)
+	otherInfo = append(append(otherInfo, lengthPrefixed(apv)...), apv...)
+	otherInfo = binary.BigEndian.AppendUint32(otherInfo, uint32(keySize*8))
+
+	result := []byte{}
+	for counter := uint32(1); len(result) < keySize; counter++ {
+		h := sha256.New()
+		h.Write(binary.BigEndian.AppendUint32(nil, counter))
+		h.Write(shared)
+		h.Write(otherInfo)
+		result = h.Sum(result)
+	}
+	return result[:keySize]
+}
+
+// RFC 3394 AES key wrap
+var keyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+func aesKeyWrap(kek []byte, plaintext []byte) ([]byte, error) {
+	if len(plaintext)%8 != 0 || len(plaintext) < 16 {
+		return nil, fmt.Errorf("invalid key length %d to wrap", len(plaintext))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(plaintext) / 8
+	a := append([]byte{}, keyWrapIV...)
+	r := append([]byte{}, plaintext...)
+	buff := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 0; i < n; i++ {
+			copy(buff, a)
+			copy(buff[8:], r[i*8:i*8+8])
+			block.Encrypt(buff, buff)
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buff[:8])^t)
+			copy(r[i*8:], buff[8:])
+		}
+	}
+	return append(a, r...), nil
+}
+
+func aesKeyUnwrap(kek []byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext)%8 != 0 || len(ciphertext) < 24 {
+		return nil, fmt.Errorf("invalid wrapped key length %d", len(ciphertext))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(ciphertext)/8 - 1
+	a := append([]byte{}, ciphertext[:8]...)
+	r := append([]byte{}, ciphertext[8:]...)
+	buff := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n - 1; i >= 0; i-- {
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(buff, binary.BigEndian.Uint64(a)^t)
+			copy(buff[8:], r[i*8:i*8+8])
+			block.Decrypt(buff, buff)
+			copy(a, buff[:8])
+			copy(r[i*8:], buff[8:])
+		}
+	}
+	if !bytes.Equal(a, keyWrapIV) {
+		return nil, fmt.Errorf("failed to unwrap key")
+	}
+	return r, nil
+}
+
+// ==================== PKCS7 ====================
+// 只支持解密：ocicrypt 使用 RSA 加密 key，内容使用 AES-128-GCM 加密的 EnvelopedData
+// https://www.rfc-editor.org/rfc/rfc5652#section-6
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type pkcs7EnvelopedData struct {
+	Version              int
+	RecipientInfos       []pkcs7RecipientInfo `asn1:"set"`
+	EncryptedContentInfo pkcs7EncryptedContentInfo
+}
+
+type pkcs7RecipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  asn1.RawValue
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type pkcs7EncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"tag:0,optional"`
+}
+
+// RFC 5084 中 nonce 为 OCTET STRING，smallstep/pkcs7 使用 [4] 的 tag，因此不检查 tag
+type pkcs7GCMParameters struct {
+	Nonce  asn1.RawValue
+	ICVLen int `asn1:"optional,default:12"`
+}
+
+var (
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidAES128CBC     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES128GCM     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 6}
+	oidAES256CBC     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidAES256GCM     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+)
+
+// 使用任意一个 RSA 私钥解密 PKCS7 EnvelopedData
+func unwrapKeyPkcs7(data []byte, keys []crypto.PrivateKey) ([]byte, error) {
+	var info pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid PKCS7: %w", err)
+	}
+	if !info.ContentType.Equal(oidEnvelopedData) {
+		return nil, fmt.Errorf("PKCS7 content type %s is not enveloped data", info.ContentType)
+	}
+	var enveloped pkcs7EnvelopedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &enveloped); err != nil {
+		return nil, fmt.Errorf("invalid PKCS7 enveloped data: %w", err)
+	}
+
+	for _, recipient := range enveloped.RecipientInfos {
+		for _, key := range keys {
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				continue
+			}
+			contentKey, err := rsa.DecryptPKCS1v15(nil, rsaKey, recipient.EncryptedKey)
+			if err != nil {
+				continue
+			}
+			if plaintext, err := decryptPkcs7Content(&enveloped.EncryptedContentInfo, contentKey); err == nil {
+				return plaintext, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no private key can decrypt the PKCS7 data")
+}
+
+func decryptPkcs7Content(info *pkcs7EncryptedContentInfo, key []byte) ([]byte, error) {
+	content := info.EncryptedContent.Bytes
+	if info.EncryptedContent.IsCompound {
+		// constructed 编码时由多个 OCTET STRING 组成
+		content = []byte{}
+		rest := info.EncryptedContent.Bytes
+		for len(rest) > 0 {
+			var part []byte
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &part); err != nil {
+				return nil, err
+			}
+			content = append(content, part...)
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithm := info.ContentEncryptionAlgorithm
+	switch {
+	case algorithm.Algorithm.Equal(oidAES128GCM) || algorithm.Algorithm.Equal(oidAES256GCM):
+		var params pkcs7GCMParameters
+		if _, err = asn1.Unmarshal(algorithm.Parameters.Bytes, &params); err != nil {
+			if _, err = asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+				return nil, fmt.Errorf("invalid AES-GCM parameters: %w", err)
+			}
+		}
+		gcm, err := cipher.NewGCMWithNonceSize(block, len(params.Nonce.Bytes))
+		if err != nil {
+			return nil, err
+		}
+		return gcm.Open(nil, params.Nonce.Bytes, content, nil)
+	case algorithm.Algorithm.Equal(oidAES128CBC) || algorithm.Algorithm.Equal(oidAES256CBC):
+		var iv []byte
+		if _, err = asn1.Unmarshal(algorithm.Parameters.FullBytes, &iv); err != nil {
+			return nil, fmt.Errorf("invalid AES-CBC parameters: %w", err)
+		}
+		if len(iv) != aes.BlockSize || len(content) == 0 || len(content)%aes.BlockSize != 0 {
+			return nil, fmt.Errorf("invalid AES-CBC content")
+		}
+		plaintext := make([]byte, len(content))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, content)
+		padding := int(plaintext[len(plaintext)-1])
+		if padding == 0 || padding > aes.BlockSize || padding > len(plaintext) {
+			return nil, fmt.Errorf("invalid padding")
+		}
+		// PKCS7 padding 的每个字节都等于 padding 的长度
+		if !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+			return nil, fmt.Errorf("invalid padding")
+		}
+		return plaintext[:len(plaintext)-padding], nil
+	}
+	return nil, fmt.Errorf("unsupported PKCS7 content encryption %s", algorithm.Algorithm)
+}
+
+// ==================== 密钥 ====================
+
+// 读取加密 layer 的公钥：PKIX 或 PKCS1 格式的 RSA、EC 公钥，或 x509 证书；可以加上 jwe: 前缀
+func loadEncryptionKeys(recipients []string) ([]crypto.PublicKey, error) {
+	keys := []crypto.PublicKey{}
+	for _, recipient := range recipients {
+		filename := recipient
+		if scheme, name, found := strings.Cut(recipient, ":"); found && !strings.Contains(scheme, "/") {
+			if scheme != "jwe" {
+				return nil, fmt.Errorf("unsupported encryption recipient %q, only jwe:<public key file> is supported", recipient)
+			}
+			filename = name
+		}
+		block, err := readPemBlock(filename)
+		if err != nil {
+			return nil, err
+		}
+		var key crypto.PublicKey
+		switch block.Type {
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("%s: unsupported public key type %T", filename, key)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// 读取解密 layer 的私钥：PKCS1、SEC1 或 PKCS8 格式的 RSA、EC 私钥
+func loadDecryptionKeys(filenames []string) ([]crypto.PrivateKey, error) {
+	keys := []crypto.PrivateKey{}
+	for _, filename := range filenames {
+		block, err := readPemBlock(filename)
+		if err != nil {
+			return nil, err
+		}
+		var key crypto.PrivateKey
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,292 @@
+package utils_test
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func decodeHex(t *testing.T, text string) []byte {
+	content, err := hex.DecodeString(strings.ReplaceAll(text, " ", ""))
+	assert.NoError(t, err)
+	return content
+}
+
+// RFC 3394 4.1 - 4.6
+func Test_AesKeyWrap(t *testing.T) {
+	cases := []struct {
+		kek        string
+		key        string
+		ciphertext string
+	}{
+		{
+			"000102030405060708090A0B0C0D0E0F",
+			"00112233445566778899AABBCCDDEEFF",
+			"1FA68B0A8112B447 AEF34BD8FB5A7B82 9D3E862371D2CFE5",
+		},
+		{
+			"000102030405060708090A0B0C0D0E0F1011121314151617",
+			"00112233445566778899AABBCCDDEEFF",
+			"96778B25AE6CA435 F92B5B97C050AED2 468AB8A17AD84E5D",
+		},
+		{
+			"000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			"00112233445566778899AABBCCDDEEFF",
+			"64E8C3F9CE0F5BA2 63E9777905818A2A 93C8191E7D6E8AE7",
+		},
+		{
+			"000102030405060708090A0B0C0D0E0F1011121314151617",
+			"00112233445566778899AABBCCDDEEFF0001020304050607",
+			"031D33264E15D332 68F24EC260743EDC E1C6C7DDEE725A93 6BA814915C6762D2",
+		},
+		{
+			"000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			"00112233445566778899AABBCCDDEEFF0001020304050607",
+			"A8F9BC1612C68B3F F6E6F4FBE30E71E4 769C8B80A32CB895 8CD5D17D6B254DA1",
+		},
+		{
+			"000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			"00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F",
+			"28C9F404C4B810F4 CBCCB35CFB87F826 3F5786E2D80ED326 CBC7F0E71A99F43B FB988B9B7A02DD21",
+		},
+	}
+	for _, c := range cases {
+		kek := decodeHex(t, c.kek)
+		key := decodeHex(t, c.key)
+		ciphertext := decodeHex(t, c.ciphertext)
+
+		wrapped, err := utils.AesKeyWrap(kek, key)
+		assert.NoError(t, err)
+		assert.Equal(t, ciphertext, wrapped, c.ciphertext)
+		unwrapped, err := utils.AesKeyUnwrap(kek, ciphertext)
+		assert.NoError(t, err)
+		assert.Equal(t, key, unwrapped, c.ciphertext)
+
+		// 密文被修改或 KEK 不对时，完整性检查失败
+		ciphertext[len(ciphertext)-1] ^= 1
+		_, err = utils.AesKeyUnwrap(kek, ciphertext)
+		assert.Error(t, err)
+		kek[0] ^= 1
+		_, err = utils.AesKeyUnwrap(kek, wrapped)
+		assert.Error(t, err)
+	}
+
+	kek := decodeHex(t, "000102030405060708090A0B0C0D0E0F")
+	_, err := utils.AesKeyWrap(kek, make([]byte, 12))
+	assert.Error(t, err)
+	_, err = utils.AesKeyUnwrap(kek, make([]byte, 16))
+	assert.Error(t, err)
+}
+
+// RFC 7518 附录 C 中 ECDH-ES 的例子
+func Test_ConcatKDF(t *testing.T) {
+	b64 := func(text string) []byte {
+		content, err := base64.RawURLEncoding.DecodeString(text)
+		assert.NoError(t, err)
+		return content
+	}
+	alice, err := ecdh.P256().NewPublicKey(append(append([]byte{4},
+		b64("gI0GAILBdu7T53akrFmMyGcsF3n5dO7MmwNBHKW5SV0")...),
+		b64("SLW_xSffzlPWrHEVI30DHM_4egVwt3NQqeUD7nMFpps")...))
+	assert.NoError(t, err)
+	bob, err := ecdh.P256().NewPrivateKey(b64("VEmDZpDXXK8p8N0Cndsxs924q6nS1RXFASRl6BfUqdw"))
+	assert.NoError(t, err)
+	shared, err := bob.ECDH(alice)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{158, 86, 217, 29, 129, 113, 53, 211, 114, 131, 66, 131, 191, 132, 38, 156,
+		251, 49, 110, 163, 218, 128, 106, 72, 246, 218, 167, 121, 140, 254, 144, 196}, shared)
+
+	key := utils.ConcatKDF(shared, "A128GCM", []byte("Alice"), []byte("Bob"), 16)
+	assert.Equal(t, "VqqN6vgjbSBcIijNcacQGg", base64.RawURLEncoding.EncodeToString(key))
+	// 超过一次 hash 的长度
+	long := utils.ConcatKDF(shared, "A128GCM", []byte("Alice"), []byte("Bob"), 48)
+	assert.Len(t, long, 48)
+}
+
+func readAnnotations(t *testing.T, filename string) string {
+	content, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	return string(content)
+}
+
+// testdata/ocicrypt 中的 layer 由 ocicrypt（skopeo 使用的库）加密
+func Test_DecryptOcicryptLayer(t *testing.T) {
+	dir := t.TempDir()
+	expected, err := os.ReadFile("testdata/ocicrypt/layer.tar.gz")
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name string
+		key  string
+	}{
+		{"jwe-rsa", "rsa.pem"},
+		{"jwe-ec", "ec.pem"},
+		{"pkcs7", "rsa.pem"},
+	}
+	for _, c := range cases {
+		src := path.Join("testdata/ocicrypt", c.name+".enc")
+		annotations := readAnnotations(t, path.Join("testdata/ocicrypt", c.name+".json"))
+		dst := path.Join(dir, c.name)
+		assert.NoError(t, utils.DecryptLayerFile(src, dst, annotations, []string{path.Join("testdata/ocicrypt", c.key)}), c.name)
+		content, err := os.ReadFile(dst)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, content, c.name)
+	}
+
+	// 私钥不匹配
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	other := writePem(t, path.Join(dir, "other.pem"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(otherKey), nil)
+	for _, name := range []string{"jwe-rsa", "pkcs7"} {
+		annotations := readAnnotations(t, path.Join("testdata/ocicrypt", name+".json"))
+		err := utils.DecryptLayerFile(path.Join("testdata/ocicrypt", name+".enc"), path.Join(dir, "out"), annotations, []string{other})
+		assert.Error(t, err, name)
+	}
+
+	// 加密的 layer 被修改时 HMAC 检查失败
+	content, err := os.ReadFile("testdata/ocicrypt/jwe-ec.enc")
+	assert.NoError(t, err)
+	content[len(content)/2] ^= 1
+	tampered := path.Join(dir, "tampered.enc")
+	assert.NoError(t, os.WriteFile(tampered, content, 0644))
+	err = utils.DecryptLayerFile(tampered, path.Join(dir, "out"), readAnnotations(t, "testdata/ocicrypt/jwe-ec.json"), []string{"testdata/ocicrypt/ec.pem"})
+	assert.ErrorContains(t, err, "HMAC")
+}
+
+func Test_EncryptLayerFile(t *testing.T) {
+	dir := t.TempDir()
+	src := "testdata/ocicrypt/layer.tar.gz"
+	expected, err := os.ReadFile(src)
+	assert.NoError(t, err)
+
+	encrypted := path.Join(dir, "layer.enc")
+	annotations, err := utils.EncryptLayerFile(src, encrypted, []string{"testdata/ocicrypt/rsa.pub", "jwe:testdata/ocicrypt/ec.pub"})
+	assert.NoError(t, err)
+	content, err := json.Marshal(annotations)
+	assert.NoError(t, err)
+
+	// 每个接收者都可以解密
+	for _, key := range []string{"rsa.pem", "ec.pem"} {
+		dst := path.Join(dir, key+".out")
+		assert.NoError(t, utils.DecryptLayerFile(encrypted, dst, string(content), []string{path.Join("testdata/ocicrypt", key)}), key)
+		decrypted, err := os.ReadFile(dst)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, decrypted, key)
+	}
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber int
+}
+
+type pkcs7Recipient struct {
+	Version                int
+	IssuerAndSerialNumber  pkcs7IssuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type pkcs7Content struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0"`
+}
+
+type pkcs7Enveloped struct {
+	Version              int
+	RecipientInfos       []pkcs7Recipient `asn1:"set"`
+	EncryptedContentInfo pkcs7Content
+}
+
+type pkcs7Info struct {
+	ContentType asn1.ObjectIdentifier
+	Content     pkcs7Enveloped `asn1:"explicit,tag:0"`
+}
+
+// 生成内容使用 AES-CBC 加密的 EnvelopedData，plaintext 需要已经补齐到 block 的整数倍
+func buildPkcs7Cbc(t *testing.T, publicKey *rsa.PublicKey, key []byte, plaintext []byte) []byte {
+	oids := map[int]asn1.ObjectIdentifier{
+		16: {2, 16, 840, 1, 101, 3, 4, 1, 2},
+		32: {2, 16, 840, 1, 101, 3, 4, 1, 42},
+	}
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, key)
+	assert.NoError(t, err)
+	iv := make([]byte, aes.BlockSize)
+	_, err = rand.Read(iv)
+	assert.NoError(t, err)
+	params, err := asn1.Marshal(iv)
+	assert.NoError(t, err)
+	block, err := aes.NewCipher(key)
+	assert.NoError(t, err)
+	content := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(content, plaintext)
+
+	data, err := asn1.Marshal(pkcs7Info{
+		ContentType: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3},
+		Content: pkcs7Enveloped{
+			RecipientInfos: []pkcs7Recipient{{
+				IssuerAndSerialNumber:  pkcs7IssuerAndSerial{Issuer: asn1.RawValue{FullBytes: []byte{0x30, 0}}, SerialNumber: 1},
+				KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}},
+				EncryptedKey:           encryptedKey,
+			}},
+			EncryptedContentInfo: pkcs7Content{
+				ContentType:                asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1},
+				ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oids[len(key)], Parameters: asn1.RawValue{FullBytes: params}},
+				EncryptedContent:           content,
+			},
+		},
+	})
+	assert.NoError(t, err)
+	return data
+}
+
+func Test_UnwrapKeyPkcs7Cbc(t *testing.T) {
+	content, err := os.ReadFile("testdata/ocicrypt/rsa.pem")
+	assert.NoError(t, err)
+	block, _ := pem.Decode(content)
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	assert.NoError(t, err)
+
+	message := []byte(`{"symkey":"key"}`)
+	cases := []struct {
+		keySize   int
+		plaintext []byte
+		expected  []byte
+	}{
+		{16, append([]byte("0123456789"), 6, 6, 6, 6, 6, 6), []byte("0123456789")},
+		{32, append(append([]byte{}, message...), []byte(strings.Repeat("\x10", 16))...), message},
+		{32, append([]byte("0123456789abcde"), 1), []byte("0123456789abcde")},
+		// 只有最后一个字节是正确的 padding
+		{32, append([]byte("0123456789"), 1, 2, 3, 4, 5, 6), nil},
+		{32, append([]byte("0123456789"), 6, 6, 6, 6, 0, 6), nil},
+		{16, append([]byte("0123456789abcde"), 0), nil},
+		{16, append([]byte("0123456789abcde"), 17), nil},
+	}
+	for _, c := range cases {
+		data := buildPkcs7Cbc(t, &privateKey.PublicKey, make([]byte, c.keySize), c.plaintext)
+		plaintext, err := utils.UnwrapKeyPkcs7(data, "testdata/ocicrypt/rsa.pem")
+		if c.expected == nil {
+			assert.Error(t, err, "%q", c.plaintext)
+			continue
+		}
+		assert.NoError(t, err, "%q", c.plaintext)
+		assert.Equal(t, c.expected, plaintext)
+	}
+}
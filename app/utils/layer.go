@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 生成 layer 时文件的属主
+type layerOwner struct {
+	uid int
+	gid int
+}
+
+// 解析 <uid>:<gid> 格式的属主，只指定 uid 时 gid 与 uid 相同
+func parseLayerOwner(value string) (owner layerOwner, err error) {
+	if len(value) == 0 {
+		return
+	}
+	parts := strings.SplitN(value, ":", 2)
+	if owner.uid, err = strconv.Atoi(parts[0]); err != nil {
+		return owner, fmt.Errorf("invalid owner %q, expected <uid>:<gid>", value)
+	}
+	owner.gid = owner.uid
+	if len(parts) == 2 {
+		if owner.gid, err = strconv.Atoi(parts[1]); err != nil {
+			return owner, fmt.Errorf("invalid owner %q, expected <uid>:<gid>", value)
+		}
+	}
+	return
+}
+
+// 生成 layer 时使用的修改时间，可通过 SOURCE_DATE_EPOCH 指定，默认为 1970-01-01
+func layerModTime() time.Time {
+	epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64)
+	if err != nil {
+		epoch = 0
+	}
+	return time.Unix(epoch, 0).UTC()
+}
+
+// 将目录打包为 layer，相同的目录内容总是得到相同的 tar 包：
+// 文件按名字排序，统一修改时间和属主，不记录用户名和访问时间
+func writeDirLayer(w io.Writer, dir string, owner layerOwner, modTime time.Time) error {
+	tarWriter := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(filename string, entry fs.DirEntry, err error) error {
+		if err != nil || filename == dir {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(dir, filename)
+		header := &tar.Header{
+			Name:    filepath.ToSlash(name),
+			Mode:    int64(info.Mode().Perm()),
+			Uid:     owner.uid,
+			Gid:     owner.gid,
+			ModTime: modTime,
+			Format:  tar.FormatPAX,
+		}
+		if info.Mode()&fs.ModeSetuid != 0 {
+			header.Mode |= 04000
+		}
+		if info.Mode()&fs.ModeSetgid != 0 {
+			header.Mode |= 02000
+		}
+		if info.Mode()&fs.ModeSticky != 0 {
+			header.Mode |= 01000
+		}
+
+		switch {
+		case info.IsDir():
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+		case info.Mode()&fs.ModeSymlink != 0:
+			header.Typeflag = tar.TypeSymlink
+			if header.Linkname, err = os.Readlink(filename); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			header.Typeflag = tar.TypeReg
+			header.Size = info.Size()
+		default:
+			return fmt.Errorf("%s: unsupported file type %s", filename, info.Mode().Type())
+		}
+
+		if err = tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		fp, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		_, err = io.CopyN(tarWriter, fp, header.Size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
+
+// 计算 layer 解压后的 digest，即 config 中的 diff_id
+func computeDiffID(fsys fs.FS, filename string) (string, error) {
+	fp, err := fsys.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	reader, err := decompressStream(fp)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, reader); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
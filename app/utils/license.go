@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// SPDX 许可证列表中常用的 ID，不区分大小写：https://spdx.org/licenses/
+// 软件包中的许可证只有由这些 ID 组成的表达式才直接写入 SBOM，其他的（如 "BSD License"、"GPLv2+"）作为自由文本处理
+var spdxLicenseIDs = []string{
+	"0BSD", "AFL-2.1", "AFL-3.0", "AGPL-3.0", "AGPL-3.0-only", "AGPL-3.0-or-later", "Apache-1.0", "Apache-1.1", "Apache-2.0",
+	"APSL-2.0", "Artistic-1.0", "Artistic-1.0-Perl", "Artistic-2.0", "Beerware", "BlueOak-1.0.0", "BSD-1-Clause", "BSD-2-Clause",
+	"BSD-2-Clause-Patent", "BSD-3-Clause", "BSD-3-Clause-Clear", "BSD-4-Clause", "BSD-Source-Code", "BSL-1.0", "bzip2-1.0.6",
+	"CC-BY-3.0", "CC-BY-4.0", "CC-BY-SA-3.0", "CC-BY-SA-4.0", "CC0-1.0", "CDDL-1.0", "CDDL-1.1", "CPL-1.0", "curl", "ECL-2.0",
+	"EFL-2.0", "EPL-1.0", "EPL-2.0", "EUPL-1.1", "EUPL-1.2", "FSFAP", "FSFUL", "FSFULLR", "FTL", "GFDL-1.1", "GFDL-1.1-only",
+	"GFDL-1.1-or-later", "GFDL-1.2", "GFDL-1.2-only", "GFDL-1.2-or-later", "GFDL-1.3", "GFDL-1.3-only", "GFDL-1.3-or-later",
+	"GPL-1.0", "GPL-1.0-only", "GPL-1.0-or-later", "GPL-2.0", "GPL-2.0-only", "GPL-2.0-or-later", "GPL-3.0", "GPL-3.0-only",
+	"GPL-3.0-or-later", "HPND", "IJG", "ImageMagick", "IPA", "ISC", "LGPL-2.0", "LGPL-2.0-only", "LGPL-2.0-or-later",
+	"LGPL-2.1", "LGPL-2.1-only", "LGPL-2.1-or-later", "LGPL-3.0", "LGPL-3.0-only", "LGPL-3.0-or-later", "Libpng",
+	"libpng-2.0", "libtiff", "LPPL-1.3c", "MirOS", "MIT", "MIT-0", "MIT-CMU", "MPL-1.0", "MPL-1.1", "MPL-2.0",
+	"MPL-2.0-no-copyleft-exception", "MS-PL", "MS-RL", "NCSA", "NTP", "ODbL-1.0", "OFL-1.1", "OLDAP-2.8", "OpenSSL",
+	"OSL-3.0", "PHP-3.0", "PHP-3.01", "PostgreSQL", "PSF-2.0", "Python-2.0", "Python-2.0.1", "Ruby", "Sendmail", "SGI-B-2.0",
+	"Sleepycat", "SMLNJ", "TCL", "Unicode-3.0", "Unicode-DFS-2015", "Unicode-DFS-2016", "Unlicense", "UPL-1.0", "Vim",
+	"W3C", "WTFPL", "X11", "XFree86-1.1", "Zlib", "zlib-acknowledgement", "ZPL-2.0", "ZPL-2.1",
+}
+
+var spdxExceptionIDs = []string{
+	"Autoconf-exception-2.0", "Autoconf-exception-3.0", "Bison-exception-2.2", "Classpath-exception-2.0", "Font-exception-2.0",
+	"GCC-exception-2.0", "GCC-exception-3.1", "GPL-3.0-linking-exception", "LGPL-3.0-linking-exception", "Libtool-exception",
+	"Linux-syscall-note", "LLVM-exception", "OpenJDK-assembly-exception-1.0", "openvpn-openssl-exception",
+	"Qt-GPL-exception-1.0", "Qt-LGPL-exception-1.1", "Universal-FOSS-exception-1.0", "WxWindows-exception-3.1",
+}
+
+var spdxLicenseTokenPattern = regexp.MustCompile(`\(|\)|[^\s()]+`)
+
+// 检查许可证是否为只包含已知 ID 的 SPDX 表达式，返回规范的写法：
+// <表达式> := <项> {(AND | OR) <项>}，<项> := (<表达式>) | <ID>[+] [WITH <例外>]
+func normalizeSpdxLicense(license string) (string, bool) {
+	tokens := spdxLicenseTokenPattern.FindAllString(license, -1)
+	if len(tokens) == 0 {
+		return "", false
+	}
+	lookup := func(ids []string, token string) (string, bool) {
+		for _, id := range ids {
+			if strings.EqualFold(id, token) {
+				return id, true
+			}
+		}
+		return "", false
+	}
+
+	position := 0
+	var expression func(depth int) (string, bool)
+	term := func(depth int) (string, bool) {
+		if position >= len(tokens) {
+			return "", false
+		}
+		token := tokens[position]
+		position++
+		if token == "(" {
+			inner, ok := expression(depth + 1)
+			if !ok || position >= len(tokens) || tokens[position] != ")" {
+				return "", false
+			}
+			position++
+			return "(" + inner + ")", true
+		}
+		id, ok := lookup(spdxLicenseIDs, strings.TrimSuffix(token, "+"))
+		if !ok {
+			return "", false
+		}
+		if strings.HasSuffix(token, "+") {
+			id += "+"
+		}
+		if position < len(tokens) && strings.EqualFold(tokens[position], "WITH") {
+			if position+1 >= len(tokens) {
+				return "", false
+			}
+			exception, ok := lookup(spdxExceptionIDs, tokens[position+1])
+			if !ok {
+				return "", false
+			}
+			position += 2
+			id += " WITH " + exception
+		}
+		return id, true
+	}
+	expression = func(depth int) (string, bool) {
+		if depth > 16 {
+			return "", false
+		}
+		result, ok := term(depth)
+		for ok && position < len(tokens) && (strings.EqualFold(tokens[position], "AND") || strings.EqualFold(tokens[position], "OR")) {
+			operator := strings.ToUpper(tokens[position])
+			position++
+			var next string
+			if next, ok = term(depth); ok {
+				result += " " + operator + " " + next
+			}
+		}
+		return result, ok
+	}
+
+	result, ok := expression(0)
+	if !ok || position != len(tokens) {
+		return "", false
+	}
+	return result, true
+}
+
+// 自由文本的许可证在 SPDX 中使用 LicenseRef-<名称>，同一个文本使用同一个 ID
+type spdxLicenseRefs struct {
+	ids   map[string]string // 许可证文本 -> LicenseRef
+	infos []spdxExtractedLicense
+}
+
+var spdxLicenseRefInvalidChars = regexp.MustCompile(`[^A-Za-z0-9.]+`)
+
+func (r *spdxLicenseRefs) declared(license string) string {
+	if len(strings.TrimSpace(license)) == 0 {
+		return "NOASSERTION"
+	}
+	if expression, ok := normalizeSpdxLicense(license); ok {
+		return expression
+	}
+	if id, exist := r.ids[license]; exist {
+		return id
+	}
+
+	name := strings.Trim(spdxLicenseRefInvalidChars.ReplaceAllString(license, "-"), "-")
+	if len(name) > 64 {
+		name = strings.TrimRight(name[:64], "-")
+	}
+	if len(name) == 0 {
+		name = "unknown"
+	}
+	id := "LicenseRef-" + name
+	for idx := 2; r.used(id); idx++ {
+		id = fmt.Sprintf("LicenseRef-%s-%d", name, idx)
+	}
+	if r.ids == nil {
+		r.ids = map[string]string{}
+	}
+	r.ids[license] = id
+	r.infos = append(r.infos, spdxExtractedLicense{LicenseId: id, ExtractedText: license, Name: strings.TrimSpace(license)})
+	return id
+}
+
+func (r *spdxLicenseRefs) used(id string) bool {
+	for _, item := range r.infos {
+		if strings.EqualFold(item.LicenseId, id) {
+			return true
+		}
+	}
+	return false
+}
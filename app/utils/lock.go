@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// lockfile 记录每个镜像在 lock 时的 manifest digest，pull 时按 digest 下载，得到完全相同的内容
+type imageLockfile struct {
+	Version int           `json:"version"`
+	Images  []lockedImage `json:"images"`
+}
+
+type lockedImage struct {
+	Reference string            `json:"reference"`           // 列表中的镜像名
+	Digest    string            `json:"digest"`              // tag 对应的 manifest 或 manifest list 的 digest
+	MediaType string            `json:"mediaType,omitempty"` // manifest 的 mediaType
+	Platforms map[string]string `json:"platforms,omitempty"` // manifest list 中每个 <os>/<arch>[/<variant>] 的 manifest digest
+}
+
+type LockOptions struct {
+	Lockfile string // lockfile 的路径
+	Check    bool   // 只检查 lockfile 中的 tag 是否已经指向其他的 digest
+}
+
+// 解析列表文件中的每个镜像，写入 lockfile；opts.Check 时检查 lockfile 中的镜像是否有变化
+func LockImages(image *Image, listFile string, opts LockOptions) error {
+	names := []string{}
+	if len(listFile) > 0 {
+		entries, err := readImageList(listFile)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			names = append(names, entry.Image)
+		}
+	}
+	if opts.Check {
+		return checkLockfile(image, names, opts.Lockfile)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no images to lock")
+	}
+
+	lockfile := imageLockfile{Version: 1, Images: []lockedImage{}}
+	seen := map[string]bool{}
+	for idx, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		target := image.WithReference(name)
+		locked, err := resolveImageLock(&target)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		locked.Reference = name
+		fmt.Printf("(%d/%d) %s %s\n", idx+1, len(names), name, locked.Digest)
+		lockfile.Images = append(lockfile.Images, locked)
+	}
+
+	content, err := json.MarshalIndent(lockfile, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(opts.Lockfile, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("%d images locked in %s\n", len(lockfile.Images), opts.Lockfile)
+	return nil
+}
+
+// 得到镜像当前的 manifest digest，manifest list 同时记录每个 platform 的 digest
+func resolveImageLock(image *Image) (locked lockedImage, err error) {
+	var content []byte
+	var fetchErr error
+	if err = Try(func() {
+		content, locked.MediaType, fetchErr = image.fetchManifestRaw("")
+	}); err != nil {
+		return
+	}
+	if err = fetchErr; err != nil {
+		return
+	}
+	var p fastjson.Parser
+	manifest, err := p.ParseBytes(content)
+	if err != nil {
+		return
+	}
+	locked.Digest = manifestDigest(content)
+	if !strings.HasPrefix(locked.MediaType, "application/vnd.") {
+		locked.MediaType = string(manifest.GetStringBytes("mediaType"))
+	}
+	for _, item := range manifest.GetArray("manifests") {
+		platform := fmt.Sprintf("%s/%s", item.GetStringBytes("platform", "os"), item.GetStringBytes("platform", "architecture"))
+		if variant := item.GetStringBytes("platform", "variant"); len(variant) > 0 {
+			platform = fmt.Sprintf("%s/%s", platform, variant)
+		}
+		if platform == "unknown/unknown" {
+			// buildx 的 attestation manifest
+			continue
+		}
+		if locked.Platforms == nil {
+			locked.Platforms = map[string]string{}
+		}
+		locked.Platforms[platform] = string(item.GetStringBytes("digest"))
+	}
+	return
+}
+
+func readLockfile(filename string) (*imageLockfile, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	lockfile := &imageLockfile{}
+	if err = json.Unmarshal(content, lockfile); err != nil {
+		return nil, fmt.Errorf("invalid lockfile %s: %w", filename, err)
+	}
+	if lockfile.Version != 1 {
+		return nil, fmt.Errorf("unsupported lockfile version %d in %s", lockfile.Version, filename)
+	}
+	return lockfile, nil
+}
+
+// 检查 lockfile 中的每个镜像，列出 tag 已经指向其他 digest 的镜像
+func checkLockfile(image *Image, names []string, filename string) error {
+	lockfile, err := readLockfile(filename)
+	if err != nil {
+		return err
+	}
+
+	drifted, missing, failed := 0, 0, 0
+	locked := map[string]bool{}
+	for _, item := range lockfile.Images {
+		locked[item.Reference] = true
+		target := image.WithReference(item.Reference)
+		current, err := resolveImageLock(&target)
+		if err != nil {
+			fmt.Printf("error    %s: %s\n", item.Reference, err)
+			failed++
+			continue
+		}
+		if current.Digest == item.Digest {
+			fmt.Printf("ok       %s %s\n", item.Reference, item.Digest)
+			continue
+		}
+		fmt.Printf("drifted  %s %s -> %s\n", item.Reference, item.Digest, current.Digest)
+		for _, platform := range sortedKeys(item.Platforms) {
+			if digest := current.Platforms[platform]; digest != item.Platforms[platform] {
+				if len(digest) == 0 {
+					digest = "(removed)"
+				}
+				fmt.Printf("           %s %s -> %s\n", platform, item.Platforms[platform], digest)
+			}
+		}
+		drifted++
+	}
+	for _, name := range names {
+		if !locked[name] {
+			fmt.Printf("missing  %s is not in %s\n", name, filename)
+			missing++
+		}
+	}
+
+	if drifted+missing+failed > 0 {
+		return fmt.Errorf("%s is out of date: %d drifted, %d missing, %d failed", filename, drifted, missing, failed)
+	}
+	fmt.Printf("all %d images in %s are up to date\n", len(lockfile.Images), filename)
+	return nil
+}
+
+// 在 lockfile 中查找镜像的 digest，镜像名按 registry、repository 和 tag 比较
+func findLockedDigest(filename string, image *Image) (string, error) {
+	lockfile, err := readLockfile(filename)
+	if err != nil {
+		return "", err
+	}
+	for _, item := range lockfile.Images {
+		var locked Image
+		locked.ParseImage(item.Reference)
+		if locked.Registry == image.Registry && locked.Repository == image.Repository && locked.Tag == image.Tag {
+			return item.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("%s/%s:%s is not in lockfile %s", image.Registry, image.Repository, image.Tag, filename)
+}
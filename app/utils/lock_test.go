@@ -0,0 +1,90 @@
+package utils_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+const (
+	nginxDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	appDigest   = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+func writeLockfile(t *testing.T, content string) string {
+	filename := path.Join(t.TempDir(), "images.lock")
+	assert.NoError(t, os.WriteFile(filename, []byte(content), 0644))
+	return filename
+}
+
+func Test_ReadLockfile(t *testing.T) {
+	filename := writeLockfile(t, `{
+  "version": 1,
+  "images": [
+    {
+      "reference": "nginx:1.25",
+      "digest": "`+nginxDigest+`",
+      "mediaType": "application/vnd.oci.image.index.v1+json",
+      "platforms": {"linux/amd64": "sha256:3333333333333333333333333333333333333333333333333333333333333333"}
+    },
+    {"reference": "registry.example.com/team/app:v1", "digest": "`+appDigest+`"}
+  ]
+}`)
+	references, digests, err := utils.ReadLockfile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nginx:1.25", "registry.example.com/team/app:v1"}, references)
+	assert.Equal(t, []string{nginxDigest, appDigest}, digests)
+
+	cases := []struct {
+		content string
+		message string
+	}{
+		{`{"version": 2, "images": []}`, "unsupported lockfile version 2"},
+		{`{"images": []}`, "unsupported lockfile version 0"},
+		{`{"version": 1, "images": {}}`, "invalid lockfile"},
+		{`nginx:1.25 ` + nginxDigest, "invalid lockfile"},
+	}
+	for _, c := range cases {
+		_, _, err := utils.ReadLockfile(writeLockfile(t, c.content))
+		assert.ErrorContains(t, err, c.message, c.content)
+	}
+	_, _, err = utils.ReadLockfile(path.Join(t.TempDir(), "missing.lock"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func Test_FindLockedDigest(t *testing.T) {
+	filename := writeLockfile(t, `{"version": 1, "images": [
+		{"reference": "nginx:1.25", "digest": "`+nginxDigest+`"},
+		{"reference": "registry.example.com/team/app:v1", "digest": "`+appDigest+`"}
+	]}`)
+
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		// 镜像名按 registry、repository 和 tag 比较，与写法无关
+		{"nginx:1.25", nginxDigest},
+		{"library/nginx:1.25", nginxDigest},
+		{"docker.io/library/nginx:1.25", nginxDigest},
+		{"registry.example.com/team/app:v1", appDigest},
+		{"nginx:1.26", ""},
+		{"nginx", ""},
+		{"mirror.example.com/library/nginx:1.25", ""},
+		{"registry.example.com/other/app:v1", ""},
+	}
+	for _, c := range cases {
+		digest, err := utils.FindLockedDigest(filename, c.name)
+		if len(c.expected) == 0 {
+			assert.ErrorContains(t, err, "is not in lockfile", c.name)
+			continue
+		}
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, c.expected, digest, c.name)
+	}
+
+	_, err := utils.FindLockedDigest(writeLockfile(t, `{"version": 3}`), "nginx:1.25")
+	assert.ErrorContains(t, err, "unsupported lockfile version 3")
+}
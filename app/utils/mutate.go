@@ -0,0 +1,222 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/valyala/fastjson"
+)
+
+type MutateOptions struct {
+	Entrypoint  []string // 为 nil 时不修改
+	Cmd         []string // 为 nil 时不修改
+	Env         []string // KEY=VALUE，替换同名的环境变量
+	Labels      map[string]string
+	User        string
+	WorkingDir  string
+	ExposePorts []string          // <port>[/<protocol>]，默认为 tcp
+	Annotations map[string]string // 写入 manifest 的 annotations
+}
+
+// 修改远程镜像的 config 和 annotations，只上传新的 config 和 manifest，不下载 layer
+// 对于包含多个 platform 的镜像，修改其中的每个镜像；target 为 source 时覆盖原有的 tag
+func MutateImage(source *Image, target *Image, opts MutateOptions) error {
+	fmt.Printf("Mutate Image %s/%s:%s\n", source.Registry, source.Repository, source.Tag)
+
+	var manifest *fastjson.Value
+	if err := Try(func() {
+		manifest = source.FetchManifest("")
+	}); err != nil {
+		return err
+	}
+	if manifest.GetInt("schemaVersion") != 2 {
+		return fmt.Errorf("Unsupported schema version %d", manifest.GetInt("schemaVersion"))
+	}
+
+	var a fastjson.Arena
+	mediaType := manifestMediaType(manifest, manifest)
+	if isIndexMediaType(mediaType) {
+		// 先修改每个 platform 的镜像，再生成新的 manifest list
+		children := a.NewArray()
+		count := 0
+		for _, item := range manifest.GetArray("manifests") {
+			if string(item.GetStringBytes("platform", "os")) == "unknown" {
+				// attestation 等引用原有 digest 的 manifest，修改后不再有效
+				fmt.Printf("skipping %s\n", item.GetStringBytes("digest"))
+				continue
+			}
+			var child *fastjson.Value
+			if err := Try(func() {
+				child = source.FetchManifest(string(item.GetStringBytes("digest")))
+			}); err != nil {
+				return err
+			}
+			childMediaType := manifestMediaType(item, child)
+			content, err := mutateManifest(source, target, child, &opts)
+			if err != nil {
+				return err
+			}
+			digest, err := uploadManifest(target, computeBytesDigest(content), childMediaType, content)
+			if err != nil {
+				return err
+			}
+			item.Set("digest", a.NewString(digest))
+			item.Set("size", a.NewNumberInt(len(content)))
+			children.SetArrayItem(count, item)
+			count++
+		}
+		manifest.Set("manifests", children)
+		setAnnotations(manifest, opts.Annotations)
+	} else {
+		content, err := mutateManifest(source, target, manifest, &opts)
+		if err != nil {
+			return err
+		}
+		manifest = parseJson(content)
+	}
+
+	digest, err := uploadManifest(target, target.Tag, mediaType, manifest.MarshalTo(nil))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Mutated %s/%s:%s@%s\n", target.Registry, target.Repository, target.Tag, digest)
+	return nil
+}
+
+// 修改一个镜像的 config，上传新的 config，返回新的 manifest
+func mutateManifest(source *Image, target *Image, manifest *fastjson.Value, opts *MutateOptions) ([]byte, error) {
+	configDigest := string(manifest.GetStringBytes("config", "digest"))
+	blob, err := openBlob(source, configDigest)
+	if err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return nil, err
+	}
+	var p fastjson.Parser
+	config, err := p.ParseBytes(content)
+	if err != nil {
+		return nil, err
+	}
+	mutateConfig(config, opts)
+
+	// 推送到其他 repository 时，需要 mount 原有的 layer
+	if target.Registry != source.Registry || target.Repository != source.Repository {
+		for _, layer := range manifest.GetArray("layers") {
+			layerMediaType := string(layer.GetStringBytes("mediaType"))
+			if isForeignMediaType(layerMediaType) {
+				continue
+			}
+			if err = copyBlob(target, source, string(layer.GetStringBytes("digest")), layerMediaType); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	configMediaType := string(manifest.GetStringBytes("config", "mediaType"))
+	digest, size, err := uploadBlobBytes(target, config.MarshalTo(nil), configMediaType)
+	if err != nil {
+		return nil, err
+	}
+	var a fastjson.Arena
+	manifest.Get("config").Set("digest", a.NewString(digest))
+	manifest.Get("config").Set("size", a.NewNumberInt(int(size)))
+	setAnnotations(manifest, opts.Annotations)
+	return manifest.MarshalTo(nil), nil
+}
+
+// 修改 config 中的运行参数
+func mutateConfig(config *fastjson.Value, opts *MutateOptions) {
+	var a fastjson.Arena
+	if config.Get("config") == nil || config.Get("config").Type() != fastjson.TypeObject {
+		config.Set("config", a.NewObject())
+	}
+	runConfig := config.Get("config")
+
+	newStringArray := func(items []string) *fastjson.Value {
+		array := a.NewArray()
+		for idx, item := range items {
+			array.SetArrayItem(idx, a.NewString(item))
+		}
+		return array
+	}
+	if opts.Entrypoint != nil {
+		runConfig.Set("Entrypoint", newStringArray(opts.Entrypoint))
+	}
+	if opts.Cmd != nil {
+		runConfig.Set("Cmd", newStringArray(opts.Cmd))
+	}
+	if len(opts.User) > 0 {
+		runConfig.Set("User", a.NewString(opts.User))
+	}
+	if len(opts.WorkingDir) > 0 {
+		runConfig.Set("WorkingDir", a.NewString(opts.WorkingDir))
+	}
+
+	if len(opts.Env) > 0 {
+		env := []string{}
+		for _, item := range runConfig.GetArray("Env") {
+			env = append(env, string(item.GetStringBytes()))
+		}
+		for _, item := range opts.Env {
+			key := strings.SplitN(item, "=", 2)[0]
+			replaced := false
+			for idx, old := range env {
+				if strings.SplitN(old, "=", 2)[0] == key {
+					env[idx] = item
+					replaced = true
+				}
+			}
+			if !replaced {
+				env = append(env, item)
+			}
+		}
+		runConfig.Set("Env", newStringArray(env))
+	}
+
+	if len(opts.Labels) > 0 {
+		if runConfig.Get("Labels") == nil || runConfig.Get("Labels").Type() != fastjson.TypeObject {
+			runConfig.Set("Labels", a.NewObject())
+		}
+		for _, key := range sortedKeys(opts.Labels) {
+			runConfig.Get("Labels").Set(key, a.NewString(opts.Labels[key]))
+		}
+	}
+
+	if len(opts.ExposePorts) > 0 {
+		if runConfig.Get("ExposedPorts") == nil || runConfig.Get("ExposedPorts").Type() != fastjson.TypeObject {
+			runConfig.Set("ExposedPorts", a.NewObject())
+		}
+		for _, port := range opts.ExposePorts {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			runConfig.Get("ExposedPorts").Set(port, a.NewObject())
+		}
+	}
+}
+
+func setAnnotations(manifest *fastjson.Value, annotations map[string]string) {
+	if len(annotations) == 0 {
+		return
+	}
+	var a fastjson.Arena
+	if manifest.Get("annotations") == nil {
+		manifest.Set("annotations", a.NewObject())
+	}
+	for _, key := range sortedKeys(annotations) {
+		manifest.Get("annotations").Set(key, a.NewString(annotations[key]))
+	}
+}
+
+// 按顺序写入 json，保证相同的修改得到相同的 digest
+func sortedKeys(items map[string]string) []string {
+	keys := lo.Keys(items)
+	sort.Strings(keys)
+	return keys
+}
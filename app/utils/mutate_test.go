@@ -0,0 +1,46 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_MutateConfig(t *testing.T) {
+	config := `{"os": "linux", "config": {"Env": ["PATH=/bin", "TZ=Asia/Shanghai"], "Cmd": ["sh"], "Labels": {"a": "1"}}}`
+	cases := []struct {
+		opts     utils.MutateOptions
+		expected string
+	}{
+		{utils.MutateOptions{}, config},
+		{
+			utils.MutateOptions{Entrypoint: []string{"/app", "--port", "80"}, Cmd: []string{}},
+			`{"os": "linux", "config": {"Env": ["PATH=/bin", "TZ=Asia/Shanghai"], "Cmd": [], "Labels": {"a": "1"}, "Entrypoint": ["/app", "--port", "80"]}}`,
+		},
+		{
+			// 替换同名的环境变量，其他的追加在后面
+			utils.MutateOptions{Env: []string{"TZ=UTC", "A=b=c"}, User: "1000", WorkingDir: "/app"},
+			`{"os": "linux", "config": {"Env": ["PATH=/bin", "TZ=UTC", "A=b=c"], "Cmd": ["sh"], "Labels": {"a": "1"}, "User": "1000", "WorkingDir": "/app"}}`,
+		},
+		{
+			utils.MutateOptions{Labels: map[string]string{"b": "2", "a": "x"}, ExposePorts: []string{"80", "53/udp"}},
+			`{"os": "linux", "config": {"Env": ["PATH=/bin", "TZ=Asia/Shanghai"], "Cmd": ["sh"], "Labels": {"a": "x", "b": "2"}, "ExposedPorts": {"80/tcp": {}, "53/udp": {}}}}`,
+		},
+	}
+	for _, c := range cases {
+		assert.JSONEq(t, c.expected, utils.MutateConfig(config, c.opts))
+	}
+
+	// 没有 config 字段的镜像
+	assert.JSONEq(t, `{"config": {"User": "app"}}`, utils.MutateConfig(`{}`, utils.MutateOptions{User: "app"}))
+}
+
+func Test_SetAnnotations(t *testing.T) {
+	manifest := `{"schemaVersion": 2}`
+	assert.JSONEq(t, manifest, utils.SetAnnotations(manifest, nil))
+	assert.JSONEq(t, `{"schemaVersion": 2, "annotations": {"a": "1", "b": "2"}}`,
+		utils.SetAnnotations(manifest, map[string]string{"b": "2", "a": "1"}))
+	assert.JSONEq(t, `{"schemaVersion": 2, "annotations": {"a": "2", "c": "3"}}`,
+		utils.SetAnnotations(`{"schemaVersion": 2, "annotations": {"a": "1", "c": "3"}}`, map[string]string{"a": "2"}))
+}
@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// https://github.com/opencontainers/image-spec/blob/main/image-layout.md
+func isOciLayout(fsys fs.FS) bool {
+	if !checkFsExist(fsys, "index.json") {
+		return false
+	}
+	// docker 25 之后的 docker save 同时包含 manifest.json 和 OCI layout
+	return checkFsExist(fsys, "oci-layout") || !checkFsExist(fsys, "manifest.json")
+}
+
+// 根据 digest 得到 blob 在 layout 中的文件路径
+func ociBlobPath(digest string) string {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 {
+		return path.Join("blobs", digest)
+	}
+	return path.Join("blobs", parts[0], parts[1])
+}
+
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == "application/vnd.oci.image.index.v1+json" ||
+		mediaType == "application/vnd.docker.distribution.manifest.list.v2+json"
+}
+
+// 不可分发的 layer 一般不会保存在 layout 中，上传时直接跳过
+func isForeignMediaType(mediaType string) bool {
+	return strings.Contains(mediaType, ".foreign.") || strings.Contains(mediaType, ".nondistributable.")
+}
+
+// 读取 descriptor 的 mediaType，若未指定则从内容中推断
+func manifestMediaType(desc *fastjson.Value, data *fastjson.Value) string {
+	mediaType := string(desc.GetStringBytes("mediaType"))
+	if len(mediaType) == 0 {
+		mediaType = string(data.GetStringBytes("mediaType"))
+	}
+	if len(mediaType) == 0 {
+		if data.Exists("manifests") {
+			mediaType = "application/vnd.oci.image.index.v1+json"
+		} else {
+			mediaType = "application/vnd.oci.image.manifest.v1+json"
+		}
+	}
+	return mediaType
+}
+
+// 上传 OCI image layout 目录，blob 保持原有的 mediaType 和 digest
+func pushOciLayout(image *Image, fsys fs.FS) (desc descriptor, content []byte, err error) {
+	if content, err = fs.ReadFile(fsys, "index.json"); err != nil {
+		return
+	}
+	indexJson := parseJson(content)
+	manifests := indexJson.GetArray("manifests")
+	if len(manifests) == 0 {
+		err = fmt.Errorf("no manifest found in index.json")
+		return
+	}
+
+	if err = checkLayoutPlatforms(manifests); err != nil {
+		return
+	}
+
+	for idx, item := range manifests {
+		fmt.Printf("Manifest (%d/%d) %s #####\n", idx+1, len(manifests), item.GetStringBytes("digest"))
+		if desc, content, err = pushOciManifest(image, fsys, item); err != nil {
+			return
+		}
+	}
+
+	if len(manifests) == 1 {
+		// 只有一个 manifest，直接将其作为 tag 的内容
+		return
+	}
+
+	// 多个 manifest，生成一个新的 index 指向它们
+	indexJson.Del("annotations")
+	for _, item := range manifests {
+		item.Del("annotations")
+	}
+	if !indexJson.Exists("mediaType") {
+		var a fastjson.Arena
+		indexJson.Set("mediaType", a.NewString("application/vnd.oci.image.index.v1+json"))
+	}
+	content = indexJson.MarshalTo(nil)
+	desc.MediaType = string(indexJson.GetStringBytes("mediaType"))
+	desc.Digest = computeBytesDigest(content)
+	desc.Size = int64(len(content))
+	return
+}
+
+// 多个 manifest 合并为一个 index 时，每个 manifest 都需要不同的 platform，否则是多个无关的镜像
+func checkLayoutPlatforms(manifests []*fastjson.Value) error {
+	if len(manifests) < 2 {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, item := range manifests {
+		platform := fmt.Sprintf("%s/%s", item.GetStringBytes("platform", "os"), item.GetStringBytes("platform", "architecture"))
+		if variant := item.GetStringBytes("platform", "variant"); len(variant) > 0 {
+			platform = fmt.Sprintf("%s/%s", platform, variant)
+		}
+		if !item.Exists("platform") || isIndexMediaType(string(item.GetStringBytes("mediaType"))) {
+			return fmt.Errorf("index.json contains %d manifests without platform, omit <image> to push each of them to its ref.name", len(manifests))
+		}
+		if seen[platform] {
+			return fmt.Errorf("index.json contains more than one manifest for platform %s", platform)
+		}
+		seen[platform] = true
+	}
+	return nil
+}
+
+// 上传一个 manifest 或 index 及其引用的所有 blob，并按 digest 上传 manifest 本身
+func pushOciManifest(image *Image, fsys fs.FS, item *fastjson.Value) (desc descriptor, content []byte, err error) {
+	desc.Digest = string(item.GetStringBytes("digest"))
+	if content, err = fs.ReadFile(fsys, ociBlobPath(desc.Digest)); err != nil {
+		return
+	}
+	if digest := computeBytesDigest(content); digest != desc.Digest {
+		err = fmt.Errorf("manifest %s does not match its digest %s", desc.Digest, digest)
+		return
+	}
+	manifestJson := parseJson(content)
+	desc.MediaType = manifestMediaType(item, manifestJson)
+	desc.Size = int64(len(content))
+
+	if isIndexMediaType(desc.MediaType) {
+		// 嵌套的 index，先上传其包含的 manifest
+		for _, child := range manifestJson.GetArray("manifests") {
+			if _, _, err = pushOciManifest(image, fsys, child); err != nil {
+				return
+			}
+		}
+	} else {
+		configDigest := string(manifestJson.GetStringBytes("config", "digest"))
+		configFilename := ociBlobPath(configDigest)
+		if _, _, err = uploadBlob(image, fsys, configFilename, string(manifestJson.GetStringBytes("config", "mediaType"))); err != nil {
+			return
+		}
+		if data, e := fs.ReadFile(fsys, configFilename); e == nil {
+			var p fastjson.Parser
+			if configJson, e := p.ParseBytes(data); e == nil {
+				desc.Platform.osName = string(configJson.GetStringBytes("os"))
+				desc.Platform.architecture = string(configJson.GetStringBytes("architecture"))
+				desc.Platform.variant = string(configJson.GetStringBytes("variant"))
+			}
+		}
+
+		layers := manifestJson.GetArray("layers")
+		for idx, layer := range layers {
+			layerDigest := string(layer.GetStringBytes("digest"))
+			layerMediaType := string(layer.GetStringBytes("mediaType"))
+			layerFilename := ociBlobPath(layerDigest)
+			fmt.Printf("Progress (%d/%d) #####\n", idx, len(layers))
+			if isForeignMediaType(layerMediaType) && !checkFsExist(fsys, layerFilename) {
+				fmt.Printf("skipping non-distributable layer %s\n", layerDigest)
+				continue
+			}
+			if _, _, err = uploadBlob(image, fsys, layerFilename, layerMediaType); err != nil {
+				return
+			}
+		}
+	}
+
+	if item.Exists("platform") {
+		desc.Platform.osName = string(item.GetStringBytes("platform", "os"))
+		desc.Platform.architecture = string(item.GetStringBytes("platform", "architecture"))
+		desc.Platform.variant = string(item.GetStringBytes("platform", "variant"))
+	}
+
+	_, err = uploadManifest(image, desc.Digest, desc.MediaType, content)
+	return
+}
+
+// 将 docker 的 layer mediaType 转换为对应的 OCI mediaType
+func ociLayerMediaType(mediaType string) string {
+	switch mediaType {
+	case "application/vnd.docker.image.rootfs.diff.tar.gzip":
+		return "application/vnd.oci.image.layer.v1.tar+gzip"
+	case "application/vnd.docker.image.rootfs.diff.tar":
+		return "application/vnd.oci.image.layer.v1.tar"
+	case "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":
+		return "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"
+	}
+	return mediaType
+}
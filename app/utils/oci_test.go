@@ -0,0 +1,38 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_CheckLayoutPlatforms(t *testing.T) {
+	cases := []struct {
+		index string
+		ok    bool
+	}{
+		{`{"manifests": [{"digest": "sha256:a"}]}`, true},
+		{`{"manifests": [
+			{"digest": "sha256:a", "platform": {"os": "linux", "architecture": "amd64"}},
+			{"digest": "sha256:b", "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}}
+		]}`, true},
+		// 无关的多个镜像不能合并到一个 tag
+		{`{"manifests": [
+			{"digest": "sha256:a", "annotations": {"org.opencontainers.image.ref.name": "a"}},
+			{"digest": "sha256:b", "annotations": {"org.opencontainers.image.ref.name": "b"}}
+		]}`, false},
+		{`{"manifests": [
+			{"digest": "sha256:a", "platform": {"os": "linux", "architecture": "amd64"}},
+			{"digest": "sha256:b", "platform": {"os": "linux", "architecture": "amd64"}}
+		]}`, false},
+		{`{"manifests": [
+			{"digest": "sha256:a", "platform": {"os": "linux", "architecture": "amd64"}},
+			{"digest": "sha256:b", "mediaType": "application/vnd.oci.image.index.v1+json", "platform": {"os": "linux", "architecture": "arm64"}}
+		]}`, false},
+	}
+	for _, c := range cases {
+		err := utils.CheckLayoutPlatforms(c.index)
+		assert.Equal(t, c.ok, err == nil, c.index)
+	}
+}
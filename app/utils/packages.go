@@ -0,0 +1,301 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"debug/buildinfo"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// 镜像中安装的一个软件包
+type sbomPackage struct {
+	Type     string // deb, apk, rpm, golang, npm, pypi
+	Name     string
+	Version  string
+	Arch     string
+	License  string
+	Location string // 记录该软件包的文件
+}
+
+// 镜像中的系统信息，来自 /etc/os-release
+type osRelease struct {
+	ID        string
+	VersionID string
+	Name      string
+}
+
+// 生成 package url：https://github.com/package-url/purl-spec
+func (p *sbomPackage) purl(release *osRelease) string {
+	name := url.PathEscape(p.Name)
+	if strings.HasPrefix(p.Name, "@") || strings.Contains(p.Name, "/") {
+		// npm 的 scope 和 go module 的路径作为 namespace
+		parts := strings.Split(p.Name, "/")
+		for idx, part := range parts {
+			parts[idx] = strings.Replace(url.PathEscape(part), "@", "%40", 1)
+		}
+		name = strings.Join(parts, "/")
+	}
+	purl := fmt.Sprintf("pkg:%s/%s", p.Type, name)
+	qualifiers := []string{}
+	if p.Type == "deb" || p.Type == "apk" || p.Type == "rpm" {
+		namespace := p.Type
+		if release != nil && len(release.ID) > 0 {
+			namespace = release.ID
+			if len(release.VersionID) > 0 {
+				qualifiers = append(qualifiers, "distro="+url.QueryEscape(release.ID+"-"+release.VersionID))
+			}
+		}
+		purl = fmt.Sprintf("pkg:%s/%s/%s", p.Type, url.PathEscape(namespace), name)
+	}
+	version := p.Version
+	if epoch, rest, found := strings.Cut(version, ":"); found && p.Type == "rpm" {
+		// rpm 的 epoch 作为 qualifier
+		version = rest
+		qualifiers = append(qualifiers, "epoch="+url.QueryEscape(epoch))
+	}
+	if len(version) > 0 {
+		purl += "@" + url.PathEscape(version)
+	}
+	if len(p.Arch) > 0 {
+		qualifiers = append([]string{"arch=" + url.QueryEscape(p.Arch)}, qualifiers...)
+	}
+	if len(qualifiers) > 0 {
+		purl += "?" + strings.Join(qualifiers, "&")
+	}
+	return purl
+}
+
+// 按 name: value 格式解析的段落，段落之间以空行分隔，以空格开头的行是上一个字段的延续
+func parseStanzas(content []byte) []map[string]string {
+	stanzas := []map[string]string{}
+	current := map[string]string{}
+	lastKey := ""
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 {
+			if len(current) > 0 {
+				stanzas = append(stanzas, current)
+				current = map[string]string{}
+			}
+			lastKey = ""
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lastKey) > 0 {
+			current[lastKey] += "\n" + strings.TrimSpace(line)
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		lastKey = strings.TrimSpace(parts[0])
+		if _, exist := current[lastKey]; !exist {
+			current[lastKey] = strings.TrimSpace(parts[1])
+		}
+	}
+	if len(current) > 0 {
+		stanzas = append(stanzas, current)
+	}
+	return stanzas
+}
+
+// 解析 /var/lib/dpkg/status 和 /var/lib/dpkg/status.d/*
+func parseDpkgStatus(content []byte, location string) []sbomPackage {
+	packages := []sbomPackage{}
+	for _, stanza := range parseStanzas(content) {
+		status := stanza["Status"]
+		if len(stanza["Package"]) == 0 || (len(status) > 0 && !strings.HasSuffix(status, " installed")) {
+			continue
+		}
+		packages = append(packages, sbomPackage{
+			Type:     "deb",
+			Name:     stanza["Package"],
+			Version:  stanza["Version"],
+			Arch:     stanza["Architecture"],
+			Location: location,
+		})
+	}
+	return packages
+}
+
+// 解析 /lib/apk/db/installed，每行为 <字母>:<值>
+func parseApkInstalled(content []byte, location string) []sbomPackage {
+	packages := []sbomPackage{}
+	var current *sbomPackage
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 {
+			if current != nil && len(current.Name) > 0 {
+				packages = append(packages, *current)
+			}
+			current = nil
+			continue
+		}
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+		if current == nil {
+			current = &sbomPackage{Type: "apk", Location: location}
+		}
+		switch line[0] {
+		case 'P':
+			current.Name = line[2:]
+		case 'V':
+			current.Version = line[2:]
+		case 'A':
+			current.Arch = line[2:]
+		case 'L':
+			current.License = line[2:]
+		}
+	}
+	if current != nil && len(current.Name) > 0 {
+		packages = append(packages, *current)
+	}
+	return packages
+}
+
+// 读取 Go 程序中的构建信息，包括 Go 版本、main module 和依赖
+func parseGoBinary(content []byte, location string) []sbomPackage {
+	info, err := buildinfo.Read(bytes.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	packages := []sbomPackage{{
+		Type:     "golang",
+		Name:     "stdlib",
+		Version:  info.GoVersion,
+		Location: location,
+	}}
+	if len(info.Main.Path) > 0 {
+		packages = append(packages, sbomPackage{Type: "golang", Name: info.Main.Path, Version: info.Main.Version, Location: location})
+	}
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		packages = append(packages, sbomPackage{Type: "golang", Name: dep.Path, Version: dep.Version, Location: location})
+	}
+	return packages
+}
+
+// 解析 package-lock.json，支持 lockfileVersion 1 的 dependencies 和 2、3 的 packages
+func parsePackageLock(content []byte, location string) []sbomPackage {
+	type lockDependency struct {
+		Version      string                    `json:"version"`
+		License      interface{}               `json:"license"`
+		Dependencies map[string]lockDependency `json:"dependencies"`
+	}
+	var lock struct {
+		Packages     map[string]lockDependency `json:"packages"`
+		Dependencies map[string]lockDependency `json:"dependencies"`
+	}
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return nil
+	}
+	license := func(value interface{}) string {
+		if text, ok := value.(string); ok {
+			return text
+		}
+		return ""
+	}
+
+	packages := []sbomPackage{}
+	if len(lock.Packages) > 0 {
+		for key, item := range lock.Packages {
+			index := strings.LastIndex(key, "node_modules/")
+			if index < 0 || len(item.Version) == 0 {
+				// 空字符串为项目本身
+				continue
+			}
+			packages = append(packages, sbomPackage{
+				Type:     "npm",
+				Name:     key[index+len("node_modules/"):],
+				Version:  item.Version,
+				License:  license(item.License),
+				Location: location,
+			})
+		}
+	} else {
+		var walk func(dependencies map[string]lockDependency)
+		walk = func(dependencies map[string]lockDependency) {
+			for name, item := range dependencies {
+				packages = append(packages, sbomPackage{Type: "npm", Name: name, Version: item.Version, Location: location})
+				walk(item.Dependencies)
+			}
+		}
+		walk(lock.Dependencies)
+	}
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].Name < packages[j].Name || packages[i].Name == packages[j].Name && packages[i].Version < packages[j].Version
+	})
+	return packages
+}
+
+// 解析 Python 的 *.dist-info/METADATA 和 *.egg-info/PKG-INFO
+func parsePythonMetadata(content []byte, location string) []sbomPackage {
+	// 只读取第一个空行之前的字段，之后是包的说明
+	if index := bytes.Index(content, []byte("\n\n")); index >= 0 {
+		content = content[:index]
+	}
+	stanzas := parseStanzas(content)
+	if len(stanzas) == 0 || len(stanzas[0]["Name"]) == 0 {
+		return nil
+	}
+	license := stanzas[0]["License-Expression"]
+	if len(license) == 0 && !strings.Contains(stanzas[0]["License"], "\n") {
+		license = stanzas[0]["License"]
+	}
+	return []sbomPackage{{
+		Type:     "pypi",
+		Name:     stanzas[0]["Name"],
+		Version:  stanzas[0]["Version"],
+		License:  license,
+		Location: location,
+	}}
+}
+
+func parseOsRelease(content []byte) *osRelease {
+	values := map[string]string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = strings.Trim(parts[1], `"'`)
+		}
+	}
+	return &osRelease{ID: values["ID"], VersionID: values["VERSION_ID"], Name: values["PRETTY_NAME"]}
+}
+
+// 根据文件路径选择解析方式，返回 nil 表示不是软件包数据库
+func packageParser(name string) func(content []byte, location string) []sbomPackage {
+	switch {
+	case name == "var/lib/dpkg/status" || path.Dir(name) == "var/lib/dpkg/status.d" && !strings.HasSuffix(name, ".md5sums"):
+		return parseDpkgStatus
+	case name == "lib/apk/db/installed":
+		return parseApkInstalled
+	case path.Base(name) == "package-lock.json" && !strings.Contains(name, "node_modules/"):
+		return parsePackageLock
+	case path.Base(name) == "METADATA" && strings.HasSuffix(path.Dir(name), ".dist-info"),
+		path.Base(name) == "PKG-INFO" && strings.HasSuffix(path.Dir(name), ".egg-info"):
+		return parsePythonMetadata
+	}
+	return nil
+}
+
+// rpm 数据库：Berkeley DB、sqlite 或 ndb 格式，由 parseRpmDatabase 解析
+func isRpmDatabase(name string) bool {
+	switch name {
+	case "var/lib/rpm/Packages", "var/lib/rpm/rpmdb.sqlite", "var/lib/rpm/Packages.db",
+		"usr/lib/sysimage/rpm/Packages", "usr/lib/sysimage/rpm/rpmdb.sqlite", "usr/lib/sysimage/rpm/Packages.db":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// 镜像的信任策略，参考 containers 的 policy.json
+// 按顺序匹配 rules，第一个匹配 repository 和操作的 rule 生效；没有匹配的 rule 时使用 default
+type imagePolicy struct {
+	Default string       `json:"default"` // allow 或 deny，默认为 deny
+	Rules   []policyRule `json:"rules"`
+}
+
+type policyRule struct {
+	Name          string   `json:"name"`
+	Repositories  []string `json:"repositories"`  // <registry>/<repository> 的模式，* 不匹配 /，** 匹配任意字符；为空时匹配所有
+	Operations    []string `json:"operations"`    // pull, push；为空时匹配所有
+	Effect        string   `json:"effect"`        // allow 或 deny，默认为 allow
+	RequireDigest bool     `json:"requireDigest"` // pull 时必须使用 @sha256:<hex> 格式的镜像
+	SignedBy      []string `json:"signedBy"`      // pull 时需要其中任意一个公钥的有效签名，相对路径基于策略文件所在目录
+	ProtectedTags []string `json:"protectedTags"` // 禁止 push 的 tag 模式
+
+	repositories  []*regexp.Regexp
+	protectedTags []*regexp.Regexp
+}
+
+// 读取并检查策略文件
+func loadPolicy(filename string) (*imagePolicy, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	policy := &imagePolicy{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(policy); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", filename, err)
+	}
+
+	if len(policy.Default) == 0 {
+		policy.Default = "deny"
+	}
+	if policy.Default != "allow" && policy.Default != "deny" {
+		return nil, fmt.Errorf("invalid policy file %s: default must be allow or deny", filename)
+	}
+	for idx := range policy.Rules {
+		rule := &policy.Rules[idx]
+		if len(rule.Name) == 0 {
+			rule.Name = fmt.Sprintf("rules[%d]", idx)
+		}
+		if len(rule.Effect) == 0 {
+			rule.Effect = "allow"
+		}
+		if rule.Effect != "allow" && rule.Effect != "deny" {
+			return nil, fmt.Errorf("invalid policy rule %q: effect must be allow or deny", rule.Name)
+		}
+		for _, operation := range rule.Operations {
+			if operation != "pull" && operation != "push" {
+				return nil, fmt.Errorf("invalid policy rule %q: unknown operation %q", rule.Name, operation)
+			}
+		}
+		for _, pattern := range rule.Repositories {
+			rule.repositories = append(rule.repositories, globToRegexp(pattern))
+		}
+		for _, pattern := range rule.ProtectedTags {
+			rule.protectedTags = append(rule.protectedTags, globToRegexp(pattern))
+		}
+		for i, keyFile := range rule.SignedBy {
+			if !filepath.IsAbs(keyFile) {
+				rule.SignedBy[i] = filepath.Join(filepath.Dir(filename), keyFile)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// 将 glob 模式转换为正则表达式：** 匹配任意字符，* 和 ? 不匹配 /
+func globToRegexp(pattern string) *regexp.Regexp {
+	var buff strings.Builder
+	buff.WriteString("^")
+	for idx := 0; idx < len(pattern); idx++ {
+		switch {
+		case strings.HasPrefix(pattern[idx:], "**"):
+			buff.WriteString(".*")
+			idx++
+		case pattern[idx] == '*':
+			buff.WriteString("[^/]*")
+		case pattern[idx] == '?':
+			buff.WriteString("[^/]")
+		default:
+			buff.WriteString(regexp.QuoteMeta(pattern[idx : idx+1]))
+		}
+	}
+	buff.WriteString("$")
+	return regexp.MustCompile(buff.String())
+}
+
+// 策略中使用的镜像名：<registry>/<repository>，docker hub 使用 docker.io
+func policyReference(image *Image) string {
+	registry := image.Registry
+	if registry == "registry-1.docker.io" {
+		registry = "docker.io"
+	}
+	return fmt.Sprintf("%s/%s", registry, image.Repository)
+}
+
+// 检查是否允许对镜像执行 pull 或 push，返回匹配的 rule，没有匹配的 rule 时返回 nil
+func (p *imagePolicy) check(image *Image, operation string) (*policyRule, error) {
+	reference := policyReference(image)
+	name := image.Reference()
+
+	for idx := range p.Rules {
+		rule := &p.Rules[idx]
+		if !rule.matches(reference, operation) {
+			continue
+		}
+		if rule.Effect == "deny" {
+			return nil, fmt.Errorf("%s of %s is denied by policy rule %q", operation, name, rule.Name)
+		}
+		if operation == "pull" && rule.RequireDigest && !strings.HasPrefix(image.Tag, "sha256:") {
+			return nil, fmt.Errorf("pull of %s is blocked by policy rule %q: a digest-pinned reference (@sha256:...) is required", name, rule.Name)
+		}
+		if operation == "push" {
+			for idx, pattern := range rule.protectedTags {
+				if pattern.MatchString(image.Tag) {
+					return nil, fmt.Errorf("push of %s is blocked by policy rule %q: tag matches protected tag %q", name, rule.Name, rule.ProtectedTags[idx])
+				}
+			}
+		}
+		return rule, nil
+	}
+
+	if p.Default != "allow" {
+		return nil, fmt.Errorf("%s of %s is denied by the policy default: no rule matches %s", operation, name, reference)
+	}
+	return nil, nil
+}
+
+func (r *policyRule) matches(reference string, operation string) bool {
+	if len(r.Operations) > 0 && !lo.Contains(r.Operations, operation) {
+		return false
+	}
+	if len(r.repositories) == 0 {
+		return true
+	}
+	for _, pattern := range r.repositories {
+		if pattern.MatchString(reference) {
+			return true
+		}
+	}
+	return false
+}
+
+// 读取策略文件并检查镜像，返回 pull 时需要验证的签名
+func checkPolicy(filename string, image *Image, operation string) ([]signatureRequirement, error) {
+	if len(filename) == 0 {
+		return nil, nil
+	}
+	policy, err := loadPolicy(filename)
+	if err != nil {
+		return nil, err
+	}
+	rule, err := policy.check(image, operation)
+	if err != nil {
+		return nil, err
+	}
+	if rule == nil || operation != "pull" || len(rule.SignedBy) == 0 {
+		return nil, nil
+	}
+	return []signatureRequirement{{source: fmt.Sprintf("policy rule %q", rule.Name), keys: rule.SignedBy}}, nil
+}
@@ -0,0 +1,108 @@
+package utils_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_GlobToRegexp(t *testing.T) {
+	cases := []struct {
+		pattern string
+		value   string
+		match   bool
+	}{
+		{"docker.io/library/*", "docker.io/library/nginx", true},
+		{"docker.io/library/*", "docker.io/library/a/b", false},
+		{"docker.io/**", "docker.io/library/a/b", true},
+		{"docker.io/**", "docker.io", false},
+		{"**/internal/*", "registry.example.com/team/internal/app", true},
+		{"registry.example.com/app?", "registry.example.com/app1", true},
+		{"registry.example.com/app?", "registry.example.com/app/", false},
+		{"registry.example.com/app?", "registry.example.com/app12", false},
+		// 正则表达式的特殊字符按原样匹配
+		{"registry.example.com:5000/a+b", "registry.example.com:5000/a+b", true},
+		{"registry.example.com/app", "registry-example.com/app", false},
+		{"registry.example.com/app", "registry.example.com/app2", false},
+		{"v*", "v1.2", true},
+		{"", "", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, utils.GlobToRegexp(c.pattern).MatchString(c.value), "%s %s", c.pattern, c.value)
+	}
+}
+
+func Test_CheckPolicy(t *testing.T) {
+	dir := t.TempDir()
+	filename := path.Join(dir, "policy.json")
+	assert.NoError(t, os.WriteFile(filename, []byte(`{
+		"default": "deny",
+		"rules": [
+			{"name": "no-hub", "repositories": ["docker.io/**"], "effect": "deny"},
+			{"name": "prod", "repositories": ["registry.example.com/prod/*"], "operations": ["pull"], "requireDigest": true, "signedBy": ["keys/prod.pub", "/etc/keys/backup.pub"]},
+			{"name": "prod-push", "repositories": ["registry.example.com/prod/*"], "operations": ["push"], "protectedTags": ["latest", "v*"]},
+			{"repositories": ["registry.example.com/dev/**"]}
+		]
+	}`), 0644))
+
+	digest := "@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	cases := []struct {
+		name      string
+		operation string
+		keys      []string
+		err       string
+	}{
+		{"nginx", "pull", nil, `denied by policy rule "no-hub"`},
+		{"docker.io/library/nginx:1", "push", nil, `denied by policy rule "no-hub"`},
+		{"registry.example.com/prod/app:1", "pull", nil, "digest-pinned reference"},
+		{"registry.example.com/prod/app" + digest, "pull", []string{path.Join(dir, "keys/prod.pub"), "/etc/keys/backup.pub"}, ""},
+		{"registry.example.com/prod/app:1.0", "push", []string{}, ""},
+		{"registry.example.com/prod/app:latest", "push", nil, `protected tag "latest"`},
+		{"registry.example.com/prod/app:v1", "push", nil, `protected tag "v*"`},
+		{"registry.example.com/dev/team/app:1", "pull", []string{}, ""},
+		{"registry.example.com/dev/team/app:latest", "push", []string{}, ""},
+		// 没有匹配的 rule 时使用 default
+		{"registry.example.com/prod/a/b:1", "pull", nil, "denied by the policy default"},
+		{"quay.io/app:1", "push", nil, "denied by the policy default"},
+	}
+	for _, c := range cases {
+		keys, err := utils.CheckPolicy(filename, c.name, c.operation)
+		if len(c.err) > 0 {
+			assert.ErrorContains(t, err, c.err, c.name)
+		} else {
+			assert.NoError(t, err, c.name)
+			assert.Equal(t, c.keys, keys, c.name)
+		}
+	}
+
+	// 没有策略文件时不检查
+	keys, err := utils.CheckPolicy("", "nginx", "pull")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	// default 为 allow
+	assert.NoError(t, os.WriteFile(filename, []byte(`{"default": "allow"}`), 0644))
+	_, err = utils.CheckPolicy(filename, "nginx", "push")
+	assert.NoError(t, err)
+}
+
+func Test_LoadPolicyErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, content := range []string{
+		`{"default": "maybe"}`,
+		`{"rules": [{"effect": "reject"}]}`,
+		`{"rules": [{"operations": ["delete"]}]}`,
+		`{"rules": [{"repository": ["docker.io/**"]}]}`,
+		`{"rules": `,
+	} {
+		filename := path.Join(dir, "policy.json")
+		assert.NoError(t, os.WriteFile(filename, []byte(content), 0644))
+		_, err := utils.CheckPolicy(filename, "registry.example.com/app:1", "pull")
+		assert.ErrorContains(t, err, "invalid policy", content)
+	}
+	_, err := utils.CheckPolicy(path.Join(dir, "missing.json"), "registry.example.com/app:1", "pull")
+	assert.Error(t, err)
+}
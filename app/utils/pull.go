@@ -3,6 +3,7 @@ package utils
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -20,25 +21,82 @@ import (
 	"github.com/valyala/fastjson"
 )
 
+type PullOptions struct {
+	Unpack string		// 将镜像的 layer 解压到该目录，得到镜像最终的文件系统
+	Rootless string		// 无 root 权限解压时记录属主的方式：xattr, sidecar
+	SubIDUser string	// 按 /etc/subuid 和 /etc/subgid 中该用户的范围映射属主
+	VerifyKey string	// 验证镜像签名的公钥，签名无效时不下载任何 layer
+	Policy string		// 镜像信任策略文件，在下载之前检查
+	DecryptionKeys []string	// 解密 +encrypted layer 的私钥文件
+	Lockfile string		// 按 lockfile 中记录的 digest 下载镜像，tag 被修改时仍得到相同的内容
+	OutputName string	// 输出的目录和 tar 文件名，默认为 <registry>---<repository>:<tag>-<arch>
+
+	layers *sharedLayers	// 批量下载时共享已下载的 layer
+}
+
 // https://docker-docs.uclv.cu/registry/spec/api/#pulling-an-image
-func PullImage(image *Image, dir string) error {
+func PullImage(image *Image, dir string, opts PullOptions) error {
 	fmt.Printf("Pull Image %s/%s:%s to %s\n", image.Registry, image.Repository, image.Tag, dir)
 
-	manifest := image.FetchManifest("")
+	// 按 digest 获取 manifest，下载的镜像仍然使用原来的 tag
+	manifestImage := image
+	if len(opts.Lockfile) > 0 {
+		digest, err := findLockedDigest(opts.Lockfile, image)
+		if err != nil {
+			return err
+		}
+		pinned := *image
+		pinned.Tag = digest
+		manifestImage = &pinned
+	}
+
+	requirements, err := checkPolicy(opts.Policy, manifestImage, "pull")
+	if err != nil {
+		return err
+	}
+	if len(opts.VerifyKey) > 0 {
+		requirements = append(requirements, signatureRequirement{source: "--verify-key", keys: []string{opts.VerifyKey}})
+	}
+
+	var content []byte
+	if len(requirements) > 0 {
+		// 使用已验证签名的 manifest，避免验证后 tag 被修改
+		if content, err = verifyImageSignature(manifestImage, requirements); err != nil {
+			return err
+		}
+	} else {
+		content, _, err = manifestImage.fetchManifestRaw("")
+		ThrowIfError(err)
+	}
+	if strings.HasPrefix(manifestImage.Tag, "sha256:") {
+		fmt.Printf("Digest: %s (verified)\n", manifestImage.Tag)
+	} else {
+		// 记录 tag 对应的 manifest 的 digest，可以使用 <image>@<digest> 再次下载相同的镜像
+		fmt.Printf("Digest: %s\n", manifestDigest(content))
+	}
+	manifest := parseJson(content)
 	schemaVersion := manifest.Get("schemaVersion").GetInt()
 	if schemaVersion == 1 {
-		return pullV1(image, manifest, dir)
+		return pullV1(image, manifest, dir, &opts)
 	} else if schemaVersion == 2 {
-		return pullV2(image, manifest, dir)
+		return pullV2(image, manifest, dir, &opts)
 	} else {
 		return fmt.Errorf("Unsupported schema version %d", schemaVersion)
 	}
 }
 
-// ==================== schema v1 ====================
-func pullV1(image *Image, manifest *fastjson.Value, dir string) error {
+// 下载的镜像保存的目录名，同时也是 tar 文件名
+func pullTargetFolder(image *Image, opts *PullOptions) string {
+	if len(opts.OutputName) > 0 {
+		return strings.TrimSuffix(opts.OutputName, ".tar")
+	}
 	targetFolder := fmt.Sprintf("%s/%s:%s-%s", image.Registry, image.Repository, image.Tag, image.platform.architecture)
-	targetFolder = strings.ReplaceAll(targetFolder, "/", "---")
+	return strings.ReplaceAll(targetFolder, "/", "---")
+}
+
+// ==================== schema v1 ====================
+func pullV1(image *Image, manifest *fastjson.Value, dir string, opts *PullOptions) error {
+	targetFolder := pullTargetFolder(image, opts)
 	targetPath := path.Join(dir, targetFolder)
 	err := ensureDir(targetPath)
 
@@ -78,6 +136,15 @@ func pullV1(image *Image, manifest *fastjson.Value, dir string) error {
 		ThrowIfError(err)
 	})
 
+	if len(opts.Unpack) > 0 {
+		// fsLayers 中第一个是最上层的 layer
+		layerFiles := []string{}
+		for index := len(fsLayers) - 1; index >= 0; index-- {
+			layerFiles = append(layerFiles, path.Join(targetPath, string(history[index].GetStringBytes("id")), "layer.tar"))
+		}
+		return unpackLayers(layerFiles, opts)
+	}
+
 	// 创建 repositories 文件
 	fp, err := os.OpenFile(path.Join(targetPath, "repositories"), os.O_CREATE|os.O_RDWR, 0644)
 	ThrowIfError(err)
@@ -94,40 +161,25 @@ func pullV1(image *Image, manifest *fastjson.Value, dir string) error {
 	err = tarFile.AddFS(fs)
 	ThrowIfError(err)
 
-	fmt.Printf("to load image file: docker load -i %s.tar", targetFolder)
+	fmt.Printf("to load image file: docker load -i %s.tar\n", targetFolder)
 	return tarFile.Close()
 }
 // ==================== schema v2 ====================
-func pullV2(image *Image, manifest *fastjson.Value, dir string) error {
-	if manifest.Exists("manifests") {
-		// 该Tag对应有多个platform的镜像
-		digest := ""
-		manifestList := manifest.GetArray("manifests")
-		info, exist := lo.Find(manifestList, func(item *fastjson.Value) bool {
-			if string(item.GetStringBytes("platform", "os")) == image.platform.osName && string(item.GetStringBytes("platform", "architecture")) == image.platform.architecture {
-				variant := string(item.GetStringBytes("platform", "variant"))
-				if len(image.platform.variant) == 0 || len(variant) == 0 {
-					return true
-				}
-				return image.platform.variant == variant
-			}
-			return false
-		})
-		if !exist {
-			return fmt.Errorf("Not found platform %s/%s", image.platform.osName, image.platform.architecture)
-		}
-
-		digest = string(info.GetStringBytes("digest"))
-		manifest = image.FetchManifest(digest)
+func pullV2(image *Image, manifest *fastjson.Value, dir string, opts *PullOptions) error {
+	if info, found := findPlatformManifest(image, manifest.GetArray("manifests")); found {
+		fmt.Printf("Platform %s/%s digest: %s\n", image.platform.osName, image.platform.architecture, info.GetStringBytes("digest"))
+	}
+	manifest, err := selectPlatformManifest(image, manifest)
+	if err != nil {
+		return err
 	}
 
 	digest := string(manifest.GetStringBytes("config", "digest"))
 
 	// 创建目录
-	targetFolder := fmt.Sprintf("%s/%s:%s-%s", image.Registry, image.Repository, image.Tag, image.platform.architecture)
-	targetFolder = strings.ReplaceAll(targetFolder, "/", "---")
+	targetFolder := pullTargetFolder(image, opts)
 	targetPath := path.Join(dir, targetFolder)
-	err := ensureDir(targetPath)
+	err = ensureDir(targetPath)
 
 	fmt.Println(targetPath, "v2")
 	ThrowIfError(err)
@@ -169,8 +221,23 @@ func pullV2(image *Image, manifest *fastjson.Value, dir string) error {
 	}]`, strings.Split(digest, ":")[1], image.Slug, image.Tag))
 
 	layers, err := manifest.Get("layers").Array()
+	// 有加密的 layer 时，在下载之前读取私钥
+	var decryptionKeys []crypto.PrivateKey
+	for _, item := range layers {
+		if !isEncryptedMediaType(string(item.GetStringBytes("mediaType"))) {
+			continue
+		}
+		if len(opts.DecryptionKeys) == 0 {
+			return fmt.Errorf("image %s/%s:%s has encrypted layers, use --decryption-key to decrypt them", image.Registry, image.Repository, image.Tag)
+		}
+		if decryptionKeys, err = loadDecryptionKeys(opts.DecryptionKeys); err != nil {
+			return err
+		}
+		break
+	}
 	parentId := ""
 	fakeLayerid := ""
+	layerFiles := []string{}
 
 	lo.ForEach(layers, func(item *fastjson.Value, index int) {
 		blobDigest := string(item.GetStringBytes("digest"))
@@ -209,8 +276,25 @@ func pullV2(image *Image, manifest *fastjson.Value, dir string) error {
 		// https://github.com/opencontainers/image-spec/blob/main/layer.md
 		// 检查 mediaType
 		mediaType := string(item.GetStringBytes("mediaType"))
+		encrypted := isEncryptedMediaType(mediaType)
+		mediaType = strings.TrimSuffix(mediaType, encryptedSuffix)
 
 		layerTarFile := path.Join(layerDir, "layer.tar")
+		layerFiles = append(layerFiles, layerTarFile)
+		if opts.layers != nil {
+			// 其他镜像已经下载过相同的 layer 时直接使用，同时下载相同的 layer 时等待其完成
+			defer opts.layers.lock(blobDigest)()
+			if opts.layers.link(blobDigest, layerTarFile) {
+				fmt.Printf("layer %s already pulled\n", blobDigest)
+				return
+			}
+			defer func() {
+				if r := recover(); r != nil {
+					panic(r)
+				}
+				opts.layers.add(blobDigest, layerTarFile)
+			}()
+		}
 		stat, err := os.Stat(layerTarFile)
 		if err == nil && stat.Size() >= item.GetInt64("size") {
 			// Blob already exists
@@ -224,8 +308,17 @@ func pullV2(image *Image, manifest *fastjson.Value, dir string) error {
 		} else if strings.HasSuffix(mediaType, "zstd") {
 			savedFile = layerTarFile + ".zstd"
 		}
-		err = fetchBlob(image, blobDigest, savedFile, item.GetInt64("size"))
-		ThrowIfError(err)
+		if encrypted {
+			// 先下载加密的 layer，解密之后再解压
+			err = fetchBlob(image, blobDigest, savedFile + ".enc", item.GetInt64("size"))
+			ThrowIfError(err)
+			err = decryptLayerFile(savedFile + ".enc", savedFile, item.Get("annotations"), decryptionKeys)
+			ThrowIfError(err)
+			os.Remove(savedFile + ".enc")
+		} else {
+			err = fetchBlob(image, blobDigest, savedFile, item.GetInt64("size"))
+			ThrowIfError(err)
+		}
 
 		if strings.HasSuffix(mediaType, ".tar") {
 			// layer 文件没有压缩
@@ -259,6 +352,10 @@ func pullV2(image *Image, manifest *fastjson.Value, dir string) error {
 		os.Remove(savedFile)
 	})
 
+	if len(opts.Unpack) > 0 {
+		return unpackLayers(layerFiles, opts)
+	}
+
 	// 创建 repositories 文件
 	fp, err := os.OpenFile(path.Join(targetPath, "repositories"), os.O_CREATE|os.O_RDWR, 0644)
 	ThrowIfError(err)
@@ -277,11 +374,42 @@ func pullV2(image *Image, manifest *fastjson.Value, dir string) error {
 	err = tarFile.AddFS(fs)
 	ThrowIfError(err)
 
-	fmt.Printf("to load image file: docker load -i %s.tar", targetFolder)
+	fmt.Printf("to load image file: docker load -i %s.tar\n", targetFolder)
 	return tarFile.Close()
 }
 
 
+// 若 manifest 是包含多个 platform 的 manifest list，选择指定 platform 的 manifest
+func selectPlatformManifest(image *Image, manifest *fastjson.Value) (*fastjson.Value, error) {
+	if !manifest.Exists("manifests") {
+		return manifest, nil
+	}
+
+	// 该Tag对应有多个platform的镜像
+	info, exist := findPlatformManifest(image, manifest.GetArray("manifests"))
+	if !exist {
+		return nil, fmt.Errorf("Not found platform %s/%s", image.platform.osName, image.platform.architecture)
+	}
+
+	// FetchManifest 会检查返回的 manifest 与 index 中的 digest 一致
+	digest := string(info.GetStringBytes("digest"))
+	return image.FetchManifest(digest), nil
+}
+
+// 在 manifest list 中查找与镜像 platform 匹配的 manifest
+func findPlatformManifest(image *Image, manifestList []*fastjson.Value) (*fastjson.Value, bool) {
+	return lo.Find(manifestList, func(item *fastjson.Value) bool {
+		if string(item.GetStringBytes("platform", "os")) == image.platform.osName && string(item.GetStringBytes("platform", "architecture")) == image.platform.architecture {
+			variant := string(item.GetStringBytes("platform", "variant"))
+			if len(image.platform.variant) == 0 || len(variant) == 0 {
+				return true
+			}
+			return image.platform.variant == variant
+		}
+		return false
+	})
+}
+
 // 检测 blob 的下载地址
 func detectBlobUrl(image *Image, blobSum string) string {
 	baseUrl := fmt.Sprintf("%s://%s", image.protocol, image.Registry)
@@ -339,6 +467,25 @@ func fetchBlob(image *Image, blobSum string, output string, totalSize int64) err
 	return continueDownload(url, output, token, totalSize)
 }
 
+// 以数据流的方式读取 blob，不保存到磁盘
+func openBlob(image *Image, blobSum string) (io.ReadCloser, error) {
+	token := image.GetToken("pull")
+	url := detectBlobUrl(image, blobSum)
+
+	resp, err := resty.New().R().
+		SetHeader("Authorization", fmt.Sprintf("Bearer %s", token)).
+		SetDoNotParseResponse(true).
+		Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() >= 300 {
+		resp.RawResponse.Body.Close()
+		return nil, fmt.Errorf("Failed to download blob %s with code %d", blobSum, resp.StatusCode())
+	}
+	return resp.RawResponse.Body, nil
+}
+
 // 断点续传下载
 func continueDownload(url string, output string, token string, totalSize int64) error {
 	if totalSize == 0 {
@@ -1,179 +1,541 @@
 package utils
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"crypto"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 
 	resty "github.com/go-resty/resty/v2"
+	"github.com/valyala/fastjson"
 )
 
 
-func PushImage(filename string, image *Image) error {
+type PushOptions struct {
+	Compression string		// 未压缩 layer 的压缩方式：gzip, zstd, none
+	RegistryPrefix string		// 推送镜像包中的所有镜像时，替换 RepoTags 的仓库前缀
+	TagTemplate string		// 推送镜像包中的所有镜像时，RepoTags 的映射模板
+	Policy string			// 镜像信任策略文件，在上传之前检查
+	EncryptionKeys []string		// 加密 layer 的接收者公钥，格式为 [jwe:]<file>
+	EncryptLayers []int		// 需要加密的 layer 序号，负数从最上层开始计数；为空时加密所有 layer
+}
+
+// 第 idx 个 layer 是否需要加密
+func (o *PushOptions) shouldEncrypt(idx int, count int) bool {
+	if len(o.EncryptionKeys) == 0 {
+		return false
+	}
+	if len(o.EncryptLayers) == 0 {
+		return true
+	}
+	for _, item := range o.EncryptLayers {
+		if item == idx || item < 0 && count + item == idx {
+			return true
+		}
+	}
+	return false
+}
+
+func PushImage(filename string, image *Image, opts PushOptions) error {
+	if len(opts.EncryptLayers) > 0 && len(opts.EncryptionKeys) == 0 {
+		return fmt.Errorf("--encrypt-layer requires --encryption-key")
+	}
+	if len(image.ImageName) == 0 || len(opts.RegistryPrefix) > 0 || len(opts.TagTemplate) > 0 {
+		// 未指定目标镜像，按镜像包中的 RepoTags 上传每个镜像
+		return pushArchiveImages(filename, image, &opts)
+	}
+	if _, err := checkPolicy(opts.Policy, image, "push"); err != nil {
+		return err
+	}
 	fmt.Printf("Pull Image %s to %s/%s:%s\n", filename, image.Registry, image.Repository, image.Tag)
-	dir, willDelete, err := detectImageFile(filename)
-	if err != nil {
+
+	entries := parsePushEntries(filename)
+	if len(entries) == 1 && !entries[0].hasPlatform {
+		// 单个镜像，直接上传 manifest 到指定的 tag
+		desc, content, err := pushFile(image, entries[0].filename, &opts)
+		if err != nil {
+			return err
+		}
+		_, err = uploadManifest(image, image.Tag, desc.MediaType, content)
 		return err
 	}
 
-	defer func () {
-		if willDelete {
-			os.RemoveAll(dir)
+	// 多个 platform 的镜像：先按 digest 上传每个镜像的 manifest，再上传 manifest list
+	manifests := []descriptor{}
+	for idx, entry := range entries {
+		fmt.Printf("Platform (%d/%d) %s #####\n", idx + 1, len(entries), entry.filename)
+		desc, content, err := pushFile(image, entry.filename, &opts)
+		if err != nil {
+			return err
+		}
+		if entry.hasPlatform {
+			desc.Platform = entry.platform
 		}
-	}()
+		if len(desc.Platform.osName) == 0 {
+			desc.Platform.osName = image.platform.osName
+		}
+		if len(desc.Platform.architecture) == 0 {
+			desc.Platform.architecture = image.platform.architecture
+			desc.Platform.variant = image.platform.variant
+		}
+		if desc.Digest, err = uploadManifest(image, desc.Digest, desc.MediaType, content); err != nil {
+			return err
+		}
+		manifests = append(manifests, desc)
+	}
 
-	return pushDir(image, dir)
+	mediaType, content := buildManifestList(manifests)
+	_, err := uploadManifest(image, image.Tag, mediaType, content)
+	return err
 }
 
-// 检查指定的镜像文件是否是一个目录，否则解压
-func detectImageFile(filename string) (dir string, willDelete bool, err error) {
-	var info os.FileInfo
-	if info, err = os.Stat(filename); err != nil {
-		return
+type pushEntry struct {
+	filename string
+	hasPlatform bool
+	platform imagePlatform
+}
+
+// <os>/<arch>[/<variant>]=，os 为 go 支持的 GOOS，避免把 ./a=b.tar 这样的文件名当作 platform
+var pushPlatformPattern = regexp.MustCompile(`^(aix|android|darwin|dragonfly|freebsd|illumos|ios|js|linux|netbsd|openbsd|plan9|solaris|wasip1|windows|zos)/[a-z0-9_]+(/[a-z0-9]+)?=`)
+
+// 解析 push 的文件参数，格式为 [<os>/<arch>[/<variant>]=]<file>[,...]
+// 已存在的文件直接使用；只在逗号后面是 platform 时才分割，文件名中可以包含逗号
+func parsePushEntries(filename string) []pushEntry {
+	if _, err := os.Stat(filename); err == nil {
+		return []pushEntry{{filename: filename}}
 	}
-	if info.IsDir() {
-		// 当前指定的路径是一个目录，则直接上传该目录下的文件
-		dir = filename
-		willDelete = false
-		return
+	entries := []pushEntry{}
+	for _, item := range strings.Split(filename, ",") {
+		if len(entries) > 0 && !pushPlatformPattern.MatchString(item) {
+			entries[len(entries) - 1].filename += "," + item
+			continue
+		}
+		entry := pushEntry{filename: item}
+		if prefix := pushPlatformPattern.FindString(item); len(prefix) > 0 {
+			entry.hasPlatform = true
+			entry.platform = parsePlatform(strings.TrimSuffix(prefix, "="))
+			entry.filename = item[len(prefix):]
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// 解析 <os>/<arch>[/<variant>] 格式的 platform
+func parsePlatform(value string) (p imagePlatform) {
+	parts := strings.SplitN(value, "/", 3)
+	p.osName = parts[0]
+	if len(parts) > 1 {
+		p.architecture = parts[1]
 	}
+	if len(parts) > 2 {
+		p.variant = parts[2]
+	}
+	return
+}
+
+// 镜像包中的一个镜像
+type archiveImage struct {
+	name string
+	tags []string
+	index int					// docker-archive 中 manifest.json 的序号
+	ociItem *fastjson.Value		// OCI layout 中 index.json 的 descriptor
+}
 
-	// 当前指定的文件路径是一个 tar 包，先解压到临时目录，上传完成后再删除临时文件
-	var targetFolder string
-	if targetFolder, err = os.MkdirTemp("", "oci-*"); err != nil {
+// 列出镜像包中的所有镜像及其 tag
+func listArchiveImages(fsys fs.FS) (images []archiveImage, err error) {
+	var content []byte
+	if isOciLayout(fsys) {
+		if content, err = fs.ReadFile(fsys, "index.json"); err != nil {
+			return
+		}
+		for idx, item := range parseJson(content).GetArray("manifests") {
+			name := string(item.GetStringBytes("annotations", "io.containerd.image.name"))
+			if len(name) == 0 {
+				name = string(item.GetStringBytes("annotations", "org.opencontainers.image.ref.name"))
+			}
+			if !strings.ContainsAny(name, "/:") {
+				// OCI 规范中的 ref.name 可以只是 tag，无法得到 repository
+				name = ""
+			}
+			image := archiveImage{name: fmt.Sprintf("manifest %d (%s)", idx, item.GetStringBytes("digest")), index: idx, ociItem: item}
+			if len(name) > 0 {
+				image.tags = []string{name}
+			}
+			images = append(images, image)
+		}
 		return
 	}
-	dir = targetFolder
-	willDelete = true
 
-	var fp *os.File
-	if fp, err = os.Open(filename); err != nil {
+	if content, err = fs.ReadFile(fsys, "manifest.json"); err != nil {
 		return
 	}
-	fmt.Printf("extract tar %s to %s\n", filename, targetFolder)
+	for idx, item := range parseJson(content).GetArray() {
+		image := archiveImage{name: fmt.Sprintf("image %d (%s)", idx, item.GetStringBytes("Config")), index: idx}
+		for _, tag := range item.GetArray("RepoTags") {
+			image.tags = append(image.tags, string(tag.GetStringBytes()))
+		}
+		images = append(images, image)
+	}
+	return
+}
+
+// 按前缀或模板改写镜像的 tag
+func rewriteImageTag(tag string, opts *PushOptions) (string, error) {
+	var source Image
+	source.ParseImage(tag)
+
+	if len(opts.TagTemplate) > 0 {
+		tmpl, err := template.New("tag").Parse(opts.TagTemplate)
+		if err != nil {
+			return "", err
+		}
+		var buff strings.Builder
+		if err = tmpl.Execute(&buff, source); err != nil {
+			return "", err
+		}
+		return buff.String(), nil
+	}
+	if len(opts.RegistryPrefix) > 0 {
+		if strings.HasPrefix(source.Tag, "sha256:") {
+			return fmt.Sprintf("%s/%s@%s", strings.TrimSuffix(opts.RegistryPrefix, "/"), source.Repository, source.Tag), nil
+		}
+		return fmt.Sprintf("%s/%s:%s", strings.TrimSuffix(opts.RegistryPrefix, "/"), source.Repository, source.Tag), nil
+	}
+	return tag, nil
+}
+
+// 上传镜像包（如 docker save a b c）中的所有镜像，相同的 layer 只上传一次
+// 目标仓库由最后读取到的 manifest.json 或 index.json 决定，标准输入和压缩过的 tar 包仍然解压到临时目录
+func pushArchiveImages(filename string, image *Image, opts *PushOptions) error {
+	if len(parsePushEntries(filename)) > 1 {
+		return fmt.Errorf("<image> is required when pushing multiple platforms")
+	}
+	fsys, cleanup, err := openImageFile(filename)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
 
-	tarFile := tar.NewReader(fp)
-	for true {
-		header, e := tarFile.Next()
-		if e == io.EOF {
-			break
+	return pushArchiveFs(fsys, filename, image, opts)
+}
+
+func pushArchiveFs(fsys fs.FS, filename string, image *Image, opts *PushOptions) error {
+	images, err := listArchiveImages(fsys)
+	if err != nil {
+		return err
+	}
+	// 先得到所有的目标镜像，按策略检查之后再上传
+	type archivePush struct {
+		item archiveImage
+		tag string
+		target Image
+	}
+	pushes := []archivePush{}
+	for _, item := range images {
+		if len(item.tags) == 0 {
+			return fmt.Errorf("%s in %s has no tag", item.name, filename)
 		}
-		fmt.Printf("extract file %s ...\n", header.Name)
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err = os.MkdirAll(targetFolder+"/"+header.Name, 0755); err != nil {
-				return
+		for _, tag := range item.tags {
+			target, err := rewriteImageTag(tag, opts)
+			if err != nil {
+				return err
 			}
-		case tar.TypeReg:
-			outFilename := path.Join(targetFolder, header.Name)
-			ensureDir(path.Dir(outFilename))
-			outFile, e := os.OpenFile(outFilename, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-			if e != nil {
-				err = e
-				return
+			targetImage := image.WithReference(target)
+			if _, err = checkPolicy(opts.Policy, &targetImage, "push"); err != nil {
+				return err
 			}
-			io.Copy(outFile, tarFile)
-			outFile.Close()
+			pushes = append(pushes, archivePush{item, tag, targetImage})
 		}
 	}
 
-	return
+	for idx, push := range pushes {
+		targetImage := push.target
+		fmt.Printf("Push Image (%d/%d) %s to %s/%s:%s\n", idx + 1, len(pushes), push.tag, targetImage.Registry, targetImage.Repository, targetImage.Tag)
+
+		var desc descriptor
+		var content []byte
+		if push.item.ociItem != nil && len(opts.EncryptionKeys) > 0 {
+			err = fmt.Errorf("encrypting layers is only supported for docker-archive images")
+		} else if push.item.ociItem != nil {
+			desc, content, err = pushOciManifest(&targetImage, fsys, push.item.ociItem)
+		} else {
+			desc, content, err = pushDockerArchive(&targetImage, fsys, push.item.index, opts)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = uploadManifest(&targetImage, targetImage.Tag, desc.MediaType, content); err != nil {
+			return err
+		}
+	}
+	return nil
 }
-func pushDir(image *Image, dir string) (err error) {
-	var content []byte
-	if content, err = os.ReadFile(path.Join(dir, "manifest.json")); err != nil {
+
+// 上传单个镜像文件的 config 和 layer，返回待上传的 manifest 内容
+func pushFile(image *Image, filename string, opts *PushOptions) (desc descriptor, content []byte, err error) {
+	var stream io.ReadCloser
+	if stream, err = openImageStream(filename); err != nil {
+		return
+	}
+	var fsys fs.FS
+	cleanup := func() {}
+	switch {
+	case stream != nil && len(opts.EncryptionKeys) == 0:
+		// 标准输入和压缩过的 tar 包：读取时直接上传 layer，不使用临时目录
+		defer stream.Close()
+		var streamFs *streamFS
+		if streamFs, err = readImageStream(image, stream, opts.Compression); err != nil {
+			return
+		}
+		fsys = streamFs
+	case stream != nil:
+		// 加密的 layer 由 manifest.json 中的序号指定，读取到 manifest.json 之前无法决定，仍然解压到临时目录
+		defer stream.Close()
+		fsys, cleanup, err = extractImageStream(stream, filename)
+	default:
+		fsys, cleanup, err = openImageFile(filename)
+	}
+	defer cleanup()
+	if err != nil {
+		return
+	}
+
+	return pushDir(image, fsys, opts)
+}
+
+func pushDir(image *Image, fsys fs.FS, opts *PushOptions) (desc descriptor, content []byte, err error) {
+	if isOciLayout(fsys) {
+		// buildah、kaniko、BuildKit 等导出的 OCI image layout
+		if len(opts.EncryptionKeys) > 0 {
+			err = fmt.Errorf("encrypting layers is only supported for docker-archive images")
+			return
+		}
+		return pushOciLayout(image, fsys)
+	}
+
+	if content, err = fs.ReadFile(fsys, "manifest.json"); err != nil {
+		return
+	}
+	if count := len(parseJson(content).GetArray()); count > 1 {
+		err = fmt.Errorf("image file contains %d images, omit <image> to push each of them to its RepoTags", count)
+		return
+	}
+	return pushDockerArchive(image, fsys, 0, opts)
+}
+
+// 上传 docker-archive 中 manifest.json 的第 index 个镜像
+func pushDockerArchive(image *Image, fsys fs.FS, index int, opts *PushOptions) (desc descriptor, content []byte, err error) {
+	if content, err = fs.ReadFile(fsys, "manifest.json"); err != nil {
+		return
+	}
+	manifestJson := parseJson([]byte(content)).Get(strconv.Itoa(index))
+	if manifestJson == nil {
+		err = fmt.Errorf("image %d not found in manifest.json", index)
 		return
 	}
-	manifestJson := parseJson([]byte(content))
-	config := manifestJson.GetStringBytes("0", "Config")
+	config := manifestJson.GetStringBytes("Config")
 	if config == nil {
-		config = manifestJson.GetStringBytes("0", "config")
+		config = manifestJson.GetStringBytes("config")
 	}
 
-	configFilename := path.Join(dir, string(config))
-	if content, err = os.ReadFile(configFilename); err != nil {
+	configFilename := cleanTarName(string(config))
+	if content, err = fs.ReadFile(fsys, configFilename); err != nil {
 		return
 	}
+	// 从 config 中读取镜像的 platform
+	configJson := parseJson(content)
+	desc.Platform.osName = string(configJson.GetStringBytes("os"))
+	desc.Platform.architecture = string(configJson.GetStringBytes("architecture"))
+	desc.Platform.variant = string(configJson.GetStringBytes("variant"))
 
 	var blobDigest string
 	var blobSize int64
 	// 1.上传 config json 文件
-	if blobDigest, blobSize, err = uploadBlob(image, configFilename, "application/vnd.docker.container.image.v1+json"); err != nil {
+	if blobDigest, blobSize, err = uploadBlob(image, fsys, configFilename, "application/vnd.docker.container.image.v1+json"); err != nil {
 		return
 	}
 
 	// 2.上传 layer 文件
-	layers := manifestJson.GetArray("0", "Layers")
+	layers := manifestJson.GetArray("Layers")
 	if layers == nil {
-		layers = manifestJson.GetArray("0", "layers")
+		layers = manifestJson.GetArray("layers")
+	}
+
+	var recipients []crypto.PublicKey
+	if len(opts.EncryptionKeys) > 0 {
+		if recipients, err = loadEncryptionKeys(opts.EncryptionKeys); err != nil {
+			return
+		}
+	}
+
+	layerDescs := []descriptor{}
+	isOci := false
+	for idx, item := range layers {
+		name, _ := item.StringBytes()
+		layerFilename := cleanTarName(string(name))
+		fmt.Printf("Progress (%d/%d) #####\n", idx, len(layers))
+		var layerDesc descriptor
+		if opts.shouldEncrypt(idx, len(layers)) {
+			// 加密的 mediaType 只有 OCI 格式
+			isOci = true
+			layerDesc, err = uploadEncryptedLayer(image, fsys, layerFilename, opts.Compression, recipients)
+		} else {
+			layerDesc, err = uploadLayer(image, fsys, layerFilename, opts.Compression)
+		}
+		if err != nil {
+			return
+		}
+		if layerDesc.Compression == "zstd" {
+			// docker 的 manifest 不支持 zstd，需要使用 OCI manifest
+			isOci = true
+		}
+		layerDescs = append(layerDescs, layerDesc)
+	}
+
+	desc.MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	configMediaType := "application/vnd.docker.container.image.v1+json"
+	if isOci {
+		desc.MediaType = "application/vnd.oci.image.manifest.v1+json"
+		configMediaType = "application/vnd.oci.image.config.v1+json"
 	}
-	
 	newManifestJson := parseJsonString(fmt.Sprintf(`{
 		"schemaVersion": 2,
-		"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+		"mediaType": "%s",
 		"config": {
 			"digest": "%s",
 			"size": %d,
-			"mediaType": "application/vnd.docker.container.image.v1+json"
+			"mediaType": "%s"
 		},
 		"layers": []
-	}`, blobDigest, blobSize))
-	for idx, item := range layers {
-		name, _ := item.StringBytes()
-		layerFilename := path.Join(dir, string(name))
-		fmt.Printf("Progress (%d/%d) #####\n", idx, len(layers))
-		blobDigest, blobSize, err = uploadLayer(image, layerFilename)
-		if err != nil {
-			return
+	}`, desc.MediaType, blobDigest, blobSize, configMediaType))
+	for idx, item := range layerDescs {
+		mediaType := item.MediaType
+		if !isOci {
+			mediaType = layerMediaType(item.Compression, false)
 		}
-		newManifestJson.Get("layers").SetArrayItem(idx, parseJsonString(fmt.Sprintf(`{
+		layerJson := parseJsonString(fmt.Sprintf(`{
 			"digest": "%s",
 			"size": %d,
-			"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip"
-		}`, blobDigest, blobSize)))
+			"mediaType": "%s"
+		}`, item.Digest, item.Size, mediaType))
+		setAnnotations(layerJson, item.Annotations)
+		newManifestJson.Get("layers").SetArrayItem(idx, layerJson)
 	}
-	// 3.上传 manifest.json 内容
-	return uploadManifest(image, newManifestJson.MarshalTo(nil))
+
+	content = newManifestJson.MarshalTo(nil)
+	desc.Digest = computeBytesDigest(content)
+	desc.Size = int64(len(content))
+	return
+}
+
+// 根据压缩方式得到 layer 的 mediaType
+func layerMediaType(compression string, isOci bool) string {
+	if isOci {
+		switch compression {
+		case "gzip":
+			return "application/vnd.oci.image.layer.v1.tar+gzip"
+		case "zstd":
+			return "application/vnd.oci.image.layer.v1.tar+zstd"
+		}
+		return "application/vnd.oci.image.layer.v1.tar"
+	}
+	if compression == "gzip" {
+		return "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	}
+	return "application/vnd.docker.image.rootfs.diff.tar"
+}
+
+// 生成多 platform 的 manifest list；若包含 OCI manifest 则使用 OCI index
+func buildManifestList(manifests []descriptor) (mediaType string, content []byte) {
+	mediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	for _, item := range manifests {
+		if item.MediaType == "application/vnd.oci.image.manifest.v1+json" {
+			mediaType = "application/vnd.oci.image.index.v1+json"
+		}
+	}
+
+	listJson := parseJsonString(fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": "%s",
+		"manifests": []
+	}`, mediaType))
+	var a fastjson.Arena
+	for idx, item := range manifests {
+		platformJson := a.NewObject()
+		platformJson.Set("architecture", a.NewString(item.Platform.architecture))
+		platformJson.Set("os", a.NewString(item.Platform.osName))
+		if len(item.Platform.variant) > 0 {
+			platformJson.Set("variant", a.NewString(item.Platform.variant))
+		}
+		itemJson := parseJsonString(fmt.Sprintf(`{
+			"mediaType": "%s",
+			"digest": "%s",
+			"size": %d
+		}`, item.MediaType, item.Digest, item.Size))
+		itemJson.Set("platform", platformJson)
+		listJson.Get("manifests").SetArrayItem(idx, itemJson)
+	}
+	content = listJson.MarshalTo(nil)
+	return
 }
 
 
 // https://docker-docs.uclv.cu/registry/spec/api/#pushing-an-image
-func uploadBlob(image *Image, filename string, mediaType string) (digest string, size int64, err error) {
+func uploadBlob(image *Image, fsys fs.FS, filename string, mediaType string) (digest string, size int64, err error) {
+	if desc, ok := streamedBlob(fsys, filename); ok {
+		return desc.Digest, desc.Size, nil
+	}
 	fmt.Printf("Uploading blob %s ...\n", filename)
 
-	if digest, err = computeDigest(filename); err != nil {
+	if digest, err = computeDigest(fsys, filename); err != nil {
 		return
 	}
 	var fileinfo os.FileInfo
-	if fileinfo, err = os.Stat(filename); err != nil {
+	if fileinfo, err = fs.Stat(fsys, filename); err != nil {
 		return
 	}
 	size = fileinfo.Size()
 
+	var exist bool
+	if exist, err = blobExists(image, digest); err != nil || exist {
+		if exist {
+			fmt.Printf("blob %s (%s) already exists\n", filename, digest)
+		}
+		// 文件已存在，直接返回
+		return
+	}
+
 	// image.pushToken = ""		// 每次申请新的 token，以免过期
 	token := image.GetToken("push")
 	baseUrl := fmt.Sprintf("%s://%s/v2/%s", image.protocol, image.Registry, image.Repository)
 	client := resty.New()
-	client.SetHeader("Authorization", fmt.Sprintf("Bearer %s", token))
 
 	var resp *resty.Response
-	if resp, err = client.R().Head(fmt.Sprintf("%s/blobs/%s", baseUrl, digest)); err != nil {
-		return
-	}
-	if resp.StatusCode() == 200 {
-		fmt.Printf("blob %s (%s) already exists\n", filename, digest)
-		// 文件已存在，直接返回
-		return
+	req := client.R()
+	if from := findBlobRepository(image, digest); len(from) > 0 {
+		// 该 blob 已上传到同一仓库的其他 repository，尝试直接 mount
+		token = image.GetMountToken(from)
+		req.SetQueryParam("mount", digest).SetQueryParam("from", from)
 	}
+	client.SetHeader("Authorization", fmt.Sprintf("Bearer %s", token))
 
 	// POST /v2/<name>/blobs/uploads/ 创建一个 upload uuid
-	if resp, err = client.R().Post(fmt.Sprintf("%s/blobs/uploads/", baseUrl)); err != nil {
+	if resp, err = req.Post(fmt.Sprintf("%s/blobs/uploads/", baseUrl)); err != nil {
+		return
+	}
+	if resp.StatusCode() == 201 {
+		fmt.Printf("blob %s (%s) mounted\n", filename, digest)
+		rememberBlob(image, digest)
 		return
 	}
 	uploadUrl := resp.Header().Get("Location")
@@ -187,12 +549,17 @@ func uploadBlob(image *Image, filename string, mediaType string) (digest string,
 	}
 
 	// 整体上传 PUT /v2/<name>/blobs/uploads/<uuid>?digest=<digest>
-  var fp *os.File
-	if fp, err = os.Open(filename); err != nil {
+	var fp fs.File
+	if fp, err = fsys.Open(filename); err != nil {
 		return
 	}
 	defer fp.Close()
 
+	// 直接从文件流式上传，需要指定 Content-Length，否则会使用 chunked 编码
+	client.SetPreRequestHook(func(c *resty.Client, r *http.Request) error {
+		r.ContentLength = size
+		return nil
+	})
 	resp, err = client.R().
 		SetQueryParam("digest", digest).
 		SetHeader("Content-Length", fmt.Sprintf("%d", size)).
@@ -210,61 +577,312 @@ func uploadBlob(image *Image, filename string, mediaType string) (digest string,
 	}
 
 	fmt.Printf("blob %s to %s\n", filename, digest)
+	rememberBlob(image, digest)
 	return
 }
-func uploadLayer(image *Image, filename string) (digest string, size int64, err error) {
-	// 检查当前的 layer 文件是否为 gzip 压缩
-	var fp *os.File
-	if fp, err = os.Open(filename); err != nil {
+
+// 以数据流的方式上传 blob，读取完之后才知道 digest 和大小：
+// POST 创建上传，PATCH 发送全部内容（chunked 编码），最后 PUT 指定 digest 完成上传
+func uploadBlobStream(image *Image, r io.Reader) (digest string, size int64, err error) {
+	token := image.GetToken("push")
+	baseUrl := fmt.Sprintf("%s://%s/v2/%s", image.protocol, image.Registry, image.Repository)
+	client := resty.New()
+	client.SetHeader("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	var resp *resty.Response
+	if resp, err = client.R().Post(fmt.Sprintf("%s/blobs/uploads/", baseUrl)); err != nil {
+		return
+	}
+	if resp.StatusCode() != 202 {
+		err = fmt.Errorf("start blob upload failed with StatusCode: %d", resp.StatusCode())
+		return
+	}
+	var uploadUrl string
+	if uploadUrl, err = uploadLocation(image, resp); err != nil {
 		return
 	}
-	defer fp.Close()
 
-	buff := make([]byte, 512)
-	if _, err = fp.Read(buff); err != nil {
+	h := sha256.New()
+	counter := &countWriter{}
+	if resp, err = client.R().
+		SetHeader("Content-Type", "application/octet-stream").
+		SetBody(io.TeeReader(r, io.MultiWriter(h, counter))).
+		Patch(uploadUrl); err != nil {
+		return
+	}
+	if resp.StatusCode() != 202 {
+		err = fmt.Errorf("upload blob failed with StatusCode: %d", resp.StatusCode())
+		return
+	}
+	if uploadUrl, err = uploadLocation(image, resp); err != nil {
 		return
 	}
 
-	fileType := http.DetectContentType(buff)
-	layerFilename := ""
-	if !strings.HasSuffix(fileType, "gzip") {
-		// 先对 layer 进行 gzip 压缩
-		fp.Seek(0, io.SeekStart)
-		layerFilename = filename + ".gz"
+	digest = fmt.Sprintf("sha256:%x", h.Sum(nil))
+	size = counter.n
+	if resp, err = client.R().SetQueryParam("digest", digest).Put(uploadUrl); err != nil {
+		return
+	}
+	if resp.StatusCode() != 201 {
+		err = fmt.Errorf("upload blob failed with StatusCode: %d", resp.StatusCode())
+		return
+	}
+	fmt.Printf("blob %s (%d bytes)\n", digest, size)
+	rememberBlob(image, digest)
+	return
+}
 
-		var fp1 *os.File
-		if fp1, err = os.OpenFile(layerFilename, os.O_CREATE|os.O_RDWR, 0644); err != nil {
-			return
+// 上传请求返回的 Location，相对路径时补全 url 地址
+func uploadLocation(image *Image, resp *resty.Response) (string, error) {
+	location := resp.Header().Get("Location")
+	if len(location) == 0 {
+		return "", fmt.Errorf("upload url is empty with StatusCode: %d", resp.StatusCode())
+	}
+	if !strings.HasPrefix(location, "http") {
+		location = fmt.Sprintf("%s://%s%s", image.protocol, image.Registry, location)
+	}
+	return location, nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// 检查 blob 是否已存在于仓库中
+func blobExists(image *Image, digest string) (exist bool, err error) {
+	token := image.GetToken("push")
+	url := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", image.protocol, image.Registry, image.Repository, digest)
+
+	var resp *resty.Response
+	if resp, err = resty.New().R().SetHeader("Authorization", fmt.Sprintf("Bearer %s", token)).Head(url); err != nil {
+		return
+	}
+	exist = resp.StatusCode() == 200
+	if exist {
+		rememberBlob(image, digest)
+	}
+	return
+}
+
+// 从同一仓库的其他 repository mount blob，成功时返回 true
+func mountBlob(image *Image, digest string) (mounted bool, err error) {
+	from := findBlobRepository(image, digest)
+	if len(from) == 0 {
+		return
+	}
+	token := image.GetMountToken(from)
+	url := fmt.Sprintf("%s://%s/v2/%s/blobs/uploads/", image.protocol, image.Registry, image.Repository)
+
+	client := resty.New()
+	client.SetHeader("Authorization", fmt.Sprintf("Bearer %s", token))
+	var resp *resty.Response
+	if resp, err = client.R().SetQueryParam("mount", digest).SetQueryParam("from", from).Post(url); err != nil {
+		return
+	}
+	if resp.StatusCode() == 201 {
+		rememberBlob(image, digest)
+		return true, nil
+	}
+	if location := resp.Header().Get("Location"); resp.StatusCode() == 202 && len(location) > 0 {
+		// 仓库不支持 mount 时会创建一个新的上传，直接取消
+		if !strings.HasPrefix(location, "http") {
+			location = fmt.Sprintf("%s://%s%s", image.protocol, image.Registry, location)
 		}
-		defer fp1.Close()
+		client.R().Delete(location)
+	}
+	return
+}
 
-		gzipFile := gzip.NewWriter(fp1)
-		if _, err = io.Copy(gzipFile, fp); err != nil {
-			return
+// 上传内存中的 blob，如 config
+func uploadBlobBytes(image *Image, content []byte, mediaType string) (digest string, size int64, err error) {
+	var tempDir string
+	if tempDir, err = os.MkdirTemp("", "blob-*"); err != nil {
+		return
+	}
+	defer os.RemoveAll(tempDir)
+
+	filename := strings.TrimPrefix(computeBytesDigest(content), "sha256:")
+	if err = os.WriteFile(path.Join(tempDir, filename), content, 0644); err != nil {
+		return
+	}
+	return uploadBlob(image, os.DirFS(tempDir), filename, mediaType)
+}
+
+// 将远程镜像 source 中的 blob 复制到 image，优先 mount，无法 mount 时先下载到临时文件再上传
+func copyBlob(image *Image, source *Image, digest string, mediaType string) (err error) {
+	var exist bool
+	if exist, err = blobExists(image, digest); err != nil || exist {
+		return
+	}
+	rememberBlob(source, digest)
+	if mounted, e := mountBlob(image, digest); e == nil && mounted {
+		fmt.Printf("blob %s mounted from %s\n", digest, source.Repository)
+		return
+	}
+
+	var fp *os.File
+	if fp, err = os.CreateTemp("", "blob-*"); err != nil {
+		return
+	}
+	blobFilename := fp.Name()
+	defer os.Remove(blobFilename)
+
+	var blob io.ReadCloser
+	if blob, err = openBlob(source, digest); err != nil {
+		fp.Close()
+		return
+	}
+	_, err = io.Copy(fp, blob)
+	blob.Close()
+	fp.Close()
+	if err != nil {
+		return
+	}
+
+	var uploaded string
+	if uploaded, _, err = uploadBlob(image, os.DirFS(path.Dir(blobFilename)), path.Base(blobFilename), mediaType); err != nil {
+		return
+	}
+	if uploaded != digest {
+		err = fmt.Errorf("blob %s does not match its digest %s", digest, uploaded)
+	}
+	return
+}
+
+// ==================== 已上传的 blob，用于跨 repository mount ====================
+var uploadedBlobs = map[string]string{}
+var uploadedBlobsLock sync.Mutex
+
+func rememberBlob(image *Image, digest string) {
+	uploadedBlobsLock.Lock()
+	defer uploadedBlobsLock.Unlock()
+	uploadedBlobs[image.Registry + "@" + digest] = image.Repository
+}
+
+// 查找同一仓库中已包含该 blob 的其他 repository
+func findBlobRepository(image *Image, digest string) string {
+	uploadedBlobsLock.Lock()
+	defer uploadedBlobsLock.Unlock()
+	repository := uploadedBlobs[image.Registry + "@" + digest]
+	if repository == image.Repository {
+		return ""
+	}
+	return repository
+}
+
+// 上传 layer 文件，返回的 descriptor 中 Compression 为压缩方式：gzip, zstd, tar，MediaType 为对应的 OCI mediaType
+func uploadLayer(image *Image, fsys fs.FS, filename string, compression string) (desc descriptor, err error) {
+	if streamed, ok := streamedBlob(fsys, filename); ok {
+		// 读取数据流时已经上传
+		return *streamed, nil
+	}
+	// 检查当前的 layer 文件的压缩格式
+	var fileType string
+	if fileType, err = detectCompression(fsys, filename); err != nil {
+		return
+	}
+
+	if fileType != "tar" || compression == "none" {
+		// 已经压缩过的 layer 直接上传，保持原有的 digest
+		desc.Compression = fileType
+		desc.MediaType = layerMediaType(fileType, true)
+		desc.Digest, desc.Size, err = uploadBlob(image, fsys, filename, desc.MediaType)
+		return
+	}
+
+	// 对于相同内容的 layer，优先使用之前压缩后的 digest
+	var diffId string
+	if diffId, err = computeDigest(fsys, filename); err != nil {
+		return
+	}
+	if cached, ok := lookupCompressedDigest(diffId, compression); ok {
+		if exist, e := blobExists(image, cached.Digest); e == nil && exist {
+			fmt.Printf("blob %s (%s) already exists\n", filename, cached.Digest)
+			return cached, nil
 		}
-		if err = gzipFile.Flush(); err != nil {
+		if mounted, e := mountBlob(image, cached.Digest); e == nil && mounted {
+			fmt.Printf("blob %s (%s) mounted\n", filename, cached.Digest)
+			return cached, nil
+		}
+	}
+
+	// 压缩到临时文件，上传完成后删除
+	var fp *os.File
+	if fp, err = os.CreateTemp("", "layer-*.tar."+compression); err != nil {
+		return
+	}
+	layerFilename := fp.Name()
+	fp.Close()
+	defer os.Remove(layerFilename)
+
+	if err = compressFile(fsys, filename, layerFilename, compression); err != nil {
+		return
+	}
+	desc.Compression = compression
+	desc.MediaType = layerMediaType(compression, true)
+	if desc.Digest, desc.Size, err = uploadBlob(image, os.DirFS(path.Dir(layerFilename)), path.Base(layerFilename), desc.MediaType); err != nil {
+		return
+	}
+	saveCompressedDigest(diffId, desc)
+	return
+}
+
+// 压缩并加密 layer 文件后上传，返回的 descriptor 中 Annotations 为 wrap 后的 key
+// 每次加密使用不同的密钥，因此不使用压缩后 digest 的缓存
+func uploadEncryptedLayer(image *Image, fsys fs.FS, filename string, compression string, recipients []crypto.PublicKey) (desc descriptor, err error) {
+	if desc.Compression, err = detectCompression(fsys, filename); err != nil {
+		return
+	}
+	if desc.Compression == "tar" && compression != "none" {
+		var fp *os.File
+		if fp, err = os.CreateTemp("", "layer-*.tar."+compression); err != nil {
 			return
 		}
-		if err = gzipFile.Close(); err != nil {
+		layerFilename := fp.Name()
+		fp.Close()
+		defer os.Remove(layerFilename)
+
+		if err = compressFile(fsys, filename, layerFilename, compression); err != nil {
 			return
 		}
-	} else {
-		layerFilename = filename
+		desc.Compression = compression
+		fsys, filename = os.DirFS(path.Dir(layerFilename)), path.Base(layerFilename)
 	}
 
-	return uploadBlob(image, layerFilename, "application/vnd.docker.image.rootfs.diff.tar.gzip")
+	var fp *os.File
+	if fp, err = os.CreateTemp("", "layer-*.encrypted"); err != nil {
+		return
+	}
+	encryptedFilename := fp.Name()
+	fp.Close()
+	defer os.Remove(encryptedFilename)
+
+	fmt.Printf("Encrypting layer %s for %d recipients\n", filename, len(recipients))
+	if desc.Annotations, err = encryptLayerFile(fsys, filename, encryptedFilename, recipients); err != nil {
+		return
+	}
+	desc.MediaType = layerMediaType(desc.Compression, true) + encryptedSuffix
+	desc.Digest, desc.Size, err = uploadBlob(image, os.DirFS(path.Dir(encryptedFilename)), path.Base(encryptedFilename), desc.MediaType)
+	return
 }
-func uploadManifest(image *Image, content []byte) (err error) {
+
+func uploadManifest(image *Image, reference string, mediaType string, content []byte) (digest string, err error) {
 	// PUT /v2/<name>/manifests/<reference>
 	token := image.GetToken("push")
-	url := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", image.protocol, image.Registry, image.Repository, image.Tag)
+	url := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", image.protocol, image.Registry, image.Repository, reference)
+	digest = computeBytesDigest(content)
 
 	client := resty.New()
 	client.SetHeader("Authorization", fmt.Sprintf("Bearer %s", token))
 
 	var resp *resty.Response
 	resp, err = client.R().
-		SetHeader("Content-Type", "application/vnd.docker.distribution.manifest.v2+json").
+		SetHeader("Content-Type", mediaType).
 		SetBody(content).
 		Put(url)
 
@@ -272,17 +890,17 @@ func uploadManifest(image *Image, content []byte) (err error) {
 		return
 	}
 	if resp.StatusCode() != 201 {
-		err = fmt.Errorf("upload blob failed with StatusCode: %d", resp.StatusCode())
+		err = fmt.Errorf("upload manifest failed with StatusCode: %d", resp.StatusCode())
 		return
 	}
-	fmt.Printf("manifest to %s\n", resp.Header().Get("Location"))
+	fmt.Printf("manifest %s to %s\n", digest, resp.Header().Get("Location"))
 	return
 }
 
 // 计算文件的 sha256
-func computeDigest(filename string) (digest string, err error) {
-  var fp *os.File
-	if fp, err = os.Open(filename); err != nil {
+func computeDigest(fsys fs.FS, filename string) (digest string, err error) {
+	var fp fs.File
+	if fp, err = fsys.Open(filename); err != nil {
 		return
 	}
 	defer fp.Close()
@@ -294,4 +912,8 @@ func computeDigest(filename string) (digest string, err error) {
 
 	digest = fmt.Sprintf("sha256:%x", h.Sum(nil))
 	return
-}
\ No newline at end of file
+}
+// 计算内容的 sha256
+func computeBytesDigest(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
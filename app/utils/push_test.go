@@ -0,0 +1,58 @@
+package utils_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_ParsePushEntries(t *testing.T) {
+	cases := []struct {
+		arg       string
+		files     []string
+		platforms []string
+	}{
+		{"image.tar", []string{"image.tar"}, []string{""}},
+		{"linux/amd64=a.tar,linux/arm64/v8=b.tar", []string{"a.tar", "b.tar"}, []string{"linux/amd64", "linux/arm64/v8"}},
+		// 左边不是 <os>/<arch> 时不是 platform
+		{"./a=b.tar", []string{"./a=b.tar"}, []string{""}},
+		{"dir/sub=x.tar", []string{"dir/sub=x.tar"}, []string{""}},
+		// 逗号后面不是 platform 时属于文件名
+		{"linux/amd64=a,1.tar,linux/arm64=b.tar", []string{"a,1.tar", "b.tar"}, []string{"linux/amd64", "linux/arm64"}},
+		{"a,b.tar", []string{"a,b.tar"}, []string{""}},
+	}
+	for _, c := range cases {
+		files, platforms := utils.ParsePushEntries(c.arg)
+		assert.Equal(t, c.files, files, c.arg)
+		assert.Equal(t, c.platforms, platforms, c.arg)
+	}
+
+	// 已存在的文件名中的逗号不分割
+	dir := t.TempDir()
+	filename := path.Join(dir, "linux,linux/amd64=x.tar")
+	assert.NoError(t, os.MkdirAll(path.Dir(filename), 0755))
+	assert.NoError(t, os.WriteFile(filename, nil, 0644))
+	files, platforms := utils.ParsePushEntries(filename)
+	assert.Equal(t, []string{filename}, files)
+	assert.Equal(t, []string{""}, platforms)
+}
+
+func Test_LayerMediaType(t *testing.T) {
+	cases := []struct {
+		compression string
+		isOci       bool
+		mediaType   string
+	}{
+		{"gzip", false, "application/vnd.docker.image.rootfs.diff.tar.gzip"},
+		{"tar", false, "application/vnd.docker.image.rootfs.diff.tar"},
+		{"gzip", true, "application/vnd.oci.image.layer.v1.tar+gzip"},
+		{"zstd", true, "application/vnd.oci.image.layer.v1.tar+zstd"},
+		{"tar", true, "application/vnd.oci.image.layer.v1.tar"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.mediaType, utils.LayerMediaType(c.compression, c.isOci))
+	}
+}
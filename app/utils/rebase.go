@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/valyala/fastjson"
+)
+
+// 将镜像 image 的基础镜像从 oldBase 替换为 newBase，推送到 target
+// image 的前几个 layer 必须与 oldBase 的 diff_ids 相同；layer 直接 mount，不重新上传
+func RebaseImage(image *Image, oldBase *Image, newBase *Image, target *Image) error {
+	fmt.Printf("Rebase Image %s/%s:%s onto %s/%s:%s\n", image.Registry, image.Repository, image.Tag, newBase.Registry, newBase.Repository, newBase.Tag)
+
+	images := []*Image{image, oldBase, newBase}
+	srcs := make([]*sourceImage, len(images))
+	configs := make([]*fastjson.Value, len(images))
+	for idx, item := range images {
+		src, err := loadRemoteImage(item)
+		if err != nil {
+			return err
+		}
+		var p fastjson.Parser
+		if configs[idx], err = p.ParseBytes(src.config); err != nil {
+			return err
+		}
+		srcs[idx] = src
+	}
+	app, old, base := srcs[0], srcs[1], srcs[2]
+	appConfig, oldConfig, baseConfig := configs[0], configs[1], configs[2]
+
+	// 1.检查 image 是否基于 oldBase
+	appDiffIDs := appConfig.GetArray("rootfs", "diff_ids")
+	oldDiffIDs := oldConfig.GetArray("rootfs", "diff_ids")
+	if len(app.layers) != len(appDiffIDs) || len(old.layers) != len(oldDiffIDs) {
+		return fmt.Errorf("image %s or %s has mismatched layers and diff_ids", image.Slug, oldBase.Slug)
+	}
+	if err := checkBaseConfig(appConfig, oldConfig); err != nil {
+		return fmt.Errorf("image %s is not based on %s: %w", image.Slug, oldBase.Slug, err)
+	}
+	appHistory := appConfig.GetArray("history")
+	oldHistory := oldConfig.GetArray("history")
+
+	// 2.将 newBase 和 image 自身的 layer mount 到 target
+	layers := append([]sourceLayer{}, base.layers...)
+	for _, layer := range base.layers {
+		if !isForeignMediaType(layer.MediaType) {
+			if err := copyBlob(target, newBase, layer.Digest, layer.MediaType); err != nil {
+				return err
+			}
+		}
+	}
+	for _, layer := range app.layers[len(old.layers):] {
+		if !isForeignMediaType(layer.MediaType) {
+			if err := copyBlob(target, image, layer.Digest, layer.MediaType); err != nil {
+				return err
+			}
+		}
+		layers = append(layers, layer)
+	}
+
+	// 3.替换 config 中基础镜像的 diff_ids 和 history，保留 image 自身的运行参数
+	var a fastjson.Arena
+	diffIDs := a.NewArray()
+	for idx, item := range append(baseConfig.GetArray("rootfs", "diff_ids"), appDiffIDs[len(oldDiffIDs):]...) {
+		diffIDs.SetArrayItem(idx, item)
+	}
+	appConfig.Get("rootfs").Set("diff_ids", diffIDs)
+	history := a.NewArray()
+	for idx, item := range append(baseConfig.GetArray("history"), appHistory[len(oldHistory):]...) {
+		history.SetArrayItem(idx, item)
+	}
+	appConfig.Set("history", history)
+
+	configMediaType := string(app.manifest.GetStringBytes("config", "mediaType"))
+	configDigest, configSize, err := uploadBlobBytes(target, appConfig.MarshalTo(nil), configMediaType)
+	if err != nil {
+		return err
+	}
+
+	// 4.生成新的 manifest，两者之一为 OCI 格式时使用 OCI manifest
+	manifest := app.manifest
+	mediaType := manifestMediaType(manifest, manifest)
+	isOci := mediaType == "application/vnd.oci.image.manifest.v1+json" ||
+		manifestMediaType(base.manifest, base.manifest) == "application/vnd.oci.image.manifest.v1+json"
+	if isOci {
+		mediaType = "application/vnd.oci.image.manifest.v1+json"
+		configMediaType = "application/vnd.oci.image.config.v1+json"
+	}
+	manifest.Set("mediaType", a.NewString(mediaType))
+	manifest.Get("config").Set("mediaType", a.NewString(configMediaType))
+	manifest.Get("config").Set("digest", a.NewString(configDigest))
+	manifest.Get("config").Set("size", a.NewNumberInt(int(configSize)))
+	layersJson := a.NewArray()
+	for idx, layer := range layers {
+		layerMediaType := layer.MediaType
+		if isOci {
+			layerMediaType = ociLayerMediaType(layerMediaType)
+		}
+		layersJson.SetArrayItem(idx, parseJsonString(fmt.Sprintf(`{
+			"mediaType": "%s",
+			"digest": "%s",
+			"size": %d
+		}`, layerMediaType, layer.Digest, layer.Size)))
+	}
+	manifest.Set("layers", layersJson)
+
+	digest, err := uploadManifest(target, target.Tag, mediaType, manifest.MarshalTo(nil))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rebased %s/%s:%s@%s\n", target.Registry, target.Repository, target.Tag, digest)
+	return nil
+}
+
+// 检查 app 的 diff_ids 和 history 是否以 base 的 diff_ids 和 history 开头
+// history 按 created、created_by 和 empty_layer 比较，comment 等其他字段可能被构建工具修改
+func checkBaseConfig(app *fastjson.Value, base *fastjson.Value) error {
+	appDiffIDs := app.GetArray("rootfs", "diff_ids")
+	baseDiffIDs := base.GetArray("rootfs", "diff_ids")
+	if len(appDiffIDs) < len(baseDiffIDs) {
+		return fmt.Errorf("it has fewer layers")
+	}
+	for idx, item := range baseDiffIDs {
+		if string(item.GetStringBytes()) != string(appDiffIDs[idx].GetStringBytes()) {
+			return fmt.Errorf("layer %d is %s, expected %s", idx, appDiffIDs[idx].GetStringBytes(), item.GetStringBytes())
+		}
+	}
+	appHistory := app.GetArray("history")
+	baseHistory := base.GetArray("history")
+	if len(appHistory) < len(baseHistory) {
+		return fmt.Errorf("it has fewer history entries")
+	}
+	for idx, item := range baseHistory {
+		for _, key := range []string{"created", "created_by"} {
+			if string(item.GetStringBytes(key)) != string(appHistory[idx].GetStringBytes(key)) {
+				return fmt.Errorf("history %d %s is %q, expected %q", idx, key, appHistory[idx].GetStringBytes(key), item.GetStringBytes(key))
+			}
+		}
+		if item.GetBool("empty_layer") != appHistory[idx].GetBool("empty_layer") {
+			return fmt.Errorf("history %d empty_layer does not match", idx)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_CheckBaseConfig(t *testing.T) {
+	base := `{"rootfs": {"diff_ids": ["sha256:a", "sha256:b"]}, "history": [
+		{"created": "2024-01-01T00:00:00Z", "created_by": "ADD rootfs.tar /"},
+		{"created": "2024-01-01T00:00:01Z", "created_by": "ENV PATH=/bin", "empty_layer": true},
+		{"created": "2024-01-01T00:00:02Z", "created_by": "RUN apk add curl"}
+	]}`
+	cases := []struct {
+		app   string
+		valid bool
+	}{
+		{base, true},
+		{`{"rootfs": {"diff_ids": ["sha256:a", "sha256:b", "sha256:c"]}, "history": [
+			{"created": "2024-01-01T00:00:00Z", "created_by": "ADD rootfs.tar /", "comment": "buildkit"},
+			{"created": "2024-01-01T00:00:01Z", "created_by": "ENV PATH=/bin", "empty_layer": true},
+			{"created": "2024-01-01T00:00:02Z", "created_by": "RUN apk add curl"},
+			{"created": "2024-02-01T00:00:00Z", "created_by": "COPY app /app"}
+		]}`, true},
+		// diff_ids 不同
+		{`{"rootfs": {"diff_ids": ["sha256:a", "sha256:x", "sha256:c"]}, "history": []}`, false},
+		{`{"rootfs": {"diff_ids": ["sha256:a"]}, "history": []}`, false},
+		// diff_ids 相同但 history 不同，例如基础镜像中加了 ENV
+		{`{"rootfs": {"diff_ids": ["sha256:a", "sha256:b", "sha256:c"]}, "history": [
+			{"created": "2024-01-01T00:00:00Z", "created_by": "ADD rootfs.tar /"},
+			{"created": "2024-01-01T00:00:01Z", "created_by": "ENV PATH=/usr/bin", "empty_layer": true},
+			{"created": "2024-01-01T00:00:02Z", "created_by": "RUN apk add curl"},
+			{"created": "2024-02-01T00:00:00Z", "created_by": "COPY app /app"}
+		]}`, false},
+		{`{"rootfs": {"diff_ids": ["sha256:a", "sha256:b"]}, "history": [
+			{"created": "2024-01-01T00:00:00Z", "created_by": "ADD rootfs.tar /"},
+			{"created": "2024-01-01T00:00:01Z", "created_by": "ENV PATH=/bin"},
+			{"created": "2024-01-01T00:00:02Z", "created_by": "RUN apk add curl"}
+		]}`, false},
+		{`{"rootfs": {"diff_ids": ["sha256:a", "sha256:b"]}, "history": [
+			{"created": "2024-01-01T00:00:00Z", "created_by": "ADD rootfs.tar /"}
+		]}`, false},
+	}
+	for idx, c := range cases {
+		err := utils.CheckBaseConfig(c.app, base)
+		if c.valid {
+			assert.NoError(t, err, idx)
+		} else {
+			assert.Error(t, err, idx)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	resty "github.com/go-resty/resty/v2"
+	"github.com/valyala/fastjson"
+)
+
+// https://github.com/opencontainers/image-spec/blob/main/manifest.md#guidance-for-an-empty-descriptor
+const emptyConfigMediaType = "application/vnd.oci.empty.v1+json"
+
+type AttachOptions struct {
+	ArtifactType string            // artifact 的类型，如 application/spdx+json
+	MediaType    string            // 文件的 mediaType，默认为 application/octet-stream
+	Annotations  map[string]string // 写入 artifact manifest 的 annotations
+}
+
+type ReferrersOptions struct {
+	ArtifactType string // 只列出该类型的 artifact
+	Json         bool   // 以 OCI index 的 json 格式输出
+}
+
+// 将文件作为 artifact 上传，artifact 的 manifest 通过 subject 引用 image
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pushing-manifests-with-subject
+func AttachArtifact(image *Image, filename string, opts AttachOptions) error {
+	fmt.Printf("Attach %s to %s/%s:%s\n", filename, image.Registry, image.Repository, image.Tag)
+	if len(opts.ArtifactType) == 0 {
+		return fmt.Errorf("artifact type is required")
+	}
+	if len(opts.MediaType) == 0 {
+		opts.MediaType = "application/octet-stream"
+	}
+
+	subject, err := resolveSubject(image)
+	if err != nil {
+		return err
+	}
+
+	// 1.上传文件和空的 config
+	fileDigest, fileSize, err := uploadBlob(image, os.DirFS(path.Dir(filename)), path.Base(filename), opts.MediaType)
+	if err != nil {
+		return err
+	}
+	configDigest, configSize, err := uploadBlobBytes(image, []byte("{}"), emptyConfigMediaType)
+	if err != nil {
+		return err
+	}
+
+	// 2.上传引用 image 的 manifest
+	var a fastjson.Arena
+	manifest := parseJsonString(fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {
+			"mediaType": "%s",
+			"digest": "%s",
+			"size": %d
+		},
+		"layers": [{
+			"digest": "%s",
+			"size": %d
+		}]
+	}`, emptyConfigMediaType, configDigest, configSize, fileDigest, fileSize))
+	manifest.Set("artifactType", a.NewString(opts.ArtifactType))
+	manifest.Get("layers", "0").Set("mediaType", a.NewString(opts.MediaType))
+	manifest.Get("layers", "0").Set("annotations", a.NewObject())
+	manifest.Get("layers", "0", "annotations").Set("org.opencontainers.image.title", a.NewString(path.Base(filename)))
+	setAnnotations(manifest, opts.Annotations)
+
+	digest, err := pushReferrer(image, subject, manifest)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Attached %s to %s@%s\n", digest, image.Slug, subject.Digest)
+	return nil
+}
+
+// 设置 manifest 的 subject 并上传；仓库不支持 referrers API 时，将其记录到 sha256-<hex> tag 指向的 index 中
+func pushReferrer(image *Image, subject descriptor, manifest *fastjson.Value) (digest string, err error) {
+	var a fastjson.Arena
+	manifest.Set("subject", parseJsonString(fmt.Sprintf(`{
+		"mediaType": "%s",
+		"digest": "%s",
+		"size": %d
+	}`, subject.MediaType, subject.Digest, subject.Size)))
+
+	content := manifest.MarshalTo(nil)
+	if digest, err = uploadManifest(image, computeBytesDigest(content), "application/vnd.oci.image.manifest.v1+json", content); err != nil {
+		return
+	}
+
+	var supported bool
+	var fetchErr error
+	if err = Try(func() {
+		_, supported, fetchErr = fetchReferrers(image, subject.Digest)
+	}); err != nil {
+		return
+	}
+	if err = fetchErr; err != nil || supported {
+		return
+	}
+	desc := parseJsonString(fmt.Sprintf(`{
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"digest": "%s",
+		"size": %d
+	}`, digest, len(content)))
+	desc.Set("artifactType", a.NewString(string(manifest.GetStringBytes("artifactType"))))
+	if annotations := manifest.Get("annotations"); annotations != nil {
+		desc.Set("annotations", annotations)
+	}
+	err = addReferrerTag(image, subject.Digest, desc)
+	return
+}
+
+// 列出引用 image 的所有 artifact
+func ListReferrers(image *Image, opts ReferrersOptions) error {
+	subject, err := resolveSubject(image)
+	if err != nil {
+		return err
+	}
+
+	var referrers []*fastjson.Value
+	var supported bool
+	var fetchErr error
+	if err = Try(func() {
+		referrers, supported, fetchErr = fetchReferrers(image, subject.Digest)
+		if fetchErr == nil && !supported {
+			referrers, _, fetchErr = fetchReferrerTag(image, subject.Digest)
+		}
+	}); err != nil {
+		return err
+	}
+	if fetchErr != nil {
+		return fetchErr
+	}
+	if len(opts.ArtifactType) > 0 {
+		// 仓库可能不支持按 artifactType 过滤，在本地再过滤一次
+		filtered := []*fastjson.Value{}
+		for _, item := range referrers {
+			if string(item.GetStringBytes("artifactType")) == opts.ArtifactType {
+				filtered = append(filtered, item)
+			}
+		}
+		referrers = filtered
+	}
+
+	if opts.Json {
+		index := newReferrersIndex()
+		for idx, item := range referrers {
+			index.Get("manifests").SetArrayItem(idx, item)
+		}
+		fmt.Println(string(index.MarshalTo(nil)))
+		return nil
+	}
+	if len(referrers) == 0 {
+		fmt.Printf("no referrers found for %s@%s\n", image.Slug, subject.Digest)
+		return nil
+	}
+	for _, item := range referrers {
+		annotations := []string{}
+		if object := item.GetObject("annotations"); object != nil {
+			object.Visit(func(key []byte, v *fastjson.Value) {
+				annotations = append(annotations, fmt.Sprintf("%s=%s", key, v.GetStringBytes()))
+			})
+		}
+		fmt.Printf("%s  %s  %s  %s\n", item.GetStringBytes("digest"), item.GetStringBytes("artifactType"), formatSize(item.GetInt64("size")), strings.Join(annotations, ","))
+	}
+	return nil
+}
+
+// 得到 image 的 manifest 的 descriptor，作为 artifact 的 subject
+func resolveSubject(image *Image) (subject descriptor, err error) {
+	var content []byte
+	var mediaType string
+	var fetchErr error
+	if err = Try(func() {
+		content, mediaType, fetchErr = image.fetchManifestRaw("")
+	}); err != nil {
+		return
+	}
+	if err = fetchErr; err != nil {
+		return
+	}
+	var p fastjson.Parser
+	manifest, err := p.ParseBytes(content)
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(mediaType, "application/vnd.") {
+		mediaType = manifestMediaType(manifest, manifest)
+	}
+	subject.MediaType = mediaType
+	// 与仓库一致，签名的 schema v1 manifest 的 digest 不包含签名部分
+	subject.Digest = manifestDigest(content)
+	subject.Size = int64(len(content))
+	return
+}
+
+// 不支持 referrers API 的仓库返回 404，部分仓库返回 400、405 或 501
+func isReferrersUnsupported(statusCode int) bool {
+	switch statusCode {
+	case 400, 404, 405, 501:
+		return true
+	}
+	return false
+}
+
+// GET /v2/<name>/referrers/<digest>，第一页返回 isReferrersUnsupported 的状态码时表示不支持 referrers API
+func fetchReferrers(image *Image, digest string) (referrers []*fastjson.Value, supported bool, err error) {
+	token := image.GetToken("pull")
+	url := fmt.Sprintf("%s://%s/v2/%s/referrers/%s", image.protocol, image.Registry, image.Repository, digest)
+
+	client := resty.New()
+	image.setApiProxy(client)
+	client.SetTimeout(10 * time.Second)
+	client.SetHeader("Authorization", fmt.Sprintf("Bearer %s", token))
+	referrers = []*fastjson.Value{}
+	for page := 0; len(url) > 0; page++ {
+		var resp *resty.Response
+		if resp, err = client.R().SetHeader("Accept", "application/vnd.oci.image.index.v1+json").Get(url); err != nil {
+			return
+		}
+		if page == 0 && isReferrersUnsupported(resp.StatusCode()) {
+			return nil, false, nil
+		}
+		if resp.StatusCode() != 200 {
+			err = fmt.Errorf("fetch referrers failed with StatusCode: %d", resp.StatusCode())
+			return
+		}
+		var p fastjson.Parser
+		var index *fastjson.Value
+		if index, err = p.ParseBytes(resp.Body()); err != nil {
+			return
+		}
+		referrers = append(referrers, index.GetArray("manifests")...)
+
+		// 结果较多时通过 Link: <url>; rel="next" 分页
+		url = nextPageUrl(image, resp.Header().Get("Link"))
+	}
+	return referrers, true, nil
+}
+
+func nextPageUrl(image *Image, link string) string {
+	if !strings.Contains(link, `rel="next"`) {
+		return ""
+	}
+	start := strings.Index(link, "<")
+	end := strings.Index(link, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	url := link[start+1 : end]
+	if !strings.HasPrefix(url, "http") {
+		url = fmt.Sprintf("%s://%s%s", image.protocol, image.Registry, url)
+	}
+	return url
+}
+
+// 不支持 referrers API 的仓库使用 tag 记录 artifact：<alg>-<hex>
+// https://github.com/opencontainers/distribution-spec/blob/main/spec.md#referrers-tag-schema
+func referrersTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1)
+}
+
+func newReferrersIndex() *fastjson.Value {
+	return parseJsonString(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.index.v1+json",
+		"manifests": []
+	}`)
+}
+
+// 读取 referrers tag 指向的 index，tag 不存在时返回一个空的 index
+func fetchReferrerTag(image *Image, digest string) (referrers []*fastjson.Value, index *fastjson.Value, err error) {
+	content, _, err := image.fetchManifestRaw(referrersTag(digest))
+	if errors.Is(err, errManifestNotFound) {
+		return []*fastjson.Value{}, newReferrersIndex(), nil
+	}
+	if err != nil {
+		return
+	}
+	var p fastjson.Parser
+	if index, err = p.ParseBytes(content); err != nil {
+		return
+	}
+	if index.Get("manifests") == nil {
+		return nil, nil, fmt.Errorf("tag %s is not an image index", referrersTag(digest))
+	}
+	return index.GetArray("manifests"), index, nil
+}
+
+// 将 artifact 的 descriptor 添加到 referrers tag 指向的 index
+func addReferrerTag(image *Image, subjectDigest string, desc *fastjson.Value) (err error) {
+	var referrers []*fastjson.Value
+	var index *fastjson.Value
+	var fetchErr error
+	if err = Try(func() {
+		referrers, index, fetchErr = fetchReferrerTag(image, subjectDigest)
+	}); err != nil {
+		return
+	}
+	if err = fetchErr; err != nil {
+		return
+	}
+	digest := string(desc.GetStringBytes("digest"))
+	for _, item := range referrers {
+		if string(item.GetStringBytes("digest")) == digest {
+			return nil
+		}
+	}
+	index.Get("manifests").SetArrayItem(len(referrers), desc)
+	fmt.Printf("registry does not support the referrers API, updating tag %s\n", referrersTag(subjectDigest))
+	_, err = uploadManifest(image, referrersTag(subjectDigest), "application/vnd.oci.image.index.v1+json", index.MarshalTo(nil))
+	return
+}
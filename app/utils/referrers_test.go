@@ -0,0 +1,119 @@
+package utils_test
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_IsReferrersUnsupported(t *testing.T) {
+	for _, code := range []int{400, 404, 405, 501} {
+		assert.True(t, utils.IsReferrersUnsupported(code), code)
+	}
+	for _, code := range []int{200, 401, 403, 429, 500, 502} {
+		assert.False(t, utils.IsReferrersUnsupported(code), code)
+	}
+}
+
+// 捕获 f 输出到标准输出的内容
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+	}()
+	output := make(chan string)
+	go func() {
+		content, _ := io.ReadAll(r)
+		output <- string(content)
+	}()
+	f()
+	w.Close()
+	return <-output
+}
+
+// 模拟只支持 referrers tag 的仓库，referrers API 返回 referrersStatus
+func newReferrersRegistry(t *testing.T, referrersStatus int, manifestStatus int) *httptest.Server {
+	manifest := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json", "config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:1", "size": 1}, "layers": []}`
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))
+	index := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": [
+		{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:2", "size": 2, "artifactType": "application/spdx+json"}
+	]}`
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			fmt.Fprint(w, `{"token": "tok"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.Header().Set("www-authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+			w.WriteHeader(401)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/t/app/manifests/1":
+			if manifestStatus != 200 {
+				w.WriteHeader(manifestStatus)
+				fmt.Fprint(w, "registry is broken")
+				return
+			}
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			fmt.Fprint(w, manifest)
+		case "/v2/t/app/referrers/" + digest:
+			w.WriteHeader(referrersStatus)
+		case "/v2/t/app/manifests/" + strings.Replace(digest, ":", "-", 1):
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			fmt.Fprint(w, index)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	return server
+}
+
+func Test_ListReferrersFallback(t *testing.T) {
+	// 不支持 referrers API 时读取 referrers tag，--json 的输出只包含 index
+	for _, status := range []int{400, 404, 405, 501} {
+		server := newReferrersRegistry(t, status, 200)
+		image := utils.NewImage(strings.TrimPrefix(server.URL, "http://")+"/t/app:1", "", "", true, "", "linux", "amd64", "")
+		var err error
+		output := captureStdout(t, func() {
+			err = utils.ListReferrers(&image, utils.ReferrersOptions{Json: true})
+		})
+		server.Close()
+		assert.NoError(t, err, status)
+		assert.JSONEq(t, `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": [
+			{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:2", "size": 2, "artifactType": "application/spdx+json"}
+		]}`, output, status)
+	}
+
+	// 其他错误不回退到 referrers tag
+	server := newReferrersRegistry(t, 500, 200)
+	image := utils.NewImage(strings.TrimPrefix(server.URL, "http://")+"/t/app:1", "", "", true, "", "linux", "amd64", "")
+	assert.Error(t, utils.ListReferrers(&image, utils.ReferrersOptions{Json: true}))
+	server.Close()
+}
+
+func Test_FetchManifestError(t *testing.T) {
+	// 仓库返回的错误信息包含在 error 中，不输出到标准输出
+	server := newReferrersRegistry(t, 404, 500)
+	defer server.Close()
+	image := utils.NewImage(strings.TrimPrefix(server.URL, "http://")+"/t/app:1", "", "", true, "", "linux", "amd64", "")
+	var err error
+	output := captureStdout(t, func() {
+		err = utils.ListReferrers(&image, utils.ReferrersOptions{Json: true})
+	})
+	assert.Empty(t, output)
+	assert.ErrorContains(t, err, "status 500: registry is broken")
+}
@@ -0,0 +1,265 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 与 containers/storage 和 fuse-overlayfs 使用的 xattr 一致，格式为 uid:gid:mode:type
+const overrideStatXattr = "user.containers.override_stat"
+
+// 镜像中文件的属主和权限
+type fileStat struct {
+	typ string					// file, dir, symlink, pipe, char, block
+	uid int
+	gid int
+	mode int64					// 包含 setuid/setgid/sticky 的权限位
+	link string
+	major int64
+	minor int64
+	modTime time.Time
+}
+
+func headerStat(header *tar.Header) *fileStat {
+	stat := &fileStat{
+		typ: "file",
+		uid: header.Uid,
+		gid: header.Gid,
+		mode: header.Mode & 07777,
+		major: header.Devmajor,
+		minor: header.Devminor,
+		modTime: header.ModTime,
+	}
+	switch header.Typeflag {
+	case tar.TypeDir:
+		stat.typ = "dir"
+	case tar.TypeSymlink:
+		stat.typ = "symlink"
+		stat.link = header.Linkname
+	case tar.TypeFifo:
+		stat.typ = "pipe"
+	case tar.TypeChar:
+		stat.typ = "char"
+	case tar.TypeBlock:
+		stat.typ = "block"
+	}
+	return stat
+}
+
+func formatOverrideStat(stat *fileStat) string {
+	typ := stat.typ
+	if typ == "char" || typ == "block" {
+		typ = fmt.Sprintf("%s-%d-%d", typ, stat.major, stat.minor)
+	}
+	return fmt.Sprintf("%d:%d:0%o:%s", stat.uid, stat.gid, stat.mode, typ)
+}
+
+// 无 root 权限时不修改属主，将属主和权限记录在 xattr 或 sidecar 文件中
+func (u *unpacker) applyRootlessMetadata(header *tar.Header, filename string, mode fs.FileMode) error {
+	stat := headerStat(header)
+	if err := u.applyXattrs(header, filename); err != nil {
+		return err
+	}
+
+	if header.Typeflag == tar.TypeSymlink {
+		lutimes(filename, header.ModTime)
+	} else {
+		// 当前用户需要能够读写这些文件，真实的权限记录在 xattr 或 sidecar 中
+		realMode := mode.Perm() | 0600
+		if header.Typeflag == tar.TypeDir {
+			realMode |= 0700
+		}
+		if err := os.Chmod(filename, realMode); err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeDir {
+			os.Chtimes(filename, header.ModTime, header.ModTime)
+		}
+	}
+
+	switch u.rootless {
+	case "xattr":
+		if header.Typeflag == tar.TypeSymlink {
+			// Linux 不允许在符号链接上设置 user.* 的 xattr
+			return nil
+		}
+		if err := lsetxattr(filename, overrideStatXattr, []byte(formatOverrideStat(stat))); err != nil {
+			if errors.Is(err, errors.ErrUnsupported) {
+				return fmt.Errorf("set %s: filesystem does not support user xattrs, use --rootless=sidecar instead", overrideStatXattr)
+			}
+			return err
+		}
+	case "sidecar":
+		u.stats[u.relativePath(filename)] = stat
+	}
+	return nil
+}
+
+func (u *unpacker) relativePath(filename string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(filename, strings.TrimSuffix(u.rootfs, "/")), "/")
+}
+
+// 文件被删除时，同时删除 sidecar 中的记录
+func (u *unpacker) forgetStat(filename string, recursive bool) {
+	if u.rootless != "sidecar" {
+		return
+	}
+	name := u.relativePath(filename)
+	delete(u.stats, name)
+	if recursive {
+		for key := range u.stats {
+			if strings.HasPrefix(key, name + "/") {
+				delete(u.stats, key)
+			}
+		}
+	}
+}
+
+// 硬链接与目标文件的属性相同
+func (u *unpacker) linkStat(filename string, linkFilename string) {
+	if u.rootless != "sidecar" {
+		return
+	}
+	if stat, ok := u.stats[u.relativePath(linkFilename)]; ok {
+		u.stats[u.relativePath(filename)] = stat
+	}
+}
+
+// 按 mtree 格式写入 sidecar 文件，可以通过 bsdtar -cf image.tar @rootfs.mtree 打包为属主正确的 tar
+func writeMtree(filename string, stats map[string]*fileStat) error {
+	fp, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := bufio.NewWriter(fp)
+	fmt.Fprintln(w, "#mtree")
+	for _, name := range names {
+		stat := stats[name]
+		typ := stat.typ
+		if typ == "symlink" {
+			typ = "link"
+		} else if typ == "pipe" {
+			typ = "fifo"
+		}
+		fmt.Fprintf(w, "./%s type=%s uid=%d gid=%d mode=%04o time=%d.%09d", mtreeEscape(name), typ, stat.uid, stat.gid, stat.mode, stat.modTime.Unix(), stat.modTime.Nanosecond())
+		switch stat.typ {
+		case "symlink":
+			fmt.Fprintf(w, " link=%s", mtreeEscape(stat.link))
+		case "char", "block":
+			fmt.Fprintf(w, " device=native,%d,%d", stat.major, stat.minor)
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+// mtree 中的路径使用 vis 编码：空白、反斜杠、# 和不可打印字符编码为 \ooo
+func mtreeEscape(name string) string {
+	var buff strings.Builder
+	for _, b := range []byte(name) {
+		if b <= ' ' || b >= 0x7f || b == '\\' || b == '#' {
+			fmt.Fprintf(&buff, "\\%03o", b)
+		} else {
+			buff.WriteByte(b)
+		}
+	}
+	return buff.String()
+}
+
+// ==================== subuid/subgid 映射 ====================
+type subIDMap struct {
+	uid int
+	gid int
+	uidStart int
+	uidCount int
+	gidStart int
+	gidCount int
+}
+
+// 读取用户在 /etc/subuid 和 /etc/subgid 中的范围，映射方式与 rootless podman 相同：
+// 容器内的 0 映射为用户本身，1..count 映射为 start..start+count-1
+func loadSubIDMap(username string) (*subIDMap, error) {
+	var u *user.User
+	var err error
+	if _, e := strconv.Atoi(username); e == nil {
+		u, err = user.LookupId(username)
+	} else {
+		u, err = user.Lookup(username)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &subIDMap{}
+	if m.uid, err = strconv.Atoi(u.Uid); err != nil {
+		return nil, err
+	}
+	if m.gid, err = strconv.Atoi(u.Gid); err != nil {
+		return nil, err
+	}
+	if m.uidStart, m.uidCount, err = readSubIDFile("/etc/subuid", u); err != nil {
+		return nil, err
+	}
+	if m.gidStart, m.gidCount, err = readSubIDFile("/etc/subgid", u); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func readSubIDFile(filename string, u *user.User) (start int, count int, err error) {
+	var content []byte
+	if content, err = os.ReadFile(filename); err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.Split(strings.TrimSpace(line), ":")
+		if len(parts) != 3 || (parts[0] != u.Username && parts[0] != u.Uid) {
+			continue
+		}
+		if start, err = strconv.Atoi(parts[1]); err != nil {
+			return
+		}
+		count, err = strconv.Atoi(parts[2])
+		return
+	}
+	err = fmt.Errorf("no range for user %s found in %s", u.Username, filename)
+	return
+}
+
+func (m *subIDMap) toHost(uid int, gid int) (int, int, error) {
+	hostUid, err := mapSubID(uid, m.uid, m.uidStart, m.uidCount)
+	if err != nil {
+		return 0, 0, fmt.Errorf("uid %w", err)
+	}
+	hostGid, err := mapSubID(gid, m.gid, m.gidStart, m.gidCount)
+	if err != nil {
+		return 0, 0, fmt.Errorf("gid %w", err)
+	}
+	return hostUid, hostGid, nil
+}
+func mapSubID(id int, self int, start int, count int) (int, error) {
+	if id == 0 {
+		return self, nil
+	}
+	if id < 0 || id > count {
+		return 0, fmt.Errorf("%d is outside of the subordinate id range (%d)", id, count)
+	}
+	return start + id - 1, nil
+}
@@ -0,0 +1,532 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"strconv"
+)
+
+// rpm 数据库中每个软件包保存为一个 rpm header，三种格式只是存放 header 的方式不同：
+// rpm 4.16 之前为 Berkeley DB 的 hash 格式（Packages），之后为 sqlite（rpmdb.sqlite），SUSE 使用 ndb（Packages.db）
+// 这里只读取存放 header 的记录，不依赖 librpm 或 sqlite；sqlite 的 WAL 中未 checkpoint 的修改会被忽略
+
+// rpm header 中的 tag 和数据类型
+// https://github.com/rpm-software-management/rpm/blob/master/include/rpm/rpmtag.h
+const (
+	rpmTagName    = 1000
+	rpmTagVersion = 1001
+	rpmTagRelease = 1002
+	rpmTagEpoch   = 1003
+	rpmTagLicense = 1014
+	rpmTagArch    = 1022
+
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18nString  = 9
+)
+
+// 解析 rpm 数据库，name 为镜像中的路径
+func parseRpmDatabase(name string, content []byte, location string) ([]sbomPackage, error) {
+	var blobs [][]byte
+	var err error
+	switch path.Base(name) {
+	case "rpmdb.sqlite":
+		blobs, err = readSqliteRpmdb(content)
+	case "Packages.db":
+		blobs, err = readNdbRpmdb(content)
+	default:
+		blobs, err = readBdbRpmdb(content)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	packages := []sbomPackage{}
+	for _, blob := range blobs {
+		item, err := parseRpmHeader(blob, location)
+		if err != nil {
+			return nil, err
+		}
+		// 导入的 GPG 公钥也保存为软件包
+		if item.Name != "gpg-pubkey" {
+			packages = append(packages, item)
+		}
+	}
+	return packages, nil
+}
+
+// 解析数据库中的 rpm header：<tag 数量> <数据长度> <tag 索引>... <数据>，均为大端序
+// https://rpm-software-management.github.io/rpm/manual/format_header.html
+func parseRpmHeader(blob []byte, location string) (sbomPackage, error) {
+	item := sbomPackage{Type: "rpm", Location: location}
+	if len(blob) < 8 {
+		return item, fmt.Errorf("rpm header is too short")
+	}
+	count := uint64(binary.BigEndian.Uint32(blob[0:4]))
+	dataSize := uint64(binary.BigEndian.Uint32(blob[4:8]))
+	if 8+count*16+dataSize > uint64(len(blob)) {
+		return item, fmt.Errorf("rpm header has %d tags and %d bytes of data, but only %d bytes", count, dataSize, len(blob))
+	}
+	data := blob[8+count*16 : 8+count*16+dataSize]
+
+	values := map[uint32]string{}
+	for idx := uint64(0); idx < count; idx++ {
+		entry := blob[8+idx*16 : 8+idx*16+16]
+		tag := binary.BigEndian.Uint32(entry[0:4])
+		dataType := binary.BigEndian.Uint32(entry[4:8])
+		offset := uint64(binary.BigEndian.Uint32(entry[8:12]))
+		if offset >= dataSize {
+			continue
+		}
+		switch tag {
+		case rpmTagName, rpmTagVersion, rpmTagRelease, rpmTagLicense, rpmTagArch:
+			if dataType != rpmTypeString && dataType != rpmTypeStringArray && dataType != rpmTypeI18nString {
+				continue
+			}
+			// 数组取第一个字符串
+			value := data[offset:]
+			if end := bytes.IndexByte(value, 0); end >= 0 {
+				value = value[:end]
+			}
+			values[tag] = string(value)
+		case rpmTagEpoch:
+			if dataType == rpmTypeInt32 && offset+4 <= dataSize {
+				values[tag] = strconv.FormatUint(uint64(binary.BigEndian.Uint32(data[offset:])), 10)
+			}
+		}
+	}
+	if len(values[rpmTagName]) == 0 {
+		return item, fmt.Errorf("rpm header without a name")
+	}
+
+	// 与 dpkg 相同，epoch 写在版本号之前：<epoch>:<version>-<release>
+	item.Name = values[rpmTagName]
+	item.Version = values[rpmTagVersion]
+	if len(values[rpmTagRelease]) > 0 {
+		item.Version += "-" + values[rpmTagRelease]
+	}
+	if epoch, exist := values[rpmTagEpoch]; exist {
+		item.Version = epoch + ":" + item.Version
+	}
+	item.Arch = values[rpmTagArch]
+	item.License = values[rpmTagLicense]
+	return item, nil
+}
+
+// ==================== Berkeley DB ====================
+// 只处理 hash 格式的 Packages：key 为软件包的序号，value 为 rpm header，header 总是保存在 overflow 页中
+// https://github.com/berkeleydb/libdb/blob/v5.3.28/src/dbinc/db_page.h
+const (
+	bdbHashMagic     = 0x061561
+	bdbPageHeader    = 26 // 页头的大小，之后为 hash 页的索引或 overflow 页的数据
+	bdbPageHash      = 13
+	bdbPageHashOld   = 2 // P_HASH_UNSORTED
+	bdbPageOverflow  = 7
+	bdbEntryOffPage  = 3
+	bdbMetaChecksum  = 0x01
+	bdbMaxPageSize   = 64 << 10
+	bdbMinPageSize   = 512
+	bdbOffPageLength = 12
+)
+
+func readBdbRpmdb(content []byte) ([][]byte, error) {
+	if len(content) < bdbMinPageSize {
+		return nil, fmt.Errorf("not a Berkeley DB file")
+	}
+	// 文件按写入时机器的字节序保存，根据 magic 判断
+	var order binary.ByteOrder = binary.LittleEndian
+	if order.Uint32(content[12:16]) != bdbHashMagic {
+		order = binary.BigEndian
+		if order.Uint32(content[12:16]) != bdbHashMagic {
+			return nil, fmt.Errorf("not a Berkeley DB hash file")
+		}
+	}
+	pageSize := int(order.Uint32(content[20:24]))
+	if pageSize < bdbMinPageSize || pageSize > bdbMaxPageSize || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("invalid Berkeley DB page size %d", pageSize)
+	}
+	if content[24] != 0 || content[26]&bdbMetaChecksum != 0 {
+		return nil, fmt.Errorf("encrypted or checksummed Berkeley DB is not supported")
+	}
+	pageCount := len(content) / pageSize
+
+	blobs := [][]byte{}
+	for pageNo := 1; pageNo < pageCount; pageNo++ {
+		page := content[pageNo*pageSize : (pageNo+1)*pageSize]
+		if page[25] != bdbPageHash && page[25] != bdbPageHashOld {
+			continue
+		}
+		// 索引为 key, value 交替的偏移量
+		entries := int(order.Uint16(page[20:22]))
+		if bdbPageHeader+entries*2 > pageSize {
+			return nil, fmt.Errorf("invalid Berkeley DB page %d", pageNo)
+		}
+		for idx := 1; idx < entries; idx += 2 {
+			offset := int(order.Uint16(page[bdbPageHeader+idx*2:]))
+			if offset >= pageSize {
+				return nil, fmt.Errorf("invalid Berkeley DB page %d", pageNo)
+			}
+			if page[offset] != bdbEntryOffPage {
+				// 序号为 0 的记录保存下一个序号，不是 rpm header
+				continue
+			}
+			if offset+bdbOffPageLength > pageSize {
+				return nil, fmt.Errorf("invalid Berkeley DB page %d", pageNo)
+			}
+			entry := page[offset : offset+bdbOffPageLength]
+			blob, err := readBdbOverflow(content, order, pageSize, order.Uint32(entry[4:8]), order.Uint32(entry[8:12]))
+			if err != nil {
+				return nil, err
+			}
+			blobs = append(blobs, blob)
+		}
+	}
+	return blobs, nil
+}
+
+// 按 next 指针读取 overflow 页，每页的数据长度保存在页头的 hf_offset 中
+func readBdbOverflow(content []byte, order binary.ByteOrder, pageSize int, pageNo uint32, length uint32) ([]byte, error) {
+	pageCount := uint32(len(content) / pageSize)
+	if length > uint32(len(content)) {
+		return nil, fmt.Errorf("invalid Berkeley DB overflow length %d", length)
+	}
+	blob := make([]byte, 0, length)
+	for count := uint32(0); pageNo != 0; count++ {
+		if pageNo >= pageCount || count >= pageCount {
+			return nil, fmt.Errorf("invalid Berkeley DB overflow page %d", pageNo)
+		}
+		page := content[int(pageNo)*pageSize : int(pageNo+1)*pageSize]
+		size := int(order.Uint16(page[22:24]))
+		if page[25] != bdbPageOverflow || bdbPageHeader+size > pageSize {
+			return nil, fmt.Errorf("invalid Berkeley DB overflow page %d", pageNo)
+		}
+		blob = append(blob, page[bdbPageHeader:bdbPageHeader+size]...)
+		pageNo = order.Uint32(page[16:20])
+	}
+	if uint32(len(blob)) != length {
+		return nil, fmt.Errorf("Berkeley DB overflow has %d bytes, expected %d", len(blob), length)
+	}
+	return blob, nil
+}
+
+// ==================== ndb ====================
+// 文件头之后为固定大小的 slot，每个 slot 指向一个 blob，blob 的内容为 rpm header，均为小端序
+// https://github.com/rpm-software-management/rpm/blob/master/lib/backend/ndb/rpmpkg.c
+const (
+	ndbHeaderMagic = 'R' | 'p'<<8 | 'm'<<16 | 'P'<<24
+	ndbSlotMagic   = 'S' | 'l'<<8 | 'o'<<16 | 't'<<24
+	ndbBlobMagic   = 'B' | 'l'<<8 | 'b'<<16 | 'S'<<24
+	ndbHeaderSize  = 32
+	ndbSlotSize    = 16
+	ndbPageSize    = 4096
+	ndbBlockSize   = 16
+	ndbBlobHeader  = 16
+)
+
+func readNdbRpmdb(content []byte) ([][]byte, error) {
+	if len(content) < ndbHeaderSize || binary.LittleEndian.Uint32(content[0:4]) != ndbHeaderMagic {
+		return nil, fmt.Errorf("not an ndb file")
+	}
+	slotsEnd := uint64(binary.LittleEndian.Uint32(content[12:16])) * ndbPageSize
+	if slotsEnd > uint64(len(content)) {
+		return nil, fmt.Errorf("ndb has %d bytes of slots, but only %d bytes", slotsEnd, len(content))
+	}
+
+	blobs := [][]byte{}
+	for offset := uint64(ndbHeaderSize); offset+ndbSlotSize <= slotsEnd; offset += ndbSlotSize {
+		slot := content[offset : offset+ndbSlotSize]
+		if binary.LittleEndian.Uint32(slot[0:4]) != ndbSlotMagic {
+			return nil, fmt.Errorf("invalid ndb slot at %d", offset)
+		}
+		index := binary.LittleEndian.Uint32(slot[4:8])
+		if index == 0 {
+			// 空的 slot
+			continue
+		}
+		start := uint64(binary.LittleEndian.Uint32(slot[8:12])) * ndbBlockSize
+		if start+ndbBlobHeader > uint64(len(content)) {
+			return nil, fmt.Errorf("invalid ndb blob offset %d for package %d", start, index)
+		}
+		head := content[start : start+ndbBlobHeader]
+		if binary.LittleEndian.Uint32(head[0:4]) != ndbBlobMagic || binary.LittleEndian.Uint32(head[4:8]) != index {
+			return nil, fmt.Errorf("invalid ndb blob for package %d", index)
+		}
+		length := uint64(binary.LittleEndian.Uint32(head[12:16]))
+		if start+ndbBlobHeader+length > uint64(len(content)) {
+			return nil, fmt.Errorf("ndb blob for package %d has %d bytes, but only %d bytes", index, length, uint64(len(content))-start-ndbBlobHeader)
+		}
+		blobs = append(blobs, content[start+ndbBlobHeader:start+ndbBlobHeader+length])
+	}
+	return blobs, nil
+}
+
+// ==================== sqlite ====================
+// 读取 Packages 表（hnum INTEGER PRIMARY KEY, blob BLOB）的 table b-tree
+// https://www.sqlite.org/fileformat2.html
+const (
+	sqliteHeaderSize    = 100
+	sqlitePageInterior  = 5
+	sqlitePageLeaf      = 13
+	sqliteMaxTreeDepth  = 32
+	sqliteSchemaRootNum = 1
+)
+
+type sqliteFile struct {
+	content    []byte
+	pageSize   int
+	usableSize int
+}
+
+func readSqliteRpmdb(content []byte) ([][]byte, error) {
+	if len(content) < sqliteHeaderSize || !bytes.HasPrefix(content, []byte("SQLite format 3\x00")) {
+		return nil, fmt.Errorf("not a sqlite file")
+	}
+	pageSize := int(binary.BigEndian.Uint16(content[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("invalid sqlite page size %d", pageSize)
+	}
+	db := &sqliteFile{content: content, pageSize: pageSize, usableSize: pageSize - int(content[20])}
+	if db.usableSize < 480 {
+		return nil, fmt.Errorf("invalid sqlite reserved size %d", content[20])
+	}
+
+	// sqlite_schema 的列为 type, name, tbl_name, rootpage, sql
+	var root int64
+	err := db.walkTable(sqliteSchemaRootNum, 0, map[int64]bool{}, func(payload []byte) error {
+		values, err := decodeSqliteRecord(payload)
+		if err != nil {
+			return err
+		}
+		if len(values) >= 4 && values[0] == "table" && values[1] == "Packages" {
+			root, _ = values[3].(int64)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if root <= 0 {
+		return nil, fmt.Errorf("table Packages is not found")
+	}
+
+	blobs := [][]byte{}
+	err = db.walkTable(root, 0, map[int64]bool{}, func(payload []byte) error {
+		values, err := decodeSqliteRecord(payload)
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			if blob, ok := value.([]byte); ok {
+				blobs = append(blobs, blob)
+				break
+			}
+		}
+		return nil
+	})
+	return blobs, err
+}
+
+func (db *sqliteFile) page(pageNo int64) ([]byte, error) {
+	if pageNo < 1 || pageNo > int64(len(db.content)/db.pageSize) {
+		return nil, fmt.Errorf("invalid sqlite page %d", pageNo)
+	}
+	return db.content[int(pageNo-1)*db.pageSize : int(pageNo)*db.pageSize], nil
+}
+
+// 按 rowid 顺序对 table b-tree 中的每条记录调用 visit
+// visited 记录已读取的页，损坏的数据库中 interior 页可能指向已读取的页，形成环
+func (db *sqliteFile) walkTable(pageNo int64, depth int, visited map[int64]bool, visit func(payload []byte) error) error {
+	if depth > sqliteMaxTreeDepth {
+		return fmt.Errorf("sqlite b-tree is too deep")
+	}
+	if visited[pageNo] {
+		return fmt.Errorf("sqlite page %d is referenced more than once", pageNo)
+	}
+	visited[pageNo] = true
+	page, err := db.page(pageNo)
+	if err != nil {
+		return err
+	}
+	headerOffset := 0
+	if pageNo == 1 {
+		headerOffset = sqliteHeaderSize
+	}
+	header := page[headerOffset:]
+	cellCount := int(binary.BigEndian.Uint16(header[3:5]))
+	headerSize := 8
+	if header[0] == sqlitePageInterior {
+		headerSize = 12
+	} else if header[0] != sqlitePageLeaf {
+		return fmt.Errorf("sqlite page %d is not a table b-tree page", pageNo)
+	}
+	if headerOffset+headerSize+cellCount*2 > len(page) {
+		return fmt.Errorf("invalid sqlite page %d", pageNo)
+	}
+
+	for idx := 0; idx < cellCount; idx++ {
+		offset := int(binary.BigEndian.Uint16(header[headerSize+idx*2:]))
+		if offset >= db.usableSize {
+			return fmt.Errorf("invalid sqlite cell on page %d", pageNo)
+		}
+		cell := page[offset:db.usableSize]
+		if header[0] == sqlitePageInterior {
+			// <左子页> <rowid>
+			if len(cell) < 4 {
+				return fmt.Errorf("invalid sqlite cell on page %d", pageNo)
+			}
+			if err = db.walkTable(int64(binary.BigEndian.Uint32(cell[0:4])), depth+1, visited, visit); err != nil {
+				return err
+			}
+			continue
+		}
+		payload, err := db.readPayload(cell)
+		if err != nil {
+			return fmt.Errorf("sqlite page %d: %w", pageNo, err)
+		}
+		if err = visit(payload); err != nil {
+			return err
+		}
+	}
+	if header[0] == sqlitePageInterior {
+		return db.walkTable(int64(binary.BigEndian.Uint32(header[8:12])), depth+1, visited, visit)
+	}
+	return nil
+}
+
+// 读取 table b-tree 叶子页中的记录：<记录长度> <rowid> <记录的前一部分> [<第一个 overflow 页>]
+func (db *sqliteFile) readPayload(cell []byte) ([]byte, error) {
+	size, n := sqliteVarint(cell)
+	if n == 0 {
+		return nil, fmt.Errorf("invalid cell")
+	}
+	_, m := sqliteVarint(cell[n:])
+	if m == 0 {
+		return nil, fmt.Errorf("invalid cell")
+	}
+	cell = cell[n+m:]
+	if size > uint64(len(db.content)) {
+		return nil, fmt.Errorf("record has %d bytes", size)
+	}
+
+	// 页内保存的长度，超过的部分保存在 overflow 页中
+	usable := uint64(db.usableSize)
+	local := size
+	if maxLocal := usable - 35; size > maxLocal {
+		minLocal := (usable-12)*32/255 - 23
+		local = minLocal + (size-minLocal)%(usable-4)
+		if local > maxLocal {
+			local = minLocal
+		}
+	}
+	if local == size {
+		if uint64(len(cell)) < size {
+			return nil, fmt.Errorf("truncated record")
+		}
+		return cell[:size], nil
+	}
+	if uint64(len(cell)) < local+4 {
+		return nil, fmt.Errorf("truncated record")
+	}
+	payload := make([]byte, 0, size)
+	payload = append(payload, cell[:local]...)
+	pageNo := int64(binary.BigEndian.Uint32(cell[local:]))
+	for count := 0; uint64(len(payload)) < size; count++ {
+		// overflow 页：<下一页> <数据>
+		page, err := db.page(pageNo)
+		if err != nil || count > len(db.content)/db.pageSize {
+			return nil, fmt.Errorf("invalid overflow page %d", pageNo)
+		}
+		chunk := page[4:db.usableSize]
+		if remaining := size - uint64(len(payload)); uint64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		payload = append(payload, chunk...)
+		pageNo = int64(binary.BigEndian.Uint32(page[0:4]))
+	}
+	return payload, nil
+}
+
+// 解析记录：<头部长度> <每列的类型>... <每列的值>...，每列为 nil, int64, uint64（浮点数的位模式）, string 或 []byte
+func decodeSqliteRecord(payload []byte) ([]interface{}, error) {
+	headerSize, n := sqliteVarint(payload)
+	if n == 0 || headerSize > uint64(len(payload)) {
+		return nil, fmt.Errorf("invalid sqlite record")
+	}
+	types := []uint64{}
+	for offset := uint64(n); offset < headerSize; {
+		value, m := sqliteVarint(payload[offset:headerSize])
+		if m == 0 {
+			return nil, fmt.Errorf("invalid sqlite record")
+		}
+		types = append(types, value)
+		offset += uint64(m)
+	}
+
+	values := []interface{}{}
+	data := payload[headerSize:]
+	for _, serialType := range types {
+		var size uint64
+		switch {
+		case serialType >= 12:
+			size = (serialType - 12) / 2
+		case serialType >= 1 && serialType <= 4:
+			size = serialType
+		case serialType == 5:
+			size = 6
+		case serialType == 6 || serialType == 7:
+			size = 8
+		}
+		if size > uint64(len(data)) {
+			return nil, fmt.Errorf("truncated sqlite record")
+		}
+		value := data[:size]
+		data = data[size:]
+		switch {
+		case serialType == 0:
+			values = append(values, nil)
+		case serialType <= 6:
+			// 大端序的有符号整数
+			var number int64
+			for idx, b := range value {
+				if idx == 0 {
+					number = int64(int8(b))
+				} else {
+					number = number<<8 | int64(b)
+				}
+			}
+			values = append(values, number)
+		case serialType == 7:
+			values = append(values, binary.BigEndian.Uint64(value))
+		case serialType == 8 || serialType == 9:
+			values = append(values, int64(serialType-8))
+		case serialType >= 12 && serialType%2 == 0:
+			values = append(values, value)
+		case serialType >= 13:
+			values = append(values, string(value))
+		default:
+			return nil, fmt.Errorf("invalid sqlite serial type %d", serialType)
+		}
+	}
+	return values, nil
+}
+
+// sqlite 的 varint：每字节 7 位，大端序，第 9 个字节使用全部 8 位
+func sqliteVarint(b []byte) (uint64, int) {
+	var value uint64
+	for idx := 0; idx < 9 && idx < len(b); idx++ {
+		if idx == 8 {
+			return value<<8 | uint64(b[idx]), 9
+		}
+		value = value<<7 | uint64(b[idx]&0x7f)
+		if b[idx]&0x80 == 0 {
+			return value, idx + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,371 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type SbomOptions struct {
+	Format string // spdx, cyclonedx
+	Output string // 输出文件，为空或 - 时输出到标准输出
+}
+
+// 软件包数据库和 Go 程序的最大读取大小
+const sbomMaxDatabaseSize = 64 << 20
+const sbomMaxBinarySize = 512 << 20
+
+// 从镜像最终的文件系统中读取软件包信息，生成 SPDX 或 CycloneDX 格式的 SBOM，不依赖任何外部服务
+func GenerateSbom(source string, image *Image, opts SbomOptions) (err error) {
+	src, err := loadSourceImage(source, image)
+	if err != nil {
+		return err
+	}
+	defer src.cleanup()
+
+	packages, release, err := scanPackages(src)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "found %d packages\n", len(packages))
+
+	var document interface{}
+	switch opts.Format {
+	case "", "spdx":
+		document = buildSpdx(source, packages, release)
+	case "cyclonedx":
+		document = buildCycloneDX(source, packages, release)
+	default:
+		return fmt.Errorf("unsupported sbom format %q", opts.Format)
+	}
+
+	var writer io.Writer = os.Stdout
+	if len(opts.Output) > 0 && opts.Output != "-" {
+		var file *os.File
+		if file, err = os.Create(opts.Output); err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(opts.Output)
+			}
+		}()
+		writer = file
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(document)
+}
+
+// 合并镜像的 layer，读取其中的软件包数据库、lock 文件和 Go 程序
+func scanPackages(src *sourceImage) ([]sbomPackage, *osRelease, error) {
+	packages := []sbomPackage{}
+	var release *osRelease
+	emit := func(header *tar.Header, r io.Reader) error {
+		if header.Typeflag != tar.TypeReg {
+			return nil
+		}
+		name := header.Name
+		location := "/" + name
+		switch {
+		case name == "etc/os-release" || (name == "usr/lib/os-release" && release == nil):
+			content, err := io.ReadAll(io.LimitReader(r, sbomMaxDatabaseSize))
+			if err != nil {
+				return err
+			}
+			release = parseOsRelease(content)
+		case isRpmDatabase(name):
+			// 截断的数据库无法解析，不能像其他文件一样只读取前面的部分
+			if header.Size > sbomMaxDatabaseSize {
+				return fmt.Errorf("rpm database %s has %d bytes, more than %d bytes", location, header.Size, sbomMaxDatabaseSize)
+			}
+			content, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			items, err := parseRpmDatabase(name, content, location)
+			if err != nil {
+				return fmt.Errorf("rpm database %s: %w", location, err)
+			}
+			packages = append(packages, items...)
+		case packageParser(name) != nil:
+			content, err := io.ReadAll(io.LimitReader(r, sbomMaxDatabaseSize))
+			if err != nil {
+				return err
+			}
+			packages = append(packages, packageParser(name)(content, location)...)
+		case header.Mode&0111 != 0 && header.Size > 4 && header.Size <= sbomMaxBinarySize:
+			// 可执行文件，检查是否为 Go 程序
+			magic := make([]byte, 4)
+			if _, err := io.ReadFull(r, magic); err != nil {
+				return err
+			}
+			if !isExecutableMagic(magic) {
+				return nil
+			}
+			content, err := io.ReadAll(io.MultiReader(bytes.NewReader(magic), r))
+			if err != nil {
+				return err
+			}
+			packages = append(packages, parseGoBinary(content, location)...)
+		}
+		return nil
+	}
+
+	err := src.flatten(emit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.Slice(packages, func(i, j int) bool {
+		a, b := packages[i], packages[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		return a.Location < b.Location
+	})
+	result := []sbomPackage{}
+	for idx, item := range packages {
+		if idx == 0 || item != packages[idx-1] {
+			result = append(result, item)
+		}
+	}
+	return result, release, nil
+}
+
+// ELF, PE, Mach-O
+func isExecutableMagic(magic []byte) bool {
+	return bytes.Equal(magic, []byte("\x7fELF")) || bytes.HasPrefix(magic, []byte("MZ")) ||
+		bytes.Equal(magic, []byte{0xfe, 0xed, 0xfa, 0xce}) || bytes.Equal(magic, []byte{0xfe, 0xed, 0xfa, 0xcf}) ||
+		bytes.Equal(magic, []byte{0xce, 0xfa, 0xed, 0xfe}) || bytes.Equal(magic, []byte{0xcf, 0xfa, 0xed, 0xfe})
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ==================== SPDX 2.3 ====================
+// https://spdx.github.io/spdx-spec/v2.3/
+type spdxDocument struct {
+	SpdxVersion       string                 `json:"spdxVersion"`
+	DataLicense       string                 `json:"dataLicense"`
+	SPDXID            string                 `json:"SPDXID"`
+	Name              string                 `json:"name"`
+	DocumentNamespace string                 `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo       `json:"creationInfo"`
+	Packages          []spdxPackage          `json:"packages"`
+	Relationships     []spdxRelationship     `json:"relationships"`
+	ExtractedLicenses []spdxExtractedLicense `json:"hasExtractedLicensingInfos,omitempty"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	CopyrightText    string            `json:"copyrightText"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	PrimaryPurpose   string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+// 不在 SPDX 许可证列表中的许可证
+type spdxExtractedLicense struct {
+	LicenseId     string `json:"licenseId"`
+	ExtractedText string `json:"extractedText"`
+	Name          string `json:"name"`
+}
+
+type spdxRelationship struct {
+	SpdxElementId      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSpdxElement string `json:"relatedSpdxElement"`
+}
+
+func buildSpdx(name string, packages []sbomPackage, release *osRelease) *spdxDocument {
+	document := &spdxDocument{
+		SpdxVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              name,
+		DocumentNamespace: fmt.Sprintf("https://spdx.org/spdxdocs/docker-pull-go/%s", newUUID()),
+		CreationInfo: spdxCreationInfo{
+			Created:  time.Now().UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: docker-pull-go"},
+		},
+	}
+	document.Packages = append(document.Packages, spdxPackage{
+		Name:             name,
+		SPDXID:           "SPDXRef-Image",
+		DownloadLocation: "NOASSERTION",
+		LicenseConcluded: "NOASSERTION",
+		LicenseDeclared:  "NOASSERTION",
+		CopyrightText:    "NOASSERTION",
+		PrimaryPurpose:   "CONTAINER",
+	})
+	document.Relationships = append(document.Relationships, spdxRelationship{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Image"})
+	if release != nil && len(release.ID) > 0 {
+		document.Packages = append(document.Packages, spdxPackage{
+			Name:             release.ID,
+			SPDXID:           "SPDXRef-OperatingSystem",
+			VersionInfo:      release.VersionID,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+			PrimaryPurpose:   "OPERATING-SYSTEM",
+		})
+		document.Relationships = append(document.Relationships, spdxRelationship{"SPDXRef-Image", "CONTAINS", "SPDXRef-OperatingSystem"})
+	}
+
+	var licenses spdxLicenseRefs
+	for idx, item := range packages {
+		id := fmt.Sprintf("SPDXRef-Package-%s-%d", item.Type, idx+1)
+		document.Packages = append(document.Packages, spdxPackage{
+			Name:             item.Name,
+			SPDXID:           id,
+			VersionInfo:      item.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  licenses.declared(item.License),
+			CopyrightText:    "NOASSERTION",
+			SourceInfo:       "found in " + item.Location,
+			PrimaryPurpose:   "LIBRARY",
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  item.purl(release),
+			}},
+		})
+		document.Relationships = append(document.Relationships, spdxRelationship{"SPDXRef-Image", "CONTAINS", id})
+	}
+	document.ExtractedLicenses = licenses.infos
+	return document
+}
+
+// ==================== CycloneDX 1.5 ====================
+// https://cyclonedx.org/docs/1.5/json/
+type cyclonedxDocument struct {
+	BomFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Version      int                  `json:"version"`
+	Metadata     cyclonedxMetadata    `json:"metadata"`
+	Components   []cyclonedxComponent `json:"components"`
+}
+
+type cyclonedxMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     []cyclonedxTool    `json:"tools"`
+	Component cyclonedxComponent `json:"component"`
+}
+
+type cyclonedxTool struct {
+	Name string `json:"name"`
+}
+
+type cyclonedxComponent struct {
+	BomRef     string              `json:"bom-ref,omitempty"`
+	Type       string              `json:"type"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	Purl       string              `json:"purl,omitempty"`
+	Licenses   []cyclonedxLicense  `json:"licenses,omitempty"`
+	Properties []cyclonedxProperty `json:"properties,omitempty"`
+}
+
+type cyclonedxLicense struct {
+	License    *cyclonedxLicenseName `json:"license,omitempty"`
+	Expression string                `json:"expression,omitempty"`
+}
+
+type cyclonedxLicenseName struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type cyclonedxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func buildCycloneDX(name string, packages []sbomPackage, release *osRelease) *cyclonedxDocument {
+	document := &cyclonedxDocument{
+		BomFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Metadata: cyclonedxMetadata{
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Tools:     []cyclonedxTool{{Name: "docker-pull-go"}},
+			Component: cyclonedxComponent{BomRef: "image", Type: "container", Name: name},
+		},
+		Components: []cyclonedxComponent{},
+	}
+	if release != nil && len(release.ID) > 0 {
+		document.Components = append(document.Components, cyclonedxComponent{
+			BomRef:  "os:" + release.ID,
+			Type:    "operating-system",
+			Name:    release.ID,
+			Version: release.VersionID,
+		})
+	}
+	for _, item := range packages {
+		purl := item.purl(release)
+		component := cyclonedxComponent{
+			BomRef:  purl + "#" + item.Location,
+			Type:    "library",
+			Name:    item.Name,
+			Version: item.Version,
+			Purl:    purl,
+			Properties: []cyclonedxProperty{{
+				Name:  "docker-pull-go:location",
+				Value: item.Location,
+			}},
+		}
+		// 合法的 SPDX 表达式使用 id 或 expression，其他的作为名称
+		if expression, ok := normalizeSpdxLicense(item.License); ok && strings.ContainsAny(expression, " ()+") {
+			component.Licenses = []cyclonedxLicense{{Expression: expression}}
+		} else if ok {
+			component.Licenses = []cyclonedxLicense{{License: &cyclonedxLicenseName{ID: expression}}}
+		} else if len(strings.TrimSpace(item.License)) > 0 {
+			component.Licenses = []cyclonedxLicense{{License: &cyclonedxLicenseName{Name: item.License}}}
+		}
+		document.Components = append(document.Components, component)
+	}
+	return document
+}
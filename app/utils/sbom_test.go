@@ -0,0 +1,314 @@
+package utils_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+type rpmTag struct {
+	tag      uint32
+	dataType uint32
+	value    interface{} // string, []string 或 uint32
+}
+
+// 生成 rpm header：<tag 数量> <数据长度> <tag 索引>... <数据>
+func buildRpmHeader(tags []rpmTag) []byte {
+	entries := []byte{}
+	data := []byte{}
+	for _, item := range tags {
+		count := 1
+		if item.dataType == 4 {
+			for len(data)%4 != 0 {
+				data = append(data, 0)
+			}
+		}
+		offset := len(data)
+		switch value := item.value.(type) {
+		case string:
+			data = append(append(data, value...), 0)
+		case []string:
+			for _, text := range value {
+				data = append(append(data, text...), 0)
+			}
+			count = len(value)
+		case uint32:
+			data = binary.BigEndian.AppendUint32(data, value)
+		}
+		entries = binary.BigEndian.AppendUint32(entries, item.tag)
+		entries = binary.BigEndian.AppendUint32(entries, item.dataType)
+		entries = binary.BigEndian.AppendUint32(entries, uint32(offset))
+		entries = binary.BigEndian.AppendUint32(entries, uint32(count))
+	}
+	header := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	header = binary.BigEndian.AppendUint32(header, uint32(len(data)))
+	return append(append(header, entries...), data...)
+}
+
+func buildRpmPackage(name string, version string, release string, arch string, license string) []byte {
+	return buildRpmHeader([]rpmTag{
+		{1000, 6, name},
+		{1001, 6, version},
+		{1002, 6, release},
+		{1117, 8, []string{"/usr/bin/" + name, "/usr/lib/" + name}},
+		{1022, 6, arch},
+		{1014, 6, license},
+	})
+}
+
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// 生成 Berkeley DB 的 hash 文件：第 0 页为 meta，第 1 页为 hash 页，之后为保存 header 的 overflow 页
+func buildBdb(order byteOrder, blobs [][]byte) []byte {
+	const pageSize = 512
+	pages := [][]byte{make([]byte, pageSize), make([]byte, pageSize)}
+	order.PutUint32(pages[0][12:], 0x061561)
+	order.PutUint32(pages[0][20:], pageSize)
+	pages[0][25] = 8
+
+	hash := pages[1]
+	hash[25] = 13
+	items := [][]byte{}
+	// 序号为 0 的记录不是 rpm header
+	items = append(items, append([]byte{1}, order.AppendUint32(nil, 0)...), append([]byte{1}, order.AppendUint32(nil, uint32(len(blobs)+1))...))
+	for idx, blob := range blobs {
+		first := len(pages)
+		for offset := 0; offset < len(blob); offset += pageSize - 26 {
+			page := make([]byte, pageSize)
+			page[25] = 7
+			chunk := blob[offset:min(offset+pageSize-26, len(blob))]
+			copy(page[26:], chunk)
+			order.PutUint16(page[22:], uint16(len(chunk)))
+			if offset+pageSize-26 < len(blob) {
+				order.PutUint32(page[16:], uint32(len(pages)+1))
+			}
+			pages = append(pages, page)
+		}
+		value := []byte{3, 0, 0, 0}
+		value = order.AppendUint32(value, uint32(first))
+		value = order.AppendUint32(value, uint32(len(blob)))
+		items = append(items, append([]byte{1}, order.AppendUint32(nil, uint32(idx+1))...), value)
+	}
+	end := pageSize
+	for idx, item := range items {
+		end -= len(item)
+		copy(hash[end:], item)
+		order.PutUint16(hash[26+idx*2:], uint16(end))
+	}
+	order.PutUint16(hash[20:], uint16(len(items)))
+	content := []byte{}
+	for _, page := range pages {
+		content = append(content, page...)
+	}
+	return content
+}
+
+// 生成 ndb 文件：32 字节的文件头，之后一页为 slot，blob 按 16 字节对齐
+func buildNdb(blobs [][]byte) []byte {
+	content := make([]byte, 4096)
+	copy(content, "RpmP")
+	binary.LittleEndian.PutUint32(content[12:], 1)
+	for offset := 32; offset < 4096; offset += 16 {
+		copy(content[offset:], "Slot")
+	}
+	for idx, blob := range blobs {
+		// 每两个 slot 使用一个，另一个为空
+		slot := content[32+idx*2*16:]
+		binary.LittleEndian.PutUint32(slot[4:], uint32(idx+1))
+		binary.LittleEndian.PutUint32(slot[8:], uint32(len(content)/16))
+		binary.LittleEndian.PutUint32(slot[12:], uint32((16+len(blob)+12+15)/16))
+		// blob 头部，blob，12 字节的尾部，按 16 字节对齐
+		content = append(content, "BlbS"...)
+		content = binary.LittleEndian.AppendUint32(content, uint32(idx+1))
+		content = binary.LittleEndian.AppendUint32(content, 0)
+		content = binary.LittleEndian.AppendUint32(content, uint32(len(blob)))
+		content = append(content, blob...)
+		content = append(content, make([]byte, 12)...)
+		content = append(content, make([]byte, (16-len(content)%16)%16)...)
+	}
+	return content
+}
+
+func Test_ParseRpmDatabase(t *testing.T) {
+	bash := buildRpmPackage("bash", "5.1.8", "6.el9", "x86_64", "GPLv3+")
+	openssl := buildRpmHeader([]rpmTag{
+		{1000, 6, "openssl-libs"},
+		{1003, 4, uint32(1)},
+		{1001, 6, "3.0.7"},
+		{1002, 6, "24.el9"},
+		{1022, 6, "x86_64"},
+		{1014, 6, "ASL 2.0"},
+	})
+	pubkey := buildRpmPackage("gpg-pubkey", "fd431d51", "4ae0493b", "(none)", "pubkey")
+	// 超过多个 overflow 页
+	large := buildRpmPackage("large", "1.0", "1", "noarch", strings.Repeat("x", 1500))
+	expected := []string{
+		"bash 5.1.8-6.el9 x86_64 GPLv3+",
+		"openssl-libs 1:3.0.7-24.el9 x86_64 ASL 2.0",
+		"large 1.0-1 noarch " + strings.Repeat("x", 1500),
+	}
+	blobs := [][]byte{bash, openssl, pubkey, large}
+
+	for _, order := range []byteOrder{binary.LittleEndian, binary.BigEndian} {
+		packages, err := utils.ParseRpmDatabase("var/lib/rpm/Packages", buildBdb(order, blobs))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, packages)
+	}
+	packages, err := utils.ParseRpmDatabase("usr/lib/sysimage/rpm/Packages.db", buildNdb(blobs))
+	assert.NoError(t, err)
+	assert.Equal(t, expected, packages)
+
+	// 使用 sqlite 生成，page_size 为 512，包含 interior 页和 overflow 页
+	content, err := os.ReadFile("testdata/rpmdb.sqlite")
+	assert.NoError(t, err)
+	packages, err = utils.ParseRpmDatabase("var/lib/rpm/rpmdb.sqlite", content)
+	assert.NoError(t, err)
+	assert.Len(t, packages, 33)
+	assert.Equal(t, "bash 5.2.15-3.fc38 x86_64 GPL-3.0-or-later", packages[0])
+	assert.Equal(t, "openssl-libs 1:3.0.9-2.fc38 x86_64 Apache-2.0", packages[1])
+	assert.Equal(t, "big 1.0-1 noarch MIT and "+strings.Repeat("x", 2000), packages[2])
+	assert.Equal(t, "filler29 1.29-1 noarch MIT", packages[32])
+
+	// interior 页的子页指向自己，形成环
+	cyclic := make([]byte, 512)
+	copy(cyclic, "SQLite format 3\x00")
+	binary.BigEndian.PutUint16(cyclic[16:], 512)
+	cyclic[100] = 5
+	binary.BigEndian.PutUint16(cyclic[103:], 4)
+	binary.BigEndian.PutUint32(cyclic[108:], 1)
+	for idx := 0; idx < 4; idx++ {
+		binary.BigEndian.PutUint16(cyclic[112+idx*2:], 200)
+	}
+	binary.BigEndian.PutUint32(cyclic[200:], 1)
+	cyclic[204] = 1
+	_, err = utils.ParseRpmDatabase("var/lib/rpm/rpmdb.sqlite", cyclic)
+	assert.ErrorContains(t, err, "referenced more than once")
+
+	// 无法解析时返回错误，而不是输出不完整的 SBOM
+	for _, c := range []struct {
+		name    string
+		content []byte
+	}{
+		{"var/lib/rpm/rpmdb.sqlite", []byte("not a database")},
+		{"var/lib/rpm/rpmdb.sqlite", content[:1024]},
+		{"var/lib/rpm/Packages", make([]byte, 4096)},
+		{"var/lib/rpm/Packages", buildBdb(binary.LittleEndian, blobs)[:1536]},
+		{"var/lib/rpm/Packages.db", buildNdb(blobs)[:4200]},
+		{"var/lib/rpm/Packages.db", buildNdb([][]byte{bash[:20]})},
+	} {
+		_, err := utils.ParseRpmDatabase(c.name, c.content)
+		assert.Error(t, err, c.name)
+	}
+}
+
+// etc/os-release 优先于 usr/lib/os-release，与文件在 layer 中的顺序无关
+func Test_ScanOsRelease(t *testing.T) {
+	etc := tarItem{name: "etc/os-release", content: "ID=etc\n"}
+	usr := tarItem{name: "usr/lib/os-release", content: "ID=usr\n"}
+	source := path.Join(t.TempDir(), "image.tar")
+	for _, layers := range [][][]tarItem{
+		{{etc, usr}},
+		{{usr, etc}},
+		{{etc}, {usr}},
+		{{usr}, {etc}},
+	} {
+		items := []tarItem{}
+		names := []string{}
+		diffIDs := []string{}
+		for idx, layer := range layers {
+			name := fmt.Sprintf("%d/layer.tar", idx)
+			items = append(items, tarItem{name: name, content: string(buildTar(t, layer))})
+			names = append(names, `"`+name+`"`)
+			diffIDs = append(diffIDs, fmt.Sprintf(`"sha256:%d"`, idx))
+		}
+		items = append(items,
+			tarItem{name: "config.json", content: `{"os": "linux", "rootfs": {"type": "layers", "diff_ids": [` + strings.Join(diffIDs, ",") + `]}}`},
+			tarItem{name: "manifest.json", content: `[{"Config": "config.json", "Layers": [` + strings.Join(names, ",") + `]}]`},
+		)
+		assert.NoError(t, os.WriteFile(source, buildTar(t, items), 0644))
+		id, err := utils.ScanOsRelease(source)
+		assert.NoError(t, err)
+		assert.Equal(t, "etc", id, layers)
+	}
+}
+
+func Test_PackagePurl(t *testing.T) {
+	cases := []struct {
+		packageType, name, version, arch, osID, osVersion string
+		expected                                          string
+	}{
+		{"rpm", "openssl-libs", "1:3.0.7-24.el9", "x86_64", "rhel", "9.3", "pkg:rpm/rhel/openssl-libs@3.0.7-24.el9?arch=x86_64&distro=rhel-9.3&epoch=1"},
+		{"rpm", "bash", "5.1.8-6.el9", "x86_64", "", "", "pkg:rpm/rpm/bash@5.1.8-6.el9?arch=x86_64"},
+		{"deb", "libc6", "2.36-9+deb12u4", "amd64", "debian", "12", "pkg:deb/debian/libc6@2.36-9+deb12u4?arch=amd64&distro=debian-12"},
+		{"golang", "github.com/valyala/fastjson", "v1.6.4", "", "", "", "pkg:golang/github.com/valyala/fastjson@v1.6.4"},
+		{"npm", "@babel/core", "7.24.0", "", "", "", "pkg:npm/%40babel/core@7.24.0"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, utils.PackagePurl(c.packageType, c.name, c.version, c.arch, c.osID, c.osVersion))
+	}
+}
+
+func Test_NormalizeSpdxLicense(t *testing.T) {
+	cases := []struct {
+		license  string
+		expected string
+		valid    bool
+	}{
+		{"MIT", "MIT", true},
+		{"mit", "MIT", true},
+		{"Apache-2.0 OR MIT", "Apache-2.0 OR MIT", true},
+		{"(MIT or apache-2.0) AND BSD-3-Clause", "(MIT OR Apache-2.0) AND BSD-3-Clause", true},
+		{"GPL-2.0-or-later WITH Classpath-exception-2.0", "GPL-2.0-or-later WITH Classpath-exception-2.0", true},
+		{"GPL-2.0+", "GPL-2.0+", true},
+		{"", "", false},
+		{"BSD License", "", false},
+		{"Apache Software License", "", false},
+		{"GPLv2+", "", false},
+		{"MIT AND", "", false},
+		{"(MIT", "", false},
+		{"MIT)", "", false},
+		{"MIT WITH", "", false},
+		{"MIT WITH Foo-exception", "", false},
+		{"LicenseRef-custom", "", false},
+	}
+	for _, c := range cases {
+		expression, valid := utils.NormalizeSpdxLicense(c.license)
+		assert.Equal(t, c.valid, valid, c.license)
+		assert.Equal(t, c.expected, expression, c.license)
+	}
+}
+
+func Test_SbomLicenses(t *testing.T) {
+	licenses := []string{"", "MIT", "BSD License", "bsd-3-clause", "BSD License", "BSD-License", "Copyright (c) Someone\nAll rights reserved."}
+	declared, extracted := utils.SpdxLicenses(licenses)
+	assert.Equal(t, []string{
+		"NOASSERTION",
+		"MIT",
+		"LicenseRef-BSD-License",
+		"BSD-3-Clause",
+		"LicenseRef-BSD-License",
+		"LicenseRef-BSD-License-2",
+		"LicenseRef-Copyright-c-Someone-All-rights-reserved.",
+	}, declared)
+	assert.Equal(t, map[string]string{
+		"LicenseRef-BSD-License":                              "BSD License",
+		"LicenseRef-BSD-License-2":                            "BSD-License",
+		"LicenseRef-Copyright-c-Someone-All-rights-reserved.": "Copyright (c) Someone\nAll rights reserved.",
+	}, extracted)
+
+	assert.Equal(t, []string{
+		"null",
+		`[{"license":{"id":"MIT"}}]`,
+		`[{"expression":"MIT OR Apache-2.0"}]`,
+		`[{"license":{"name":"BSD License"}}]`,
+	}, utils.CycloneDXLicenses([]string{"", "mit", "MIT or Apache-2.0", "BSD License"}))
+}
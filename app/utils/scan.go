@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type FindImagesOptions struct {
+	Output      string      // 将找到的镜像写入列表文件，可用于 pull --list 和 lock
+	Pull        string      // 将找到的镜像下载到该目录
+	Concurrency int         // 同时下载的镜像数量
+	PullOptions PullOptions // 下载镜像的参数
+}
+
+// kubernetes Pod spec 中包含 image 的字段
+var podContainerKeys = []string{"containers", "initContainers", "ephemeralContainers"}
+
+// 从 kubernetes manifest 和 docker compose 文件中查找使用的镜像，规范化并去重
+func FindImages(image *Image, paths []string, opts FindImagesOptions) error {
+	sources := map[string][]string{} // 镜像 -> 所在的文件和行
+	add := func(value string, source string) {
+		value = strings.TrimSpace(value)
+		if len(value) == 0 || strings.Contains(value, "{{") || strings.Contains(value, "$") || strings.HasSuffix(value, ":") {
+			fmt.Fprintf(os.Stderr, "warning: %s: skip unresolved image %q\n", source, value)
+			return
+		}
+		var found Image
+		found.ParseImage(value)
+		reference := found.Reference()
+		sources[reference] = append(sources[reference], source)
+	}
+
+	for _, root := range paths {
+		info, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			if err = scanYamlFile(root, add); err != nil {
+				return err
+			}
+			continue
+		}
+		err = filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				if name != root && strings.HasPrefix(entry.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if ext := filepath.Ext(name); ext != ".yaml" && ext != ".yml" {
+				return nil
+			}
+			return scanYamlFile(name, add)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	references := make([]string, 0, len(sources))
+	for reference := range sources {
+		references = append(references, reference)
+	}
+	sort.Strings(references)
+	for _, reference := range references {
+		fmt.Printf("%s\t%s\n", reference, strings.Join(sources[reference], ", "))
+	}
+	fmt.Printf("%d images found\n", len(references))
+
+	if len(opts.Output) > 0 {
+		content := fmt.Sprintf("# images found in %s\n%s\n", strings.Join(paths, " "), strings.Join(references, "\n"))
+		if err := os.WriteFile(opts.Output, []byte(content), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("image list written to %s\n", opts.Output)
+	}
+	if len(opts.Pull) > 0 && len(references) > 0 {
+		entries := []imageListEntry{}
+		for _, reference := range references {
+			entries = append(entries, imageListEntry{Image: reference})
+		}
+		return pullImageEntries(image, entries, opts.Pull, opts.Concurrency, opts.PullOptions)
+	}
+	return nil
+}
+
+// 读取 YAML 文件中的每个文档，无法解析的文件输出警告后跳过
+func scanYamlFile(filename string, add func(value string, source string)) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	decoder := yaml.NewDecoder(fp)
+	for {
+		var document yaml.Node
+		if err = decoder.Decode(&document); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: skip %s: %s\n", filename, err)
+			return nil
+		}
+		if len(document.Content) == 0 {
+			continue
+		}
+		root := document.Content[0]
+		if services := yamlMappingValue(root, "services"); services != nil && yamlMappingValue(root, "kind") == nil {
+			// docker compose: services.<name>.image
+			for idx := 1; idx < len(services.Content); idx += 2 {
+				if value := yamlMappingValue(services.Content[idx], "image"); value != nil && value.Kind == yaml.ScalarNode {
+					add(expandComposeVariables(value.Value), fmt.Sprintf("%s:%d", filename, value.Line))
+				}
+			}
+			continue
+		}
+		scanPodContainers(root, filename, add)
+	}
+}
+
+// 在任意层级中查找 containers, initContainers, ephemeralContainers，可以包含 Deployment, CronJob, List 等各种资源
+func scanPodContainers(node *yaml.Node, filename string, add func(value string, source string)) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for idx := 0; idx+1 < len(node.Content); idx += 2 {
+			key, value := node.Content[idx], node.Content[idx+1]
+			if value.Kind == yaml.SequenceNode && isPodContainerKey(key.Value) {
+				for _, container := range value.Content {
+					if image := yamlMappingValue(container, "image"); image != nil && image.Kind == yaml.ScalarNode {
+						add(image.Value, fmt.Sprintf("%s:%d", filename, image.Line))
+					}
+				}
+			}
+			scanPodContainers(value, filename, add)
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			scanPodContainers(item, filename, add)
+		}
+	}
+}
+
+func isPodContainerKey(key string) bool {
+	for _, item := range podContainerKeys {
+		if item == key {
+			return true
+		}
+	}
+	return false
+}
+
+func yamlMappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for idx := 0; idx+1 < len(node.Content); idx += 2 {
+		if node.Content[idx].Value == key {
+			return node.Content[idx+1]
+		}
+	}
+	return nil
+}
+
+// 替换 compose 中的 ${VAR}, ${VAR:-default}, ${VAR-default}，未设置的变量保持原样
+func expandComposeVariables(value string) string {
+	return os.Expand(value, func(name string) string {
+		if key, defaultValue, found := strings.Cut(name, ":-"); found {
+			if env := os.Getenv(key); len(env) > 0 {
+				return env
+			}
+			return defaultValue
+		}
+		if key, defaultValue, found := strings.Cut(name, "-"); found {
+			if env, ok := os.LookupEnv(key); ok {
+				return env
+			}
+			return defaultValue
+		}
+		if env, ok := os.LookupEnv(name); ok {
+			return env
+		}
+		return "${" + name + "}"
+	})
+}
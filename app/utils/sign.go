@@ -0,0 +1,412 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// cosign 的签名格式：https://github.com/sigstore/cosign/blob/main/specs/SIGNATURE_SPEC.md
+const (
+	simpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureKey     = "dev.cosignproject.cosign/signature"
+	cosignArtifactType     = "application/vnd.dev.cosign.artifact.sig.v1+json"
+)
+
+type SignOptions struct {
+	Key         string            // PEM 格式的 ECDSA 或 ed25519 私钥
+	Referrer    bool              // 以 OCI referrer 的方式上传签名，否则上传到 sha256-<hex>.sig tag
+	Annotations map[string]string // 写入签名内容的 optional 字段
+}
+
+// https://github.com/containers/image/blob/main/docs/containers-signature.5.md
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+// 使用本地私钥对镜像的 manifest digest 签名，签名格式与 cosign 兼容
+func SignImage(image *Image, opts SignOptions) error {
+	fmt.Printf("Sign Image %s/%s:%s\n", image.Registry, image.Repository, image.Tag)
+	signer, err := loadPrivateKey(opts.Key)
+	if err != nil {
+		return err
+	}
+	subject, err := resolveSubject(image)
+	if err != nil {
+		return err
+	}
+
+	var payload simpleSigning
+	payload.Critical.Identity.DockerReference = fmt.Sprintf("%s/%s", image.Registry, image.Repository)
+	payload.Critical.Image.DockerManifestDigest = subject.Digest
+	payload.Critical.Type = "cosign container image signature"
+	payload.Optional = opts.Annotations
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	signature, err := signPayload(signer, content)
+	if err != nil {
+		return err
+	}
+
+	payloadDigest, payloadSize, err := uploadBlobBytes(image, content, simpleSigningMediaType)
+	if err != nil {
+		return err
+	}
+	var a fastjson.Arena
+	layer := parseJsonString(fmt.Sprintf(`{
+		"mediaType": "%s",
+		"digest": "%s",
+		"size": %d,
+		"annotations": {}
+	}`, simpleSigningMediaType, payloadDigest, payloadSize))
+	layer.Get("annotations").Set(cosignSignatureKey, a.NewString(base64.StdEncoding.EncodeToString(signature)))
+
+	var digest string
+	if opts.Referrer {
+		digest, err = pushSignatureReferrer(image, subject, layer)
+	} else {
+		digest, err = pushSignatureTag(image, subject, layer)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Signed %s@%s with %s\n", image.Slug, subject.Digest, digest)
+	return nil
+}
+
+// 签名作为 OCI 1.1 的 artifact，通过 subject 引用镜像
+func pushSignatureReferrer(image *Image, subject descriptor, layer *fastjson.Value) (string, error) {
+	configDigest, configSize, err := uploadBlobBytes(image, []byte("{}"), emptyConfigMediaType)
+	if err != nil {
+		return "", err
+	}
+	manifest := parseJsonString(fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"artifactType": "%s",
+		"config": {
+			"mediaType": "%s",
+			"digest": "%s",
+			"size": %d
+		},
+		"layers": []
+	}`, cosignArtifactType, emptyConfigMediaType, configDigest, configSize))
+	manifest.Get("layers").SetArrayItem(0, layer)
+	return pushReferrer(image, subject, manifest)
+}
+
+// 签名上传到 sha256-<hex>.sig tag，已有签名时追加为新的 layer
+func pushSignatureTag(image *Image, subject descriptor, layer *fastjson.Value) (string, error) {
+	tag := referrersTag(subject.Digest) + ".sig"
+	layers := []*fastjson.Value{}
+	var content []byte
+	var fetchErr error
+	if err := Try(func() {
+		content, _, fetchErr = image.fetchManifestRaw(tag)
+	}); err != nil {
+		return "", err
+	}
+	if fetchErr != nil && !errors.Is(fetchErr, errManifestNotFound) {
+		return "", fetchErr
+	}
+	if fetchErr == nil {
+		var p fastjson.Parser
+		existing, err := p.ParseBytes(content)
+		if err != nil {
+			return "", err
+		}
+		layers = existing.GetArray("layers")
+	}
+	signature := string(layer.GetStringBytes("annotations", cosignSignatureKey))
+	for _, item := range layers {
+		if string(item.GetStringBytes("digest")) == string(layer.GetStringBytes("digest")) &&
+			string(item.GetStringBytes("annotations", cosignSignatureKey)) == signature {
+			fmt.Printf("signature already exists in %s\n", tag)
+			return computeBytesDigest(content), nil
+		}
+	}
+	layers = append(layers, layer)
+
+	// config 与 cosign 生成的相同，diff_ids 为每个签名内容的 digest
+	var a fastjson.Arena
+	config := parseJsonString(`{
+		"architecture": "",
+		"created": "0001-01-01T00:00:00Z",
+		"history": [{"created": "0001-01-01T00:00:00Z"}],
+		"os": "",
+		"rootfs": {"type": "layers", "diff_ids": []},
+		"config": {}
+	}`)
+	for idx, item := range layers {
+		config.Get("rootfs", "diff_ids").SetArrayItem(idx, a.NewString(string(item.GetStringBytes("digest"))))
+	}
+	configDigest, configSize, err := uploadBlobBytes(image, config.MarshalTo(nil), "application/vnd.oci.image.config.v1+json")
+	if err != nil {
+		return "", err
+	}
+
+	manifest := parseJsonString(fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {
+			"mediaType": "application/vnd.oci.image.config.v1+json",
+			"digest": "%s",
+			"size": %d
+		},
+		"layers": []
+	}`, configDigest, configSize))
+	for idx, item := range layers {
+		manifest.Get("layers").SetArrayItem(idx, item)
+	}
+	return uploadManifest(image, tag, "application/vnd.oci.image.manifest.v1+json", manifest.MarshalTo(nil))
+}
+
+// 需要验证的签名，keys 中任意一个公钥有对应的有效签名即可
+type signatureRequirement struct {
+	source string // 要求签名的来源，用于错误信息
+	keys   []string
+}
+
+// 在拉取 layer 之前检查镜像的签名，返回已验证的 manifest 内容
+// 签名来自 sha256-<hex>.sig tag 和 cosign 类型的 referrer，每个 requirement 都需要满足
+func verifyImageSignature(image *Image, requirements []signatureRequirement) ([]byte, error) {
+	publicKeys := make([][]crypto.PublicKey, len(requirements))
+	for idx, requirement := range requirements {
+		for _, keyFile := range requirement.keys {
+			publicKey, err := loadPublicKey(keyFile)
+			if err != nil {
+				return nil, err
+			}
+			publicKeys[idx] = append(publicKeys[idx], publicKey)
+		}
+	}
+
+	var content []byte
+	var signatures []*fastjson.Value
+	var fetchErr error
+	if err := Try(func() {
+		if content, _, fetchErr = image.fetchManifestRaw(""); fetchErr != nil {
+			return
+		}
+		// 签名的 schema v1 manifest 的 digest 不包含签名部分
+		signatures, fetchErr = fetchSignatures(image, manifestDigest(content))
+	}); err != nil {
+		return nil, err
+	}
+	if fetchErr != nil {
+		return nil, fetchErr
+	}
+	digest := manifestDigest(content)
+	if len(signatures) == 0 {
+		return nil, fmt.Errorf("image %s@%s is not signed, a signature is required by %s", image.Slug, digest, requirements[0].source)
+	}
+
+	// 每个签名只下载一次
+	payloads := make([][]byte, len(signatures))
+	signatureBytes := make([][]byte, len(signatures))
+	for idx, layer := range signatures {
+		var err error
+		if payloads[idx], signatureBytes[idx], err = fetchSignaturePayload(image, layer); err != nil {
+			fmt.Printf("signature %s: %v\n", layer.GetStringBytes("digest"), err)
+		}
+	}
+
+	for idx, requirement := range requirements {
+		verified := false
+		for i, layer := range signatures {
+			if payloads[i] == nil {
+				continue
+			}
+			for _, publicKey := range publicKeys[idx] {
+				if err := checkSignedPayload(publicKey, payloads[i], signatureBytes[i], digest); err == nil {
+					fmt.Printf("Verified signature %s of %s@%s for %s\n", layer.GetStringBytes("digest"), image.Slug, digest, requirement.source)
+					verified = true
+					break
+				}
+			}
+			if verified {
+				break
+			}
+		}
+		if !verified {
+			return nil, fmt.Errorf("no valid signature found for %s@%s, required by %s", image.Slug, digest, requirement.source)
+		}
+	}
+	return content, nil
+}
+
+// 读取镜像所有签名的 layer
+func fetchSignatures(image *Image, digest string) ([]*fastjson.Value, error) {
+	manifests := [][]byte{}
+	content, _, err := image.fetchManifestRaw(referrersTag(digest) + ".sig")
+	if err == nil {
+		manifests = append(manifests, content)
+	} else if !errors.Is(err, errManifestNotFound) {
+		return nil, err
+	}
+
+	referrers, supported, err := fetchReferrers(image, digest)
+	if err == nil && !supported {
+		referrers, _, err = fetchReferrerTag(image, digest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range referrers {
+		if string(item.GetStringBytes("artifactType")) != cosignArtifactType {
+			continue
+		}
+		if content, _, err = image.fetchManifestRaw(string(item.GetStringBytes("digest"))); err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, content)
+	}
+
+	signatures := []*fastjson.Value{}
+	for _, content := range manifests {
+		var p fastjson.Parser
+		manifest, err := p.ParseBytes(content)
+		if err != nil {
+			return nil, err
+		}
+		for _, layer := range manifest.GetArray("layers") {
+			if string(layer.GetStringBytes("mediaType")) == simpleSigningMediaType {
+				signatures = append(signatures, layer)
+			}
+		}
+	}
+	return signatures, nil
+}
+
+// 下载签名内容，返回签名内容和 annotation 中的签名
+func fetchSignaturePayload(image *Image, layer *fastjson.Value) (payload []byte, signature []byte, err error) {
+	signature, err = base64.StdEncoding.DecodeString(string(layer.GetStringBytes("annotations", cosignSignatureKey)))
+	if err != nil || len(signature) == 0 {
+		return nil, nil, fmt.Errorf("invalid signature annotation")
+	}
+	payloadDigest := string(layer.GetStringBytes("digest"))
+	blob, err := openBlob(image, payloadDigest)
+	if err != nil {
+		return
+	}
+	payload, err = io.ReadAll(io.LimitReader(blob, 1<<20))
+	blob.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	if computeBytesDigest(payload) != payloadDigest {
+		return nil, nil, fmt.Errorf("payload does not match its digest")
+	}
+	return
+}
+
+// 检查签名以及签名内容中记录的 manifest digest
+func checkSignedPayload(publicKey crypto.PublicKey, payload []byte, signature []byte, digest string) error {
+	if err := verifyPayload(publicKey, payload, signature); err != nil {
+		return err
+	}
+	var content simpleSigning
+	if err := json.Unmarshal(payload, &content); err != nil {
+		return err
+	}
+	if content.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("signed digest %s does not match %s", content.Critical.Image.DockerManifestDigest, digest)
+	}
+	return nil
+}
+
+// ECDSA 签名 payload 的 sha256，ed25519 直接签名 payload
+func signPayload(signer crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		return signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	hash := sha256.Sum256(payload)
+	return signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+}
+
+func verifyPayload(publicKey crypto.PublicKey, payload []byte, signature []byte) error {
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(payload)
+		if ecdsa.VerifyASN1(key, hash[:], signature) {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(key, payload, signature) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+	return fmt.Errorf("invalid signature")
+}
+
+func readPemBlock(filename string) (*pem.Block, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", filename)
+	}
+	if strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") || block.Type == "ENCRYPTED PRIVATE KEY" || block.Type == "ENCRYPTED SIGSTORE PRIVATE KEY" {
+		return nil, fmt.Errorf("encrypted private key %s is not supported", filename)
+	}
+	return block, nil
+}
+
+// 读取 PKCS#8 或 SEC1 格式的 ECDSA、ed25519 私钥
+func loadPrivateKey(filename string) (crypto.Signer, error) {
+	block, err := readPemBlock(filename)
+	if err != nil {
+		return nil, err
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T in %s", key, filename)
+}
+
+// 读取 PKIX 格式的公钥
+func loadPublicKey(filename string) (crypto.PublicKey, error) {
+	block, err := readPemBlock(filename)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
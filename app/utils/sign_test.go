@@ -0,0 +1,137 @@
+package utils_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func writePem(t *testing.T, filename string, blockType string, content []byte, headers map[string]string) string {
+	assert.NoError(t, os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: blockType, Headers: headers, Bytes: content}), 0600))
+	return filename
+}
+
+func writePublicKey(t *testing.T, filename string, key crypto.PublicKey) string {
+	content, err := x509.MarshalPKIXPublicKey(key)
+	assert.NoError(t, err)
+	return writePem(t, filename, "PUBLIC KEY", content, nil)
+}
+
+func Test_SignPayload(t *testing.T) {
+	dir := t.TempDir()
+	digest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"registry.example.com/app"},"image":{"docker-manifest-digest":"` + digest + `"},"type":"cosign container image signature"},"optional":null}`)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	assert.NoError(t, err)
+	ecPkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	assert.NoError(t, err)
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	edPkcs8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	assert.NoError(t, err)
+	ecPublic := writePublicKey(t, path.Join(dir, "ec.pub"), &ecKey.PublicKey)
+
+	cases := []struct {
+		key    string
+		public string
+	}{
+		{writePem(t, path.Join(dir, "ec-sec1.pem"), "EC PRIVATE KEY", sec1, nil), ecPublic},
+		{writePem(t, path.Join(dir, "ec-pkcs8.pem"), "PRIVATE KEY", ecPkcs8, nil), ecPublic},
+		{writePem(t, path.Join(dir, "ed25519.pem"), "PRIVATE KEY", edPkcs8, nil), writePublicKey(t, path.Join(dir, "ed25519.pub"), edPublic)},
+	}
+	for _, c := range cases {
+		signature, err := utils.SignPayload(c.key, payload)
+		assert.NoError(t, err, c.key)
+		assert.NoError(t, utils.CheckSignedPayload(c.public, payload, signature, digest), c.key)
+
+		// 签名内容被修改、digest 不一致或公钥不匹配
+		tampered := append([]byte{}, payload...)
+		tampered[len(tampered)-2] = ' '
+		assert.Error(t, utils.CheckSignedPayload(c.public, tampered, signature, digest), c.key)
+		assert.ErrorContains(t, utils.CheckSignedPayload(c.public, payload, signature, "sha256:0000"), "does not match", c.key)
+		for _, other := range cases {
+			if other.public != c.public {
+				assert.Error(t, utils.CheckSignedPayload(other.public, payload, signature, digest), c.key)
+			}
+		}
+	}
+
+	// 不支持加密的私钥和 RSA 私钥
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	rsaPkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	assert.NoError(t, err)
+	for _, key := range []string{
+		writePem(t, path.Join(dir, "encrypted.pem"), "ENCRYPTED PRIVATE KEY", []byte("data"), nil),
+		writePem(t, path.Join(dir, "legacy.pem"), "EC PRIVATE KEY", sec1, map[string]string{"Proc-Type": "4,ENCRYPTED"}),
+		writePem(t, path.Join(dir, "rsa.pem"), "PRIVATE KEY", rsaPkcs8, nil),
+		path.Join(dir, "ec.pub"),
+		path.Join(dir, "missing.pem"),
+	} {
+		_, err := utils.SignPayload(key, payload)
+		assert.Error(t, err, key)
+	}
+	// RSA 公钥无法验证
+	rsaPublic := writePublicKey(t, path.Join(dir, "rsa.pub"), &rsaKey.PublicKey)
+	assert.ErrorContains(t, utils.CheckSignedPayload(rsaPublic, payload, []byte("sig"), digest), "unsupported public key")
+}
+
+// 签名的 schema v1 manifest 按去掉签名后的 digest 查找和检查签名
+func Test_VerifyImageSignatureSchema1(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	sec1, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	keyFile := writePem(t, path.Join(dir, "ec.pem"), "EC PRIVATE KEY", sec1, nil)
+	publicKey := writePublicKey(t, path.Join(dir, "ec.pub"), &key.PublicKey)
+
+	manifest, err := os.ReadFile("testdata/manifest-v1-signed.json")
+	assert.NoError(t, err)
+	digest := utils.ManifestDigest(manifest)
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"t/app"},"image":{"docker-manifest-digest":"` + digest + `"},"type":"cosign container image signature"},"optional":null}`)
+	signature, err := utils.SignPayload(keyFile, payload)
+	assert.NoError(t, err)
+
+	registry := newPushRegistry(t)
+	defer registry.Close()
+	payloadDigest := "sha256:" + sha256Hex(payload)
+	registry.blobs[payloadDigest] = payload
+	registry.manifests["1"] = manifest
+	registry.manifests[strings.Replace(digest, ":", "-", 1)+".sig"] = []byte(fmt.Sprintf(`{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:0", "size": 0},
+		"layers": [{"mediaType": "application/vnd.dev.cosign.simplesigning.v1+json", "digest": "%s", "size": %d,
+			"annotations": {"dev.cosignproject.cosign/signature": "%s"}}]}`, payloadDigest, len(payload), base64.StdEncoding.EncodeToString(signature)))
+
+	name := strings.TrimPrefix(registry.URL, "http://") + "/t/app:1"
+	assert.NoError(t, utils.VerifyImageSignature(name, publicKey))
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	other := writePublicKey(t, path.Join(dir, "other.pub"), &otherKey.PublicKey)
+	assert.ErrorContains(t, utils.VerifyImageSignature(name, other), "no valid signature found")
+
+	// sign 使用相同的 digest，签名后可以通过检查
+	otherSec1, err := x509.MarshalECPrivateKey(otherKey)
+	assert.NoError(t, err)
+	otherFile := writePem(t, path.Join(dir, "other.pem"), "EC PRIVATE KEY", otherSec1, nil)
+	image := utils.NewImage(name, "", "", true, "", "linux", "amd64", "")
+	assert.NoError(t, utils.SignImage(&image, utils.SignOptions{Key: otherFile}))
+	assert.NoError(t, utils.VerifyImageSignature(name, other))
+}
@@ -0,0 +1,474 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/valyala/fastjson"
+)
+
+// 打开镜像文件：目录直接读取；未压缩的 tar 包建立索引后按偏移读取，不占用临时空间；
+// 标准输入和压缩过的 tar 包无法随机读取（docker save 的 manifest.json 和 index.json 在最后），
+// 解压到临时目录（$TMPDIR），最多 GO_DOCKER_MAX_EXTRACT_SIZE 字节。push 到指定的镜像时使用 readImageStream，不解压
+func openImageFile(filename string) (fsys fs.FS, cleanup func(), err error) {
+	cleanup = func() {}
+	var stream io.ReadCloser
+	if stream, err = openImageStream(filename); err != nil {
+		return
+	}
+	if stream != nil {
+		defer stream.Close()
+		return extractImageStream(stream, filename)
+	}
+
+	var info os.FileInfo
+	if info, err = os.Stat(filename); err != nil {
+		return
+	}
+	if info.IsDir() {
+		// 当前指定的路径是一个目录，则直接上传该目录下的文件
+		fsys = os.DirFS(filename)
+		return
+	}
+
+	var tarFs *tarFS
+	if tarFs, err = indexTarFile(filename); err != nil {
+		return
+	}
+	fsys = tarFs
+	cleanup = func() {
+		tarFs.Close()
+	}
+	return
+}
+
+// 标准输入和压缩过的 tar 包只能顺序读取，返回解压后的 tar 数据流；目录和未压缩的 tar 包返回 nil
+func openImageStream(filename string) (stream io.ReadCloser, err error) {
+	if filename == "-" {
+		return decompressStream(os.Stdin)
+	}
+	var info os.FileInfo
+	if info, err = os.Stat(filename); err != nil || info.IsDir() {
+		return
+	}
+	var fileType string
+	if fileType, err = detectCompression(os.DirFS(path.Dir(filename)), path.Base(filename)); err != nil || fileType == "tar" {
+		return
+	}
+
+	var fp *os.File
+	if fp, err = os.Open(filename); err != nil {
+		return
+	}
+	var decompressed io.ReadCloser
+	if decompressed, err = decompressStream(fp); err != nil {
+		fp.Close()
+		return
+	}
+	return &closeBoth{decompressed, fp}, nil
+}
+
+// 关闭解压的数据流和文件
+type closeBoth struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+func (c *closeBoth) Close() error {
+	c.ReadCloser.Close()
+	return c.file.Close()
+}
+
+// 解压到临时目录的最大字节数，默认 64G，可通过 GO_DOCKER_MAX_EXTRACT_SIZE 修改
+func maxExtractSize() int64 {
+	size, err := strconv.ParseInt(os.Getenv("GO_DOCKER_MAX_EXTRACT_SIZE"), 10, 64)
+	if err != nil || size <= 0 {
+		return 64 << 30
+	}
+	return size
+}
+
+// 解压 gzip/zstd 数据流，未压缩时原样返回
+func decompressStream(r io.Reader) (io.ReadCloser, error) {
+	reader := bufio.NewReader(r)
+	buff, _ := reader.Peek(4)
+	switch detectCompressionBytes(buff) {
+	case "gzip":
+		return gzip.NewReader(reader)
+	case "zstd":
+		zReader, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return zReader.IOReadCloser(), nil
+	}
+	return io.NopCloser(reader), nil
+}
+
+// 将解压后的 tar 数据流解压到临时目录，上传完成后再删除临时文件
+func extractImageStream(stream io.Reader, name string) (fsys fs.FS, cleanup func(), err error) {
+	cleanup = func() {}
+	var targetFolder string
+	if targetFolder, err = os.MkdirTemp("", "oci-*"); err != nil {
+		return
+	}
+	cleanup = func() {
+		os.RemoveAll(targetFolder)
+	}
+	fmt.Fprintf(os.Stderr, "extract tar %s to %s (at most %d bytes), use an uncompressed tar file to read it in place\n", name, targetFolder, maxExtractSize())
+
+	if err = extractTar(stream, targetFolder, maxExtractSize()); err != nil {
+		return
+	}
+	fsys = os.DirFS(targetFolder)
+	return
+}
+
+// ==================== 按偏移读取 tar 包中的文件 ====================
+type tarEntry struct {
+	header *tar.Header
+	offset int64
+}
+
+// 实现 fs.FS，读取文件时直接从 tar 包中对应的偏移读取，不需要解压
+type tarFS struct {
+	file *os.File
+	entries map[string]*tarEntry
+}
+
+func indexTarFile(filename string) (*tarFS, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "index tar %s\n", filename)
+
+	t := &tarFS{file: fp, entries: map[string]*tarEntry{}}
+	tarFile := tar.NewReader(fp)
+	for {
+		header, err := tarFile.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		name, err := checkTarName(header.Name)
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		// tar.Reader 读取 header 后，文件位置即为文件内容的起始位置
+		offset, err := fp.Seek(0, io.SeekCurrent)
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		t.entries[name] = &tarEntry{header: header, offset: offset}
+	}
+	return t, nil
+}
+
+func cleanTarName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (t *tarFS) Close() error {
+	return t.file.Close()
+}
+
+// 查找文件，跟随符号链接和硬链接
+func (t *tarFS) lookup(name string) (*tarEntry, error) {
+	name, err := resolveTarLink(name, func(name string) *tar.Header {
+		if entry, ok := t.entries[name]; ok {
+			return entry.header
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t.entries[name], nil
+}
+
+// 跟随符号链接和硬链接，返回 tar 包中实际的文件名；header 返回文件名对应的 header，不存在时为 nil
+func resolveTarLink(name string, header func(name string) *tar.Header) (string, error) {
+	for depth := 0; depth < 16; depth++ {
+		h := header(name)
+		if h == nil {
+			return "", fs.ErrNotExist
+		}
+		switch h.Typeflag {
+		case tar.TypeSymlink:
+			if path.IsAbs(h.Linkname) {
+				name = cleanTarName(h.Linkname)
+			} else {
+				name = cleanTarName(path.Join(path.Dir(name), h.Linkname))
+			}
+		case tar.TypeLink:
+			name = cleanTarName(h.Linkname)
+		default:
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("too many levels of links: %s", name)
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, err := t.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if entry.header.Typeflag != tar.TypeReg {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return &tarFile{
+		SectionReader: io.NewSectionReader(t.file, entry.offset, entry.header.Size),
+		info: entry.header.FileInfo(),
+	}, nil
+}
+
+type tarFile struct {
+	*io.SectionReader
+	info fs.FileInfo
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+func (f *tarFile) Close() error {
+	return nil
+}
+
+// 镜像中的一个 layer
+type sourceLayer struct {
+	descriptor
+	filename string // 在本地镜像文件中的路径，远程镜像为空
+}
+
+// layer 的 digest，docker-archive 中的 layer 没有记录 digest，使用文件名
+func (l *sourceLayer) name() string {
+	if len(l.Digest) > 0 {
+		return l.Digest
+	}
+	return l.filename
+}
+
+// 可读取 config 和 layer 的镜像，来自远程仓库或本地镜像文件
+type sourceImage struct {
+	image    *Image          // 远程镜像，本地镜像文件为 nil
+	fsys     fs.FS           // 本地镜像文件
+	manifest *fastjson.Value // 镜像的 manifest，docker-archive 为 nil
+	config   []byte
+	layers   []sourceLayer // 按从下到上的顺序
+	cleanup  func()
+}
+
+// 是否为本地的镜像文件：- 表示标准输入，其余为存在的文件或目录
+func isLocalImage(source string) bool {
+	if source == "-" {
+		return true
+	}
+	_, err := os.Stat(source)
+	return err == nil
+}
+
+// 读取本地镜像文件或远程镜像，image 提供远程镜像的认证信息和 platform
+func loadSourceImage(source string, image *Image) (src *sourceImage, err error) {
+	if !isLocalImage(source) {
+		return loadRemoteImage(image)
+	}
+
+	src = &sourceImage{}
+	if src.fsys, src.cleanup, err = openImageFile(source); err != nil {
+		return nil, err
+	}
+	if isOciLayout(src.fsys) {
+		err = src.loadOciLayout(image)
+	} else {
+		err = src.loadDockerArchive()
+	}
+	if err != nil {
+		src.cleanup()
+		return nil, err
+	}
+	return src, nil
+}
+
+func loadRemoteImage(image *Image) (src *sourceImage, err error) {
+	src = &sourceImage{image: image, cleanup: func() {}}
+	if err = Try(func() {
+		src.manifest = image.FetchManifest("")
+	}); err != nil {
+		return nil, err
+	}
+	if src.manifest.GetInt("schemaVersion") != 2 {
+		return nil, fmt.Errorf("Unsupported schema version %d", src.manifest.GetInt("schemaVersion"))
+	}
+	var selectErr error
+	if err = Try(func() {
+		src.manifest, selectErr = selectPlatformManifest(image, src.manifest)
+	}); err != nil {
+		return nil, err
+	}
+	if selectErr != nil {
+		return nil, selectErr
+	}
+
+	configDigest := string(src.manifest.GetStringBytes("config", "digest"))
+	blob, err := openBlob(image, configDigest)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	if src.config, err = io.ReadAll(blob); err != nil {
+		return nil, err
+	}
+	src.addManifestLayers()
+	return src, nil
+}
+
+// 从 OCI layout 中选择与 platform 匹配的 manifest，支持嵌套的 index
+func (s *sourceImage) loadOciLayout(image *Image) error {
+	content, err := fs.ReadFile(s.fsys, "index.json")
+	if err != nil {
+		return err
+	}
+	manifest := parseJson(content)
+	for manifest.Exists("manifests") {
+		manifests := manifest.GetArray("manifests")
+		if len(manifests) == 0 {
+			return fmt.Errorf("no manifest found in index.json")
+		}
+		item := manifests[0]
+		if len(manifests) > 1 {
+			var exist bool
+			if item, exist = findPlatformManifest(image, manifests); !exist {
+				return fmt.Errorf("Not found platform %s/%s", image.platform.osName, image.platform.architecture)
+			}
+		}
+		if content, err = fs.ReadFile(s.fsys, ociBlobPath(string(item.GetStringBytes("digest")))); err != nil {
+			return err
+		}
+		manifest = parseJson(content)
+	}
+	s.manifest = manifest
+
+	if s.config, err = fs.ReadFile(s.fsys, ociBlobPath(string(manifest.GetStringBytes("config", "digest")))); err != nil {
+		return err
+	}
+	s.addManifestLayers()
+	for i := range s.layers {
+		s.layers[i].filename = ociBlobPath(s.layers[i].Digest)
+	}
+	return nil
+}
+
+func (s *sourceImage) loadDockerArchive() error {
+	content, err := fs.ReadFile(s.fsys, "manifest.json")
+	if err != nil {
+		return err
+	}
+	manifests := parseJson(content).GetArray()
+	if len(manifests) != 1 {
+		return fmt.Errorf("image file contains %d images, only one is supported", len(manifests))
+	}
+	manifestJson := manifests[0]
+
+	config := manifestJson.GetStringBytes("Config")
+	if config == nil {
+		config = manifestJson.GetStringBytes("config")
+	}
+	if s.config, err = fs.ReadFile(s.fsys, cleanTarName(string(config))); err != nil {
+		return err
+	}
+
+	layers := manifestJson.GetArray("Layers")
+	if layers == nil {
+		layers = manifestJson.GetArray("layers")
+	}
+	for _, item := range layers {
+		name, _ := item.StringBytes()
+		layer := sourceLayer{filename: cleanTarName(string(name))}
+		if info, err := fs.Stat(s.fsys, layer.filename); err == nil {
+			layer.Size = info.Size()
+		}
+		s.layers = append(s.layers, layer)
+	}
+	return nil
+}
+
+func (s *sourceImage) addManifestLayers() {
+	for _, item := range s.manifest.GetArray("layers") {
+		s.layers = append(s.layers, sourceLayer{descriptor: descriptor{
+			MediaType: string(item.GetStringBytes("mediaType")),
+			Digest:    string(item.GetStringBytes("digest")),
+			Size:      item.GetInt64("size"),
+		}})
+	}
+}
+
+// 读取 layer 的原始内容
+func (s *sourceImage) openLayer(layer sourceLayer) (io.ReadCloser, error) {
+	if s.image != nil {
+		return openBlob(s.image, layer.Digest)
+	}
+	return s.fsys.Open(layer.filename)
+}
+
+// 读取 layer 解压后的 tar 数据流
+func (s *sourceImage) openLayerTar(layer sourceLayer) (io.ReadCloser, error) {
+	if isEncryptedMediaType(layer.MediaType) {
+		return nil, fmt.Errorf("layer %s is encrypted, pull it with --decryption-key first", layer.name())
+	}
+	if s.image != nil {
+		return openRemoteLayer(s.image, layer.Digest)
+	}
+	blob, err := s.openLayer(layer)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := decompressStream(blob)
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	return &layerReader{reader, blob}, nil
+}
+
+// 关闭解压流的同时关闭原始数据流
+type layerReader struct {
+	io.ReadCloser
+	blob io.Closer
+}
+
+func (r *layerReader) Close() error {
+	r.ReadCloser.Close()
+	return r.blob.Close()
+}
+
+// 按从上到下的顺序合并镜像的 layer，对最终文件系统中的每个文件调用 emit
+func (s *sourceImage) flatten(emit flattenEmitter) error {
+	return flattenLayers(len(s.layers), func(index int) (io.ReadCloser, error) {
+		layer := s.layers[len(s.layers)-1-index]
+		fmt.Fprintf(os.Stderr, "(%d/%d) Reading layer %s\n", index+1, len(s.layers), layer.name())
+		reader, err := s.openLayerTar(layer)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %w", layer.name(), err)
+		}
+		return reader, nil
+	}, emit)
+}
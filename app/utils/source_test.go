@@ -0,0 +1,80 @@
+package utils_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+type tarItem struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+}
+
+func buildTar(t *testing.T, items []tarItem) []byte {
+	var buff bytes.Buffer
+	w := tar.NewWriter(&buff)
+	for _, item := range items {
+		typeflag := item.typeflag
+		if typeflag == 0 {
+			typeflag = tar.TypeReg
+		}
+		mode := int64(0644)
+		if typeflag == tar.TypeDir {
+			mode = 0755
+		}
+		assert.NoError(t, w.WriteHeader(&tar.Header{
+			Name:     item.name,
+			Typeflag: typeflag,
+			Size:     int64(len(item.content)),
+			Linkname: item.linkname,
+			Mode:     mode,
+		}))
+		_, err := w.Write([]byte(item.content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+	return buff.Bytes()
+}
+
+func Test_OpenImageFile(t *testing.T) {
+	content := buildTar(t, []tarItem{
+		{name: "manifest.json", content: `[]`},
+		{name: "./layer/layer.tar", content: "layer"},
+		{name: "link.tar", typeflag: tar.TypeSymlink, linkname: "layer/layer.tar"},
+		{name: "hard.tar", typeflag: tar.TypeLink, linkname: "layer/layer.tar"},
+	})
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(content)
+	gw.Close()
+
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{"image.tar": content, "image.tar.gz": gz.Bytes()} {
+		filename := path.Join(dir, name)
+		assert.NoError(t, os.WriteFile(filename, data, 0644))
+		for _, file := range []string{"manifest.json", "layer/layer.tar", "link.tar", "hard.tar"} {
+			data, err := utils.ReadImageFile(filename, file)
+			assert.NoError(t, err, name+" "+file)
+			if file != "manifest.json" {
+				assert.Equal(t, "layer", string(data), name+" "+file)
+			}
+		}
+		_, err := utils.ReadImageFile(filename, "missing")
+		assert.Error(t, err, name)
+	}
+
+	// 不安全的路径
+	filename := path.Join(dir, "unsafe.tar")
+	assert.NoError(t, os.WriteFile(filename, buildTar(t, []tarItem{{name: "../evil", content: "x"}}), 0644))
+	_, err := utils.ReadImageFile(filename, "manifest.json")
+	assert.Error(t, err)
+}
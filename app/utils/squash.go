@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+type SquashOptions struct {
+	Output      string // 保存为 docker-archive 的文件路径
+	RepoTag     string // docker-archive 中记录的镜像名
+	Compression string // 推送时 layer 的压缩方式
+}
+
+// 将镜像的所有 layer 合并为一个 layer，保存为 docker-archive，或推送到 target
+// source 为本地镜像文件时直接读取，否则从 image 对应的远程仓库下载
+func SquashImage(source string, image *Image, target *Image, opts SquashOptions) error {
+	fmt.Printf("Squash Image %s\n", source)
+	if len(opts.RepoTag) == 0 && !isLocalImage(source) {
+		// 未指定目标镜像时，docker-archive 中使用远程镜像的名字
+		opts.RepoTag = source
+	}
+	src, err := loadSourceImage(source, image)
+	if err != nil {
+		return err
+	}
+	defer src.cleanup()
+
+	tempDir, err := os.MkdirTemp("", "squash-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	// 1.合并所有 layer
+	layerFile, err := os.CreateTemp(tempDir, "layer-*.tar")
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	err = writeFlattenedTar(io.MultiWriter(layerFile, h), len(src.layers), func(index int) (io.ReadCloser, error) {
+		layer := src.layers[len(src.layers)-1-index]
+		fmt.Printf("(%d/%d) Squashing layer %s\n", index+1, len(src.layers), layer.name())
+		return src.openLayerTar(layer)
+	})
+	layerFile.Chmod(0644)
+	layerFile.Close()
+	if err != nil {
+		return err
+	}
+	diffID := fmt.Sprintf("sha256:%x", h.Sum(nil))
+	layerName := path.Join(strings.TrimPrefix(diffID, "sha256:"), "layer.tar")
+	if err = ensureDir(path.Join(tempDir, path.Dir(layerName))); err != nil {
+		return err
+	}
+	if err = os.Rename(layerFile.Name(), path.Join(tempDir, layerName)); err != nil {
+		return err
+	}
+
+	// 2.生成只包含一个 layer 的 config
+	config, err := squashConfig(src.config, diffID, len(src.layers))
+	if err != nil {
+		return err
+	}
+	configName := strings.TrimPrefix(computeBytesDigest(config), "sha256:") + ".json"
+	if err = os.WriteFile(path.Join(tempDir, configName), config, 0644); err != nil {
+		return err
+	}
+
+	repoTags := []string{}
+	if len(opts.RepoTag) > 0 {
+		repoTags = append(repoTags, opts.RepoTag)
+	}
+	manifest, _ := json.Marshal([]map[string]interface{}{{
+		"Config":   configName,
+		"RepoTags": repoTags,
+		"Layers":   []string{layerName},
+	}})
+	if err = os.WriteFile(path.Join(tempDir, "manifest.json"), manifest, 0644); err != nil {
+		return err
+	}
+
+	// 3.保存为 docker-archive 或推送
+	if len(opts.Output) > 0 {
+		fmt.Printf("Saving squashed image to %s\n", opts.Output)
+		if err = tarDirectory(tempDir, opts.Output); err != nil {
+			return err
+		}
+	}
+	if target != nil {
+		return PushImage(tempDir, target, PushOptions{Compression: opts.Compression})
+	}
+	return nil
+}
+
+// 将 config 中的 rootfs 和 history 替换为合并后的单个 layer
+func squashConfig(content []byte, diffID string, layerCount int) ([]byte, error) {
+	var p fastjson.Parser
+	config, err := p.ParseBytes(content)
+	if err != nil {
+		return nil, err
+	}
+
+	created := string(config.GetStringBytes("created"))
+	config.Set("rootfs", parseJsonString(fmt.Sprintf(`{
+		"type": "layers",
+		"diff_ids": ["%s"]
+	}`, diffID)))
+	history := parseJsonString(`[{}]`)
+	var a fastjson.Arena
+	if len(created) > 0 {
+		history.Get("0").Set("created", a.NewString(created))
+	}
+	history.Get("0").Set("created_by", a.NewString("squash"))
+	history.Get("0").Set("comment", a.NewString(fmt.Sprintf("squashed %d layers", layerCount)))
+	config.Set("history", history)
+	return config.MarshalTo(nil), nil
+}
@@ -0,0 +1,53 @@
+package utils_test
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_SquashLocalImage(t *testing.T) {
+	dir := t.TempDir()
+	lower := buildTar(t, []tarItem{{name: "a", content: "a1"}, {name: "b", content: "b"}})
+	upper := buildTar(t, []tarItem{{name: "a", content: "a2"}, {name: ".wh.b"}, {name: "c", content: "c"}})
+	config := `{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers", "diff_ids": ["sha256:1", "sha256:2"]}, "history": [{"created_by": "1"}, {"created_by": "2"}]}`
+	archive := buildTar(t, []tarItem{
+		{name: "lower/layer.tar", content: string(lower)},
+		{name: "upper/layer.tar", content: string(upper)},
+		{name: "config.json", content: config},
+		{name: "manifest.json", content: `[{"Config": "config.json", "RepoTags": ["app:1"], "Layers": ["lower/layer.tar", "upper/layer.tar"]}]`},
+	})
+	source := path.Join(dir, "image.tar")
+	assert.NoError(t, os.WriteFile(source, archive, 0644))
+
+	output := path.Join(dir, "squashed.tar")
+	image := utils.NewImage("", "", "", false, "", "linux", "amd64", "")
+	assert.NoError(t, utils.SquashImage(source, &image, nil, utils.SquashOptions{Output: output}))
+
+	content, err := os.ReadFile(output)
+	assert.NoError(t, err)
+	files := readTarFiles(t, content)
+	var manifest []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	assert.NoError(t, json.Unmarshal([]byte(files["manifest.json"]), &manifest))
+	assert.Len(t, manifest, 1)
+	// 本地镜像文件不使用文件名作为镜像名
+	assert.Empty(t, manifest[0].RepoTags)
+	assert.Len(t, manifest[0].Layers, 1)
+	assert.Equal(t, map[string]string{"a": "a2", "c": "c"}, readTarFiles(t, []byte(files[manifest[0].Layers[0]])))
+
+	var squashed struct {
+		Rootfs struct {
+			DiffIDs []string `json:"diff_ids"`
+		}
+	}
+	assert.NoError(t, json.Unmarshal([]byte(files[manifest[0].Config]), &squashed))
+	assert.Len(t, squashed.Rootfs.DiffIDs, 1)
+}
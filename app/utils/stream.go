@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// 标准输入和压缩过的 tar 包只能顺序读取，且 docker save 的 manifest.json、index.json 在最后：
+// 读取时按顺序直接上传 layer，只把 manifest、index、config 等小文件保存在内存中，读取完之后再上传 manifest
+
+// 保存在内存中的文件的最大字节数，更大的文件读取时直接作为 blob 上传
+const streamMemoryLimit = 32 << 20
+
+var errStreamedBlob = errors.New("blob was uploaded while reading the stream")
+
+type streamEntry struct {
+	header   *tar.Header
+	content  []byte      // 保存在内存中的文件
+	uploaded *descriptor // 读取时已经上传的 blob
+}
+
+// 实现 fs.FS，只能读取保存在内存中的文件，已上传的 blob 通过 streamedBlob 得到其 descriptor
+type streamFS struct {
+	entries map[string]*streamEntry
+}
+
+// 顺序读取镜像包的 tar 数据流，layer 读取时直接上传到 image，未压缩的 layer 按 compression 压缩
+func readImageStream(image *Image, stream io.Reader, compression string) (*streamFS, error) {
+	s := &streamFS{entries: map[string]*streamEntry{}}
+	tarFile := tar.NewReader(stream)
+	for {
+		header, err := tarFile.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name, err := checkTarName(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		switch header.Typeflag {
+		case tar.TypeSymlink, tar.TypeLink:
+			s.entries[name] = &streamEntry{header: header}
+			continue
+		case tar.TypeReg:
+		default:
+			continue
+		}
+
+		entry := &streamEntry{header: header}
+		s.entries[name] = entry
+		reader := bufio.NewReaderSize(tarFile, 512)
+		head, _ := reader.Peek(512)
+		fileType := detectCompressionBytes(head)
+		if fileType == "tar" && !isTarHeader(head) && header.Size <= streamMemoryLimit {
+			if entry.content, err = io.ReadAll(reader); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if entry.uploaded, err = uploadStreamMember(image, name, header.Size, reader, fileType, compression); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return s, nil
+}
+
+// tar 的第一个块：ustar 格式的 header，或者空 tar 包的结束块
+func isTarHeader(head []byte) bool {
+	if len(head) < 512 {
+		return false
+	}
+	return string(head[257:262]) == "ustar" || bytes.Equal(head, make([]byte, 512))
+}
+
+// 上传数据流中的一个文件：OCI layout 中按 digest 引用的 blob 和已经压缩的 layer 原样上传，未压缩的 layer 一边压缩一边上传
+func uploadStreamMember(image *Image, name string, size int64, r io.Reader, fileType string, compression string) (desc *descriptor, err error) {
+	desc = &descriptor{Compression: fileType, MediaType: layerMediaType(fileType, true)}
+	expected := ""
+	if parts := strings.Split(name, "/"); len(parts) == 3 && parts[0] == "blobs" {
+		expected = parts[1] + ":" + parts[2]
+		if exist, e := blobExists(image, expected); e == nil && exist {
+			fmt.Printf("blob %s (%s) already exists\n", name, expected)
+			desc.Digest, desc.Size = expected, size
+			_, err = io.Copy(io.Discard, r)
+			return
+		}
+	}
+
+	if len(expected) > 0 || fileType != "tar" || compression == "none" {
+		fmt.Printf("Uploading blob %s ...\n", name)
+		if desc.Digest, desc.Size, err = uploadBlobStream(image, r); err != nil {
+			return
+		}
+		if len(expected) > 0 && desc.Digest != expected {
+			err = fmt.Errorf("blob %s does not match its digest %s", expected, desc.Digest)
+		}
+		return
+	}
+
+	fmt.Printf("Uploading layer %s (%s) ...\n", name, compression)
+	diffHash := sha256.New()
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w, err := newCompressWriter(pw, compression)
+		if err == nil {
+			_, err = io.Copy(w, io.TeeReader(r, diffHash))
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	desc.Digest, desc.Size, err = uploadBlobStream(image, pr)
+	// 上传失败时结束压缩
+	pr.Close()
+	<-done
+	if err != nil {
+		return
+	}
+	desc.Compression = compression
+	desc.MediaType = layerMediaType(compression, true)
+	saveCompressedDigest(fmt.Sprintf("sha256:%x", diffHash.Sum(nil)), *desc)
+	return
+}
+
+func (s *streamFS) lookup(name string) (*streamEntry, error) {
+	name, err := resolveTarLink(name, func(name string) *tar.Header {
+		if entry, ok := s.entries[name]; ok {
+			return entry.header
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.entries[name], nil
+}
+
+func (s *streamFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	entry, err := s.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if entry.header.Typeflag != tar.TypeReg {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if entry.uploaded != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errStreamedBlob}
+	}
+	return &tarFile{
+		SectionReader: io.NewSectionReader(bytes.NewReader(entry.content), 0, int64(len(entry.content))),
+		info:          entry.header.FileInfo(),
+	}, nil
+}
+
+// 已上传的 blob 也可以得到文件信息
+func (s *streamFS) Stat(name string) (fs.FileInfo, error) {
+	entry, err := s.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return entry.header.FileInfo(), nil
+}
+
+// fsys 中的文件在读取数据流时已经上传，返回其 descriptor
+func streamedBlob(fsys fs.FS, name string) (*descriptor, bool) {
+	s, ok := fsys.(*streamFS)
+	if !ok {
+		return nil, false
+	}
+	entry, err := s.lookup(name)
+	if err != nil || entry.uploaded == nil {
+		return nil, false
+	}
+	return entry.uploaded, true
+}
@@ -0,0 +1,214 @@
+package utils_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fastjson"
+	"main.go/utils"
+)
+
+// 简单的仓库，记录上传的 blob 和 manifest（按 tag 和 digest），以及以数据流方式上传的 blob 数量
+type pushRegistry struct {
+	*httptest.Server
+	lock      sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	uploads   map[string]*bytes.Buffer
+	streamed  int
+}
+
+func newPushRegistry(t *testing.T) *pushRegistry {
+	r := &pushRegistry{blobs: map[string][]byte{}, manifests: map[string][]byte{}, uploads: map[string]*bytes.Buffer{}}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			fmt.Fprint(w, `{"token": "tok"}`)
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer tok" {
+			w.Header().Set("www-authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, r.URL))
+			w.WriteHeader(401)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		const prefix = "/v2/t/app/"
+		name := strings.TrimPrefix(req.URL.Path, prefix)
+		switch {
+		case (req.Method == "HEAD" || req.Method == "GET") && strings.HasPrefix(name, "blobs/sha256:"):
+			blob, ok := r.blobs[strings.TrimPrefix(name, "blobs/")]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write(blob)
+		case req.Method == "GET" && strings.HasPrefix(name, "manifests/"):
+			manifest, ok := r.manifests[strings.TrimPrefix(name, "manifests/")]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			var value struct {
+				MediaType string `json:"mediaType"`
+			}
+			json.Unmarshal(manifest, &value)
+			w.Header().Set("Content-Type", value.MediaType)
+			w.Write(manifest)
+		case req.Method == "POST" && name == "blobs/uploads/":
+			id := fmt.Sprintf("u%d", len(r.uploads))
+			r.uploads[id] = &bytes.Buffer{}
+			w.Header().Set("Location", prefix+"blobs/uploads/"+id)
+			w.WriteHeader(202)
+		case req.Method == "PATCH" && strings.HasPrefix(name, "blobs/uploads/"):
+			if req.ContentLength < 0 {
+				r.streamed++
+			}
+			r.uploads[strings.TrimPrefix(name, "blobs/uploads/")].Write(body)
+			w.Header().Set("Location", req.URL.Path+"?_state=1")
+			w.WriteHeader(202)
+		case req.Method == "PUT" && strings.HasPrefix(name, "blobs/uploads/"):
+			upload := r.uploads[strings.TrimPrefix(name, "blobs/uploads/")]
+			upload.Write(body)
+			digest := fmt.Sprintf("sha256:%x", sha256.Sum256(upload.Bytes()))
+			if digest != req.URL.Query().Get("digest") {
+				w.WriteHeader(400)
+				return
+			}
+			r.blobs[digest] = upload.Bytes()
+			w.WriteHeader(201)
+		case req.Method == "PUT" && strings.HasPrefix(name, "manifests/"):
+			r.manifests[strings.TrimPrefix(name, "manifests/")] = body
+			r.manifests[fmt.Sprintf("sha256:%x", sha256.Sum256(body))] = body
+			w.WriteHeader(201)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	return r
+}
+
+func gzipBytes(t *testing.T, content []byte) []byte {
+	var buff bytes.Buffer
+	w := gzip.NewWriter(&buff)
+	_, err := w.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buff.Bytes()
+}
+
+func zstdBytes(t *testing.T, content []byte) []byte {
+	var buff bytes.Buffer
+	w, err := zstd.NewWriter(&buff)
+	assert.NoError(t, err)
+	_, err = w.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buff.Bytes()
+}
+
+func sha256Hex(content []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+// 标准输入和压缩过的镜像包读取时直接上传 layer，不使用临时目录
+func Test_PushImageStream(t *testing.T) {
+	t.Setenv("GO_DOCKER_CACHE_DIR", t.TempDir())
+	t.Setenv("TMPDIR", path.Join(t.TempDir(), "missing"))
+
+	layer := buildTar(t, []tarItem{{name: "etc/hostname", content: "app"}})
+	config := `{"architecture": "amd64", "os": "linux", "rootfs": {"type": "layers", "diff_ids": ["sha256:` + sha256Hex(layer) + `"]}}`
+	// docker save 的 manifest.json 在最后，第二个 layer 是指向第一个的符号链接
+	dockerArchive := buildTar(t, []tarItem{
+		{name: "1111/layer.tar", content: string(layer)},
+		{name: "2222/layer.tar", typeflag: '2', linkname: "../1111/layer.tar"},
+		{name: "config.json", content: config},
+		{name: "manifest.json", content: `[{"Config": "config.json", "RepoTags": ["app:1"], "Layers": ["1111/layer.tar", "2222/layer.tar"]}]`},
+	})
+
+	// docker 25 之后的 docker save：OCI layout 中的 layer 原样上传
+	manifest := `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"config": {"mediaType": "application/vnd.oci.image.config.v1+json", "digest": "sha256:` + sha256Hex([]byte(config)) + `", "size": ` + fmt.Sprint(len(config)) + `},
+		"layers": [{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": "sha256:` + sha256Hex(layer) + `", "size": ` + fmt.Sprint(len(layer)) + `}]}`
+	ociArchive := buildTar(t, []tarItem{
+		{name: "blobs/sha256/" + sha256Hex(layer), content: string(layer)},
+		{name: "blobs/sha256/" + sha256Hex([]byte(config)), content: config},
+		{name: "blobs/sha256/" + sha256Hex([]byte(manifest)), content: manifest},
+		{name: "index.json", content: `{"schemaVersion": 2, "manifests": [{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:` + sha256Hex([]byte(manifest)) + `", "size": ` + fmt.Sprint(len(manifest)) + `}]}`},
+		{name: "manifest.json", content: `[{"Config": "blobs/sha256/` + sha256Hex([]byte(config)) + `", "Layers": ["blobs/sha256/` + sha256Hex(layer) + `"]}]`},
+		{name: "oci-layout", content: `{"imageLayoutVersion": "1.0.0"}`},
+	})
+
+	dir := t.TempDir()
+	cases := []struct {
+		name    string
+		content []byte
+		oci     bool
+	}{
+		{"-", dockerArchive, false},
+		{"image.tar.gz", gzipBytes(t, dockerArchive), false},
+		{"image.tar.zst", zstdBytes(t, ociArchive), true},
+		{"-", gzipBytes(t, ociArchive), true},
+	}
+	for _, c := range cases {
+		registry := newPushRegistry(t)
+		filename := c.name
+		if filename == "-" {
+			stdin, writer, err := os.Pipe()
+			assert.NoError(t, err)
+			go func() {
+				writer.Write(c.content)
+				writer.Close()
+			}()
+			original := os.Stdin
+			os.Stdin = stdin
+			defer func() {
+				os.Stdin = original
+			}()
+		} else {
+			filename = path.Join(dir, c.name)
+			assert.NoError(t, os.WriteFile(filename, c.content, 0644))
+		}
+
+		image := utils.NewImage(strings.TrimPrefix(registry.URL, "http://")+"/t/app:1", "", "", true, "", "linux", "amd64", "")
+		assert.NoError(t, utils.PushImage(filename, &image, utils.PushOptions{Compression: "gzip"}), c.name)
+		registry.Close()
+
+		pushed, err := fastjson.ParseBytes(registry.manifests["1"])
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, "sha256:"+sha256Hex([]byte(config)), string(pushed.GetStringBytes("config", "digest")), c.name)
+		assert.Equal(t, config, string(registry.blobs["sha256:"+sha256Hex([]byte(config))]), c.name)
+		layers := pushed.GetArray("layers")
+		if c.oci {
+			assert.Len(t, layers, 1, c.name)
+			assert.Equal(t, "sha256:"+sha256Hex(layer), string(layers[0].GetStringBytes("digest")), c.name)
+			assert.Equal(t, layer, registry.blobs["sha256:"+sha256Hex(layer)], c.name)
+		} else {
+			// 上传时压缩，两个 layer 为同一个 blob
+			assert.Len(t, layers, 2, c.name)
+			digest := string(layers[0].GetStringBytes("digest"))
+			assert.Equal(t, digest, string(layers[1].GetStringBytes("digest")), c.name)
+			assert.Equal(t, "application/vnd.docker.image.rootfs.diff.tar.gzip", string(layers[0].GetStringBytes("mediaType")), c.name)
+			reader, err := gzip.NewReader(bytes.NewReader(registry.blobs[digest]))
+			assert.NoError(t, err, c.name)
+			uncompressed, err := io.ReadAll(reader)
+			assert.NoError(t, err, c.name)
+			assert.Equal(t, layer, uncompressed, c.name)
+		}
+		// layer 以 chunked 编码上传，config 在读取完 manifest 之后上传
+		assert.Equal(t, 1, registry.streamed, c.name)
+	}
+}
@@ -0,0 +1,261 @@
+package utils
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 检查 tar 包中的文件名，拒绝绝对路径和包含 .. 的路径，返回规范化后的相对路径
+func checkTarName(name string) (string, error) {
+	normalized := strings.ReplaceAll(name, `\`, "/")
+	if path.IsAbs(normalized) || (len(normalized) > 1 && normalized[1] == ':') {
+		return "", fmt.Errorf("unsafe absolute path in tar: %q", name)
+	}
+	for _, part := range strings.Split(normalized, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("unsafe path with '..' in tar: %q", name)
+		}
+	}
+	cleaned := cleanTarName(normalized)
+	if cleaned == "" {
+		cleaned = "."
+	}
+	return cleaned, nil
+}
+
+// 检查 root 下的相对路径 name 的每一级父目录，不允许经过符号链接，避免写到 root 之外
+func checkNoSymlinkParent(root string, name string) error {
+	current := root
+	for _, part := range strings.Split(path.Dir(name), "/") {
+		if part == "." || part == "" {
+			continue
+		}
+		current = path.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("unsafe path in tar: %q goes through symlink %q", name, current)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("unsafe path in tar: %q, %q is not a directory", name, current)
+		}
+	}
+	return nil
+}
+
+// 检查符号链接的目标是否在解压目录之内
+func checkSymlinkTarget(name string, linkname string) error {
+	if path.IsAbs(linkname) {
+		return fmt.Errorf("unsafe symlink in tar: %q -> %q is absolute", name, linkname)
+	}
+	target := path.Join(path.Dir(name), linkname)
+	if target == ".." || strings.HasPrefix(target, "../") {
+		return fmt.Errorf("unsafe symlink in tar: %q -> %q escapes the target directory", name, linkname)
+	}
+	return nil
+}
+
+// 删除已存在的文件，避免通过已存在的符号链接写到其他位置
+func removeExisting(filename string) error {
+	info, err := os.Lstat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	return os.Remove(filename)
+}
+
+// 安全地解压镜像 tar 包到 targetFolder，解压的总大小不超过 maxSize
+func extractTar(r io.Reader, targetFolder string, maxSize int64) error {
+	var totalSize int64
+	tarFile := tar.NewReader(r)
+	for {
+		header, err := tarFile.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := checkTarName(header.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." || header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if err = checkNoSymlinkParent(targetFolder, name); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "extract file %s ...\n", name)
+		outFilename := path.Join(targetFolder, name)
+		if header.Typeflag != tar.TypeDir {
+			if err = ensureDir(path.Dir(outFilename)); err != nil {
+				return err
+			}
+			if err = removeExisting(outFilename); err != nil {
+				return err
+			}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(outFilename, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			totalSize += header.Size
+			if totalSize > maxSize {
+				return fmt.Errorf("tar exceeds the maximum extract size of %d bytes", maxSize)
+			}
+			outFile, err := os.OpenFile(outFilename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(outFile, tarFile)
+			outFile.Close()
+			if err != nil {
+				return fmt.Errorf("extract %q: %w", name, err)
+			}
+		case tar.TypeSymlink:
+			if err = checkSymlinkTarget(name, header.Linkname); err != nil {
+				return err
+			}
+			if err = os.Symlink(header.Linkname, outFilename); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linkname, err := checkTarName(header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err = checkNoSymlinkParent(targetFolder, linkname); err != nil {
+				return err
+			}
+			linkFilename := path.Join(targetFolder, linkname)
+			if info, err := os.Lstat(linkFilename); err != nil || !info.Mode().IsRegular() {
+				return fmt.Errorf("invalid hardlink in tar: %q -> %q is not an extracted regular file", name, header.Linkname)
+			}
+			if err = os.Link(linkFilename, outFilename); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported entry %q with type %q in tar", name, string(header.Typeflag))
+		}
+	}
+}
+
+// 在 root 内解析路径 name：符号链接以 root 为根目录解析，结果不会超出 root
+func secureJoin(root string, name string) (string, error) {
+	current := ""
+	remaining := strings.Split(name, "/")
+	links := 0
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			current = strings.TrimPrefix(path.Dir("/"+current), "/")
+			continue
+		}
+
+		next := path.Join(current, part)
+		info, err := os.Lstat(path.Join(root, next))
+		if os.IsNotExist(err) {
+			current = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		links++
+		if links > 255 {
+			return "", fmt.Errorf("too many levels of symlinks: %q", name)
+		}
+		target, err := os.Readlink(path.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			current = ""
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	return path.Join(root, current), nil
+}
+
+// 将目录中的文件打包为 tar 文件，文件按名字排序
+func tarDirectory(dir string, output string) (err error) {
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(output)
+		}
+	}()
+
+	tarWriter := tar.NewWriter(file)
+	err = filepath.WalkDir(dir, func(filename string, entry fs.DirEntry, err error) error {
+		if err != nil || filename == dir {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(dir, filename)
+		header.Name = filepath.ToSlash(name)
+		if entry.IsDir() {
+			header.Name += "/"
+		}
+		if err = tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		fp, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		_, err = io.Copy(tarWriter, fp)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
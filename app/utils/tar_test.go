@@ -0,0 +1,124 @@
+package utils_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_CheckTarName(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected string
+		ok       bool
+	}{
+		{"a/b.txt", "a/b.txt", true},
+		{"./a//b/", "a/b", true},
+		{"./", ".", true},
+		{"a/./b", "a/b", true},
+		{"/etc/passwd", "", false},
+		{"../evil", "", false},
+		{"a/../../evil", "", false},
+		{"a/..", "", false},
+		{`..\evil`, "", false},
+		{`C:\evil`, "", false},
+	}
+	for _, c := range cases {
+		name, err := utils.CheckTarName(c.name)
+		assert.Equal(t, c.ok, err == nil, c.name)
+		assert.Equal(t, c.expected, name, c.name)
+	}
+}
+
+func Test_CheckSymlinkTarget(t *testing.T) {
+	cases := []struct {
+		name     string
+		linkname string
+		ok       bool
+	}{
+		{"a/link", "b", true},
+		{"a/link", "../b", true},
+		{"a/b/link", "../../c", true},
+		{"link", "../etc", false},
+		{"a/link", "../../etc", false},
+		{"link", "/etc/passwd", false},
+	}
+	for _, c := range cases {
+		err := utils.CheckSymlinkTarget(c.name, c.linkname)
+		assert.Equal(t, c.ok, err == nil, c.name+" -> "+c.linkname)
+	}
+}
+
+func Test_SecureJoin(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.MkdirAll(path.Join(root, "usr/lib"), 0755))
+	assert.NoError(t, os.Symlink("/usr/lib", path.Join(root, "lib")))
+	assert.NoError(t, os.Symlink("../../../../etc", path.Join(root, "usr/escape")))
+	assert.NoError(t, os.Symlink("loop", path.Join(root, "loop")))
+
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		{"usr/lib/a.so", "usr/lib/a.so"},
+		// 绝对路径的符号链接以 root 为根目录
+		{"lib/a.so", "usr/lib/a.so"},
+		// 相对路径的符号链接不能超出 root
+		{"usr/escape/passwd", "etc/passwd"},
+		{"../../etc/shadow", "etc/shadow"},
+		{"new/file", "new/file"},
+	}
+	for _, c := range cases {
+		joined, err := utils.SecureJoin(root, c.name)
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, path.Join(root, c.expected), joined, c.name)
+	}
+
+	_, err := utils.SecureJoin(root, "loop/a")
+	assert.Error(t, err)
+}
+
+func Test_ExtractTar(t *testing.T) {
+	dir := t.TempDir()
+	content := buildTar(t, []tarItem{
+		{name: "a/", typeflag: tar.TypeDir},
+		{name: "a/file", content: "hello"},
+		{name: "b/file", content: "no parent entry"},
+		{name: "a/link", typeflag: tar.TypeSymlink, linkname: "file"},
+		{name: "a/hard", typeflag: tar.TypeLink, linkname: "a/file"},
+	})
+	assert.NoError(t, utils.ExtractTar(bytes.NewReader(content), dir, 1024))
+	for _, name := range []string{"a/file", "a/link", "a/hard"} {
+		data, err := os.ReadFile(path.Join(dir, name))
+		assert.NoError(t, err, name)
+		assert.Equal(t, "hello", string(data), name)
+	}
+
+	cases := []struct {
+		name  string
+		items []tarItem
+	}{
+		{"traversal", []tarItem{{name: "../evil", content: "x"}}},
+		{"absolute", []tarItem{{name: "/evil", content: "x"}}},
+		{"symlink escape", []tarItem{{name: "link", typeflag: tar.TypeSymlink, linkname: "../../etc"}}},
+		// 先创建指向目录内的链接，再通过链接写文件
+		{"write through symlink", []tarItem{
+			{name: "d/", typeflag: tar.TypeDir},
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "d"},
+			{name: "link/file", content: "x"},
+		}},
+		{"hardlink outside", []tarItem{{name: "hard", typeflag: tar.TypeLink, linkname: "../etc/passwd"}}},
+		{"hardlink to missing", []tarItem{{name: "hard", typeflag: tar.TypeLink, linkname: "missing"}}},
+		{"device", []tarItem{{name: "dev", typeflag: tar.TypeChar}}},
+		{"too large", []tarItem{{name: "big", content: string(make([]byte, 2048))}}},
+	}
+	for _, c := range cases {
+		err := utils.ExtractTar(bytes.NewReader(buildTar(t, c.items)), t.TempDir(), 1024)
+		assert.Error(t, err, c.name)
+	}
+}
@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 一次申请 token 时最多包含的 repository 数量，避免 url 过长
+const maxTokenScopes = 20
+
+// 批量下载时共享的 pull token：同一个仓库的多个 repository 使用一个 token，在过期之前重复使用
+// 申请 token 时不持有 lock，同一个仓库同时只有一个申请，等待的 repository 使用其结果，不同仓库的申请互不阻塞
+type tokenCache struct {
+	lock         sync.Mutex
+	repositories map[string][]string    // registry -> 需要下载的 repository
+	tokens       map[string]cachedToken // <registry>/<repository> -> token
+	requesting   map[string]*sync.Mutex // registry -> 申请 token 时持有
+}
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{repositories: map[string][]string{}, tokens: map[string]cachedToken{}, requesting: map[string]*sync.Mutex{}}
+}
+
+// 记录将要下载的 repository，申请 token 时一起申请它们的权限
+func (c *tokenCache) register(image *Image) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, repository := range c.repositories[image.Registry] {
+		if repository == image.Repository {
+			return
+		}
+	}
+	c.repositories[image.Registry] = append(c.repositories[image.Registry], image.Repository)
+}
+
+// 未过期的 token，调用时需要持有 lock
+func (c *tokenCache) cached(registry string, repository string, now time.Time) (string, bool) {
+	cached, ok := c.tokens[fmt.Sprintf("%s/%s", registry, repository)]
+	if !ok || !now.Before(cached.expires) {
+		return "", false
+	}
+	return cached.token, true
+}
+
+func (c *tokenCache) pullToken(image *Image) string {
+	c.lock.Lock()
+	if token, ok := c.cached(image.Registry, image.Repository, time.Now()); ok {
+		c.lock.Unlock()
+		return token
+	}
+	requesting, ok := c.requesting[image.Registry]
+	if !ok {
+		requesting = &sync.Mutex{}
+		c.requesting[image.Registry] = requesting
+	}
+	c.lock.Unlock()
+
+	requesting.Lock()
+	defer requesting.Unlock()
+
+	// 等待期间其他 repository 的申请可能已经包含当前的 repository
+	c.lock.Lock()
+	now := time.Now()
+	if token, ok := c.cached(image.Registry, image.Repository, now); ok {
+		c.lock.Unlock()
+		return token
+	}
+	repositories := []string{image.Repository}
+	scopes := []string{}
+	for _, repository := range c.repositories[image.Registry] {
+		if len(repositories) >= maxTokenScopes {
+			break
+		}
+		if _, ok := c.cached(image.Registry, repository, now); repository == image.Repository || ok {
+			continue
+		}
+		repositories = append(repositories, repository)
+		scopes = append(scopes, fmt.Sprintf("repository:%s:pull", repository))
+	}
+	c.lock.Unlock()
+
+	token, expiresIn := image.requestTokenWithExpiry("pull", scopes...)
+	// 提前刷新 token，避免下载过程中过期
+	cached := cachedToken{token: token, expires: now.Add(expiresIn * 4 / 5)}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, repository := range repositories {
+		c.tokens[fmt.Sprintf("%s/%s", image.Registry, repository)] = cached
+	}
+	return token
+}
@@ -0,0 +1,86 @@
+package utils_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+// 只返回 token 的仓库，每次申请 token 前调用 wait
+func newTokenRegistry(t *testing.T, token string, wait func()) (*httptest.Server, *int32) {
+	var requests int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			atomic.AddInt32(&requests, 1)
+			wait()
+			fmt.Fprintf(w, `{"token": "%s", "expires_in": 300}`, token)
+			return
+		}
+		w.Header().Set("www-authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+		w.WriteHeader(401)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func Test_PullTokenConcurrent(t *testing.T) {
+	// 申请一个仓库的 token 时，不阻塞其他仓库
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slow, _ := newTokenRegistry(t, "slow", func() {
+		close(started)
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+	})
+	fast, _ := newTokenRegistry(t, "fast", func() {})
+	slowName := strings.TrimPrefix(slow.URL, "http://") + "/t/app:1"
+	fastName := strings.TrimPrefix(fast.URL, "http://") + "/t/app:1"
+
+	cache := utils.NewTokenCache()
+	done := make(chan string)
+	go func() {
+		done <- cache.PullToken(slowName)
+	}()
+	<-started
+	begin := time.Now()
+	assert.Equal(t, "fast", cache.PullToken(fastName))
+	assert.Less(t, time.Since(begin), 2*time.Second)
+	close(release)
+	assert.Equal(t, "slow", <-done)
+
+	// 同一个仓库的 repository 同时申请时只申请一次，token 包含所有已登记的 repository
+	gate := make(chan struct{})
+	shared, requests := newTokenRegistry(t, "shared", func() {
+		<-gate
+	})
+	cache = utils.NewTokenCache()
+	names := []string{}
+	for _, repository := range []string{"t/a", "t/b", "t/c"} {
+		name := strings.TrimPrefix(shared.URL, "http://") + "/" + repository + ":1"
+		cache.Register(name)
+		names = append(names, name)
+	}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			assert.Equal(t, "shared", cache.PullToken(name))
+		}(name)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+}
@@ -0,0 +1,321 @@
+package utils
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// https://github.com/opencontainers/image-spec/blob/main/layer.md#whiteouts
+const whiteoutPrefix = ".wh."
+const whiteoutOpaque = ".wh..wh..opq"
+
+// 返回 whiteout 文件删除的路径，name 不是 whiteout 文件时 ok 为 false
+// 删除的只能是同一目录下的一个文件，".wh.."、".wh..." 等会删除到目录本身或 rootfs 之外
+func whiteoutTarget(name string) (target string, ok bool, err error) {
+	base := path.Base(name)
+	if !strings.HasPrefix(base, whiteoutPrefix) || base == whiteoutOpaque {
+		return "", false, nil
+	}
+	deleted := strings.TrimPrefix(base, whiteoutPrefix)
+	if deleted == "" || deleted == "." || deleted == ".." || strings.Contains(deleted, "/") {
+		return "", true, fmt.Errorf("invalid whiteout in tar: %q", name)
+	}
+	return path.Join(path.Dir(name), deleted), true, nil
+}
+
+// 将 layer 依次应用到 rootfs 目录，得到镜像最终的文件系统
+type unpacker struct {
+	rootfs string
+	rootless string					// 无 root 权限时记录属主的方式：xattr, sidecar
+	idMap *subIDMap					// 将容器内的 uid/gid 映射为宿主机的 subuid/subgid
+	stats map[string]*fileStat		// sidecar 模式下记录的文件属性
+	skipped map[string]int			// 因权限不足跳过的操作
+}
+
+func newUnpacker(opts *PullOptions) (*unpacker, error) {
+	u := &unpacker{
+		rootfs: opts.Unpack,
+		rootless: opts.Rootless,
+		stats: map[string]*fileStat{},
+		skipped: map[string]int{},
+	}
+	if len(opts.SubIDUser) > 0 {
+		if len(opts.Rootless) > 0 {
+			return nil, fmt.Errorf("subuid mapping cannot be used with rootless unpack")
+		}
+		if os.Geteuid() != 0 {
+			// 没有权限时所有的 chown 都会失败，映射不会生效
+			return nil, fmt.Errorf("--subid-user requires root to change the ownership, run it with sudo or use --rootless")
+		}
+		idMap, err := loadSubIDMap(opts.SubIDUser)
+		if err != nil {
+			return nil, err
+		}
+		u.idMap = idMap
+	}
+	return u, nil
+}
+
+// 依次解压 layer 文件（可以是 gzip/zstd 压缩的）到 rootfs 目录
+func unpackLayers(layerFiles []string, opts *PullOptions) error {
+	rootfs := opts.Unpack
+	if err := ensureDir(rootfs); err != nil {
+		return err
+	}
+	u, err := newUnpacker(opts)
+	if err != nil {
+		return err
+	}
+	for idx, layerFile := range layerFiles {
+		fmt.Printf("[%d/%d] Unpacking layer %s to %s\n", idx + 1, len(layerFiles), layerFile, rootfs)
+		fp, err := os.Open(layerFile)
+		if err != nil {
+			return err
+		}
+		stream, err := decompressStream(fp)
+		if err == nil {
+			err = u.applyLayer(stream)
+			stream.Close()
+		}
+		fp.Close()
+		if err != nil {
+			return fmt.Errorf("unpack layer %s: %w", layerFile, err)
+		}
+	}
+	for op, count := range u.skipped {
+		fmt.Printf("warning: skipped %d %s operations without privileges\n", count, op)
+	}
+	if u.rootless == "sidecar" {
+		sidecar := strings.TrimSuffix(rootfs, "/") + ".mtree"
+		fmt.Printf("write ownership and permissions to %s\n", sidecar)
+		return writeMtree(sidecar, u.stats)
+	}
+	return nil
+}
+
+// 解压一个 layer 的 tar 数据流
+func (u *unpacker) applyLayer(r io.Reader) error {
+	// 当前 layer 写入的路径，用于处理 opaque 目录
+	layerPaths := map[string]bool{}
+	type dirTime struct {
+		filename string
+		modTime time.Time
+	}
+	dirTimes := []dirTime{}
+
+	tarFile := tar.NewReader(r)
+	for {
+		header, err := tarFile.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name, err := checkTarName(header.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." || header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		parent, err := secureJoin(u.rootfs, path.Dir(name))
+		if err != nil {
+			return err
+		}
+		base := path.Base(name)
+
+		// 处理 whiteout 文件
+		if base == whiteoutOpaque {
+			if err = u.clearOpaqueDir(parent, path.Dir(name), layerPaths); err != nil {
+				return err
+			}
+			continue
+		}
+		if target, ok, err := whiteoutTarget(name); ok {
+			if err != nil {
+				return err
+			}
+			filename := path.Join(parent, path.Base(target))
+			u.forgetStat(filename, true)
+			if err = os.RemoveAll(filename); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// layer 中可以没有父目录的条目，如只有 usr/bin/foo
+		if err = os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		layerPaths[name] = true
+		filename := path.Join(parent, base)
+		if err = u.applyEntry(header, filename, tarFile); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			dirTimes = append(dirTimes, dirTime{filename, header.ModTime})
+		}
+	}
+
+	// 目录的修改时间会被其中的文件改变，最后再设置
+	for i := len(dirTimes) - 1; i >= 0; i-- {
+		os.Chtimes(dirTimes[i].filename, dirTimes[i].modTime, dirTimes[i].modTime)
+	}
+	return nil
+}
+
+// 删除 opaque 目录中来自下层 layer 的文件
+func (u *unpacker) clearOpaqueDir(dir string, name string, layerPaths map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if layerPaths[path.Join(name, entry.Name())] {
+			continue
+		}
+		u.forgetStat(path.Join(dir, entry.Name()), true)
+		if err = os.RemoveAll(path.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *unpacker) applyEntry(header *tar.Header, filename string, r io.Reader) error {
+	// 已存在的文件先删除，同为目录时保留目录中的内容
+	if info, err := os.Lstat(filename); err == nil {
+		if !(info.IsDir() && header.Typeflag == tar.TypeDir) {
+			u.forgetStat(filename, info.IsDir())
+			if err = os.RemoveAll(filename); err != nil {
+				return err
+			}
+		}
+	}
+
+	mode := header.FileInfo().Mode()
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(filename, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg:
+		fp, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fp, r)
+		fp.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(header.Linkname, filename); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		linkname, err := checkTarName(header.Linkname)
+		if err != nil {
+			return err
+		}
+		linkParent, err := secureJoin(u.rootfs, path.Dir(linkname))
+		if err != nil {
+			return err
+		}
+		linkFilename := path.Join(linkParent, path.Base(linkname))
+		if err = os.Link(linkFilename, filename); err != nil {
+			return err
+		}
+		// 硬链接与目标共享权限和属主
+		u.linkStat(filename, linkFilename)
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if u.rootless == "xattr" || (u.rootless == "sidecar" && header.Typeflag != tar.TypeFifo) {
+			// 无权限创建设备文件，使用空文件代替，设备号记录在 xattr 或 sidecar 中；
+			// 特殊文件上不能设置 user.* 的 xattr，xattr 模式下 fifo 也使用空文件代替
+			fp, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			fp.Close()
+			break
+		}
+		if err := mknod(filename, header); err != nil {
+			if errors.Is(err, fs.ErrPermission) {
+				u.skipped["mknod"]++
+				return nil
+			}
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported entry type %q", string(header.Typeflag))
+	}
+
+	return u.applyMetadata(header, filename, mode)
+}
+
+// 设置属主、权限、xattr 和修改时间
+func (u *unpacker) applyMetadata(header *tar.Header, filename string, mode fs.FileMode) error {
+	if len(u.rootless) > 0 {
+		return u.applyRootlessMetadata(header, filename, mode)
+	}
+
+	// chown 会清除 setuid/setgid，需要在 chmod 之前
+	uid, gid := header.Uid, header.Gid
+	if u.idMap != nil {
+		var err error
+		if uid, gid, err = u.idMap.toHost(uid, gid); err != nil {
+			return err
+		}
+	}
+	if err := os.Lchown(filename, uid, gid); err != nil {
+		if !errors.Is(err, fs.ErrPermission) || u.idMap != nil {
+			return err
+		}
+		u.skipped["chown"]++
+	}
+
+	if err := u.applyXattrs(header, filename); err != nil {
+		return err
+	}
+
+	if header.Typeflag == tar.TypeSymlink {
+		lutimes(filename, header.ModTime)
+		return nil
+	}
+	if err := os.Chmod(filename, mode.Perm()|mode&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeDir {
+		os.Chtimes(filename, header.ModTime, header.ModTime)
+	}
+	return nil
+}
+
+// 设置 tar 中记录的 xattr，无权限或文件系统不支持时跳过
+func (u *unpacker) applyXattrs(header *tar.Header, filename string) error {
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, "SCHILY.xattr.") {
+			continue
+		}
+		if err := lsetxattr(filename, strings.TrimPrefix(key, "SCHILY.xattr."), []byte(value)); err != nil {
+			if !errors.Is(err, fs.ErrPermission) && !errors.Is(err, errors.ErrUnsupported) {
+				return err
+			}
+			u.skipped["xattr"]++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"archive/tar"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func mknod(filename string, header *tar.Header) error {
+	mode := uint32(header.Mode & 07777)
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	return syscall.Mknod(filename, mode, int(mkdev(header.Devmajor, header.Devminor)))
+}
+
+func mkdev(major int64, minor int64) uint64 {
+	return (uint64(major)&0xfffff000)<<32 | (uint64(major)&0xfff)<<8 |
+		(uint64(minor)&0xffffff00)<<12 | uint64(minor)&0xff
+}
+
+// syscall 中没有 lsetxattr，直接调用系统调用，不跟随符号链接
+func lsetxattr(filename string, attr string, data []byte) error {
+	p, err := syscall.BytePtrFromString(filename)
+	if err != nil {
+		return err
+	}
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	var d unsafe.Pointer
+	if len(data) > 0 {
+		d = unsafe.Pointer(&data[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)), uintptr(d), uintptr(len(data)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// 设置符号链接本身的修改时间
+func lutimes(filename string, modTime time.Time) error {
+	p, err := syscall.BytePtrFromString(filename)
+	if err != nil {
+		return err
+	}
+	ts := []syscall.Timespec{syscall.NsecToTimespec(modTime.UnixNano()), syscall.NsecToTimespec(modTime.UnixNano())}
+	atFdcwd := -100
+	const atSymlinkNofollow = 0x100
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(atFdcwd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])), uintptr(atSymlinkNofollow), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
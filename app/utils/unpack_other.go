@@ -0,0 +1,21 @@
+//go:build !linux
+
+package utils
+
+import (
+	"archive/tar"
+	"errors"
+	"time"
+)
+
+func mknod(filename string, header *tar.Header) error {
+	return errors.ErrUnsupported
+}
+
+func lsetxattr(filename string, attr string, data []byte) error {
+	return errors.ErrUnsupported
+}
+
+func lutimes(filename string, modTime time.Time) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,96 @@
+package utils_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"main.go/utils"
+)
+
+func Test_ApplyLayer(t *testing.T) {
+	rootfs := t.TempDir()
+	layers := [][]tarItem{
+		{
+			// 没有 usr/ 和 usr/bin/ 的目录条目
+			{name: "usr/bin/foo", content: "foo"},
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/a.conf", content: "a"},
+			{name: "etc/b.conf", content: "b"},
+			{name: "opt/app/old", content: "old"},
+			{name: "lib", typeflag: tar.TypeSymlink, linkname: "usr/lib"},
+		},
+		{
+			{name: "etc/.wh.a.conf"},
+			{name: "opt/app/.wh..wh..opq"},
+			{name: "opt/app/new", content: "new"},
+			// 经过符号链接的路径在 rootfs 内解析
+			{name: "lib/x.so", content: "x"},
+			{name: "usr/bin/foo", content: "foo2"},
+		},
+	}
+	for _, layer := range layers {
+		assert.NoError(t, utils.ApplyLayer(bytes.NewReader(buildTar(t, layer)), rootfs, "sidecar"))
+	}
+
+	expected := map[string]string{
+		"usr/bin/foo":  "foo2",
+		"etc/b.conf":   "b",
+		"opt/app/new":  "new",
+		"usr/lib/x.so": "x",
+	}
+	for name, content := range expected {
+		data, err := os.ReadFile(path.Join(rootfs, name))
+		assert.NoError(t, err, name)
+		assert.Equal(t, content, string(data), name)
+	}
+	for _, name := range []string{"etc/a.conf", "opt/app/old"} {
+		_, err := os.Lstat(path.Join(rootfs, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+
+	// 不安全的路径
+	err := utils.ApplyLayer(bytes.NewReader(buildTar(t, []tarItem{{name: "../evil", content: "x"}})), rootfs, "sidecar")
+	assert.Error(t, err)
+}
+
+func Test_ApplyLayerInvalidWhiteout(t *testing.T) {
+	dir := t.TempDir()
+	rootfs := path.Join(dir, "rootfs")
+	assert.NoError(t, os.MkdirAll(path.Join(rootfs, "etc"), 0755))
+	assert.NoError(t, os.WriteFile(path.Join(rootfs, "etc/conf"), []byte("conf"), 0644))
+	assert.NoError(t, os.WriteFile(path.Join(dir, "sibling"), []byte("sibling"), 0644))
+
+	// ".wh..." 删除 rootfs 所在的目录，".wh.." 删除 rootfs 或父目录本身
+	for _, name := range []string{".wh...", ".wh..", "etc/.wh...", "etc/.wh..", "etc/.wh..."} {
+		err := utils.ApplyLayer(bytes.NewReader(buildTar(t, []tarItem{{name: name}})), rootfs, "sidecar")
+		assert.ErrorContains(t, err, "invalid whiteout", name)
+		for _, filename := range []string{path.Join(dir, "sibling"), path.Join(rootfs, "etc/conf")} {
+			_, err = os.Stat(filename)
+			assert.NoError(t, err, name)
+		}
+	}
+}
+
+func Test_MapSubID(t *testing.T) {
+	cases := []struct {
+		id       int
+		expected int
+		ok       bool
+	}{
+		// 容器内的 0 为用户本身，1..count 为 subuid 的范围
+		{0, 1000, true},
+		{1, 100000, true},
+		{65536, 165535, true},
+		{65537, 0, false},
+		{-1, 0, false},
+	}
+	for _, c := range cases {
+		id, err := utils.MapSubID(c.id, 1000, 100000, 65536)
+		assert.Equal(t, c.ok, err == nil, c.id)
+		assert.Equal(t, c.expected, id, c.id)
+	}
+}